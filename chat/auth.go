@@ -0,0 +1,313 @@
+package chat
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultSessionTTL is how long a session token is valid when
+// Authenticator.TTL is not set.
+const DefaultSessionTTL = 24 * time.Hour
+
+// SessionCookie is the cookie HandleLogin stores the session token in.
+const SessionCookie = "chat_session"
+
+// NgrokIdentityHeader is the header in which an ngrok edge with the OAuth
+// or OIDC module enabled forwards the signed-in user's email address.
+const NgrokIdentityHeader = "Ngrok-Auth-User-Email"
+
+// ErrInvalidToken is returned by Authenticator.Verify for a token that is
+// malformed, wrongly signed or expired.
+var ErrInvalidToken = errors.New("invalid session token")
+
+// PasswordChecker checks a user's password.
+type PasswordChecker interface {
+	CheckPassword(username, password string) bool
+}
+
+// StaticUsers is a PasswordChecker holding each user's password in memory.
+type StaticUsers map[string]string
+
+func (u StaticUsers) CheckPassword(username, password string) bool {
+	want, ok := u[username]
+	if !ok {
+		// Compare anyway so that unknown users take as long as known ones.
+		want = password + "x"
+	}
+	// Comparing digests keeps the comparison's duration independent of the
+	// password's length.
+	a, b := sha256.Sum256([]byte(want)), sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1 && ok
+}
+
+// Authenticator issues and verifies session tokens. A token is a JWT signed
+// with HMAC-SHA256 whose subject is the username, so any replica holding the
+// same key can verify it without shared session state.
+type Authenticator struct {
+	// Passwords checks the credentials given to HandleLogin. Password
+	// login is off if nil.
+	Passwords PasswordChecker
+	// OIDC, if set, lets users sign in with an OpenID Connect provider.
+	OIDC *OIDCClient
+	// IdentityHeader, if set, is a request header naming the user already
+	// authenticated by a proxy in front of the server, such as
+	// NgrokIdentityHeader. Set it only if every request goes through that
+	// proxy, since anyone reaching the server directly can send the header.
+	IdentityHeader string
+	// Moderators may edit and delete every user's messages.
+	Moderators []string
+	// TTL is how long an issued token is valid, or DefaultSessionTTL if
+	// zero.
+	TTL time.Duration
+
+	key []byte
+}
+
+// NewAuthenticator returns an Authenticator that signs tokens with key and
+// checks passwords with passwords.
+func NewAuthenticator(key []byte, passwords PasswordChecker) *Authenticator {
+	return &Authenticator{Passwords: passwords, key: key}
+}
+
+// claims is the payload of a session token.
+type claims struct {
+	Subject   string `json:"sub"` // Username
+	IssuedAt  int64  `json:"iat"` // Unix time
+	ExpiresAt int64  `json:"exp"` // Unix time
+}
+
+// tokenHeader is the encoded JOSE header of every session token.
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Issue returns a session token for username and when it expires.
+func (a *Authenticator) Issue(username string) (token string, expires time.Time) {
+	ttl := a.TTL
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	now := time.Now()
+	expires = now.Add(ttl)
+
+	payload, _ := json.Marshal(claims{Subject: username, IssuedAt: now.Unix(), ExpiresAt: expires.Unix()})
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + a.sign(signed), expires
+}
+
+// Verify returns the username a token was issued for, or ErrInvalidToken.
+func (a *Authenticator) Verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		// Only the exact header Issue writes is accepted, which rules
+		// out tokens claiming another algorithm, such as "none".
+		return "", ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(a.sign(parts[0]+"."+parts[1]))) {
+		return "", ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	var c claims
+	if err := json.Unmarshal(payload, &c); err != nil || c.Subject == "" {
+		return "", ErrInvalidToken
+	}
+	if time.Now().Unix() >= c.ExpiresAt {
+		return "", ErrInvalidToken
+	}
+	return c.Subject, nil
+}
+
+func (a *Authenticator) sign(signed string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IsModerator reports whether username is one of the Moderators.
+func (a *Authenticator) IsModerator(username string) bool {
+	for _, moderator := range a.Moderators {
+		if moderator == username {
+			return true
+		}
+	}
+	return false
+}
+
+// identify returns the user r was authenticated as, by the proxy in front of
+// the server or by a session token.
+func (a *Authenticator) identify(r *http.Request) (string, bool) {
+	if a.IdentityHeader != "" {
+		if username := r.Header.Get(a.IdentityHeader); username != "" {
+			return username, true
+		}
+	}
+	username, err := a.Verify(tokenFromRequest(r))
+	return username, err == nil
+}
+
+// tokenFromRequest returns the session token sent with r: an Authorization
+// bearer token, else the session cookie, else the token query parameter,
+// which is meant for WebSocket and EventSource clients that can set neither.
+func tokenFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if scheme, token, ok := strings.Cut(auth, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		return cookie.Value
+	}
+	return r.URL.Query().Get("token")
+}
+
+type userKey struct{}
+
+// User returns the authenticated username of a request passed through
+// Server.Authenticate, or false if the server does not authenticate.
+func User(r *http.Request) (string, bool) {
+	username, ok := r.Context().Value(userKey{}).(string)
+	return username, ok
+}
+
+// Authenticate wraps handler so that, if the server has an Authenticator,
+// only requests carrying a valid session token, or authenticated by the
+// proxy named by its IdentityHeader, reach it, with the token's
+// username available from User. Other requests are refused with 401
+// Unauthorized. Without an Authenticator every request is let through.
+func (s *Server) Authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Auth == nil || r.Method == http.MethodOptions {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		username, ok := s.Auth.identify(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="chat"`)
+			WriteError(w, http.StatusUnauthorized, CodeUnauthorized, "Login required")
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, username)))
+	})
+}
+
+// stampUser sets msg.Username to the request's authenticated user, if any,
+// so that clients cannot post under someone else's name. A direct message
+// in a request that is not authenticated is left without a username, which
+// the conversation it names refuses.
+func stampUser(r *http.Request, msg *Message) {
+	if username, ok := User(r); ok {
+		msg.Username = username
+	} else if msg.Direct() {
+		msg.Username = ""
+	}
+}
+
+// HandleLogin checks the JSON credentials {"username": ..., "password": ...}
+// posted to it and answers with a session token:
+//
+//	{"username": "ann", "token": "...", "expires_at": "2024-01-02T15:04:05Z"}
+//
+// The token is also set as the SessionCookie, for browsers. Send it back as
+// an Authorization bearer token, the cookie or, for WebSockets and event
+// streams, the token query parameter.
+//
+// A GET answers with the login methods the server offers:
+//
+//	{"password": true, "oidc": false}
+func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, struct {
+			Password bool `json:"password"`
+			OIDC     bool `json:"oidc"`
+		}{s.Auth != nil && s.Auth.Passwords != nil, s.Auth != nil && s.Auth.OIDC != nil})
+		return
+	}
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return
+	}
+	if s.Auth == nil || s.Auth.Passwords == nil {
+		WriteError(w, http.StatusNotFound, CodeNotFound, "Password login is not enabled")
+		return
+	}
+
+	var credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+	if credentials.Username == "" || !s.Auth.Passwords.CheckPassword(credentials.Username, credentials.Password) {
+		WriteError(w, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid username or password")
+		return
+	}
+
+	token, expires := s.setSessionCookie(w, r, credentials.Username)
+	writeJSON(w, http.StatusOK, struct {
+		Username  string    `json:"username"`
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{credentials.Username, token, expires.UTC()})
+}
+
+// setSessionCookie issues a token for username and sets it as the session
+// cookie.
+func (s *Server) setSessionCookie(w http.ResponseWriter, r *http.Request, username string) (token string, expires time.Time) {
+	token, expires = s.Auth.Issue(username)
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token, expires
+}
+
+// isHTTPS reports whether the client sent r over HTTPS, directly or through
+// a proxy such as an ngrok edge that terminates TLS.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// HandleLogout clears the session cookie. Tokens are not revoked; they stay
+// valid until they expire.
+func (s *Server) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Value: "", Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleMe answers with the authenticated user as {"username": "ann"}, or
+// an empty username if the server does not authenticate.
+func (s *Server) HandleMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	username, _ := User(r)
+	writeJSON(w, http.StatusOK, struct {
+		Username string `json:"username"`
+	}{username})
+}
@@ -0,0 +1,194 @@
+package chat
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestTokens(t *testing.T) {
+	auth := NewAuthenticator(testKey, StaticUsers{})
+
+	token, _ := auth.Issue("ann")
+	if username, err := auth.Verify(token); err != nil || username != "ann" {
+		t.Fatalf("Verify = %q, %v; want ann", username, err)
+	}
+
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(claims{Subject: "bob", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+
+	stale, _ := json.Marshal(claims{Subject: "ann", ExpiresAt: time.Now().Add(-time.Second).Unix()})
+	expiredToken := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(stale)
+	expiredToken += "." + auth.sign(expiredToken)
+
+	otherKey, _ := NewAuthenticator([]byte("another key, just as long as the first"), StaticUsers{}).Issue("ann")
+
+	for name, token := range map[string]string{
+		"empty":           "",
+		"garbage":         "not a token",
+		"changed subject": parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2],
+		"alg none":        none + "." + base64.RawURLEncoding.EncodeToString(forged) + ".",
+		"expired":         expiredToken,
+		"other key":       otherKey,
+	} {
+		if username, err := auth.Verify(token); err == nil {
+			t.Errorf("%s token accepted for %q", name, username)
+		}
+	}
+}
+
+func TestStaticUsers(t *testing.T) {
+	users := StaticUsers{"ann": "secret"}
+	if !users.CheckPassword("ann", "secret") {
+		t.Error("right password refused")
+	}
+	for _, c := range [][2]string{{"ann", "wrong"}, {"ann", ""}, {"bob", "secret"}, {"bob", "secretx"}} {
+		if users.CheckPassword(c[0], c[1]) {
+			t.Errorf("%s/%s accepted", c[0], c[1])
+		}
+	}
+}
+
+func startAuthServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	s := NewServer(NewMemoryStore())
+	s.Auth = NewAuthenticator(testKey, StaticUsers{"ann": "secret"})
+	go s.Run()
+	mux := http.NewServeMux()
+	s.Register(mux)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func login(t *testing.T, ts *httptest.Server, username, password string) (*http.Response, string) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	resp, err := http.Post(ts.URL+"/login", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var session struct{ Token string }
+	json.NewDecoder(resp.Body).Decode(&session)
+	return resp, session.Token
+}
+
+func TestLogin(t *testing.T) {
+	_, ts := startAuthServer(t)
+
+	if resp, _ := login(t, ts, "ann", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong password: status %d, want 401", resp.StatusCode)
+	}
+
+	resp, token := login(t, ts, "ann", "secret")
+	if resp.StatusCode != http.StatusOK || token == "" {
+		t.Fatalf("login: status %d, token %q", resp.StatusCode, token)
+	}
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == SessionCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != token || !cookie.HttpOnly {
+		t.Errorf("session cookie = %+v, want an HttpOnly cookie holding the token", cookie)
+	}
+}
+
+// TestPostsCarryAuthenticatedUser checks that every transport requires a
+// session and posts under the session's user, whatever name the client
+// sends.
+func TestPostsCarryAuthenticatedUser(t *testing.T) {
+	s, ts := startAuthServer(t)
+	_, token := login(t, ts, "ann", "secret")
+
+	for _, path := range []string{"/send", "/receive", "/events", "/past_messages", "/ws"} {
+		method := http.MethodGet
+		if path == "/send" {
+			method = http.MethodPost
+		}
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(`{"content":"hi"}`))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s without a session: status %d, want 401", path, resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/send", strings.NewReader(`{"username":"bob","content":"over HTTP"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("send: status %d", resp.StatusCode)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?token=" + url.QueryEscape(token)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(Frame{Type: FrameMessage, Message: &Message{Username: "bob", Content: "over a WebSocket"}})
+	if ack := readFrame(t, conn, FrameAck); ack.Message.Username != "ann" {
+		t.Errorf("ack carries %q, want ann", ack.Message.Username)
+	}
+
+	messages, _ := s.Store.List(ListQuery{Room: DefaultRoom})
+	if len(messages) != 2 {
+		t.Fatalf("stored %d messages, want 2", len(messages))
+	}
+	for _, message := range messages {
+		if message.Username != "ann" {
+			t.Errorf("message %q stored as %q, want ann", message.Content, message.Username)
+		}
+	}
+}
+
+func TestIdentityHeader(t *testing.T) {
+	s, ts := startAuthServer(t)
+	s.Auth.IdentityHeader = NgrokIdentityHeader
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/send", strings.NewReader(`{"username":"bob","content":"hi"}`))
+	req.Header.Set(NgrokIdentityHeader, "ann@example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("send: status %d", resp.StatusCode)
+	}
+	if messages, _ := s.Store.List(ListQuery{Room: DefaultRoom}); len(messages) != 1 || messages[0].Username != "ann@example.com" {
+		t.Errorf("stored %+v, want one message from ann@example.com", messages)
+	}
+
+	// Without the header, a session token still works.
+	_, token := login(t, ts, "ann", "secret")
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/me", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("me with token: status %d", resp.StatusCode)
+	}
+}
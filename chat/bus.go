@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// busBufferSize is how many events may queue up for a bus subscriber.
+const busBufferSize = 100
+
+// ErrBusClosed is returned when publishing to or subscribing on a closed Bus.
+var ErrBusClosed = errors.New("bus closed")
+
+// Bus carries events, such as posted messages, between replicas, so that
+// each replica can deliver them to its own connected clients.
+type Bus interface {
+	// Publish sends event to every subscriber, including those in this
+	// process.
+	Publish(event Event) error
+	// Subscribe returns a channel that receives every published event.
+	// The channel is closed when the bus is closed.
+	Subscribe() (<-chan Event, error)
+	// Close stops delivery and releases the bus's resources.
+	Close() error
+}
+
+// MemoryBus is an in-process Bus. Servers sharing one MemoryBus behave like
+// replicas sharing a real pub/sub backend, which makes it useful in tests.
+type MemoryBus struct {
+	mutex       sync.Mutex
+	subscribers []chan Event
+	closed      bool
+}
+
+// NewMemoryBus returns a MemoryBus with no subscribers.
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{}
+}
+
+func (b *MemoryBus) Publish(event Event) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return ErrBusClosed
+	}
+	for _, subscriber := range b.subscribers {
+		subscriber <- event
+	}
+	return nil
+}
+
+func (b *MemoryBus) Subscribe() (<-chan Event, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, ErrBusClosed
+	}
+	subscriber := make(chan Event, busBufferSize)
+	b.subscribers = append(b.subscribers, subscriber)
+	return subscriber, nil
+}
+
+func (b *MemoryBus) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		for _, subscriber := range b.subscribers {
+			close(subscriber)
+		}
+	}
+	return nil
+}
+
+// RedisBus is a Bus backed by a Redis pub/sub channel.
+type RedisBus struct {
+	client  *redis.Client
+	channel string
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// NewRedisBus returns a RedisBus that publishes on channel through client.
+func NewRedisBus(client *redis.Client, channel string) *RedisBus {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RedisBus{client: client, channel: channel, ctx: ctx, cancel: cancel}
+}
+
+func (b *RedisBus) Publish(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(b.ctx, b.channel, data).Err()
+}
+
+func (b *RedisBus) Subscribe() (<-chan Event, error) {
+	pubsub := b.client.Subscribe(b.ctx, b.channel)
+
+	// Wait for the subscription to be confirmed so no event published
+	// after Subscribe returns can be missed.
+	if _, err := pubsub.Receive(b.ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	events := make(chan Event, busBufferSize)
+	go func() {
+		<-b.ctx.Done()
+		pubsub.Close()
+	}()
+	go func() {
+		defer close(events)
+		for payload := range pubsub.Channel() {
+			var event Event
+			if err := json.Unmarshal([]byte(payload.Payload), &event); err != nil {
+				log.Printf("Failed to decode event from Redis: %v", err)
+				continue
+			}
+			events <- event
+		}
+	}()
+	return events, nil
+}
+
+func (b *RedisBus) Close() error {
+	b.cancel()
+	return b.client.Close()
+}
@@ -0,0 +1,308 @@
+// Browser client for the chat server. It asks /negotiate which transports
+// the server offers and uses the first one that connects, falling back from
+// WebSocket to Server-Sent Events to long-polling, e.g. behind a proxy that
+// breaks WebSockets. A ?transport=sse (or websocket, longpoll) parameter on
+// the page URL forces one transport.
+//
+//     const chat = ChatClient.connect({room, since, username, onMessage, onUpdate, onTyping, onPresence, onRead});
+//     chat.send({username, content});
+//     chat.edit(id, content);
+//     chat.remove(id);
+//     chat.react(id, emoji);
+//     chat.unreact(id, emoji);
+//     chat.typing();
+//     chat.markRead(id);
+//
+// A message sent with a reply_to field replies to the message with that ID,
+// and one sent with a to field listing usernames is a direct message to
+// them; direct messages to the user arrive through onMessage like any other,
+// with their to field set. edit, remove, react, unreact and markRead take the
+// to field of a direct message as an optional last argument.
+// onUpdate receives messages that were edited, deleted or reacted to after
+// onMessage received them. onTyping receives the name of a user who is
+// typing, and onPresence an object {username, online, last_seen} whenever
+// a user comes online or goes offline. onRead receives the username and the
+// message a user has read up to. Pages that do not authenticate pass
+// the username to be known by in the room.
+(function () {
+    "use strict";
+
+    // How long a transport may take to connect before the next one is tried
+    const connectTimeout = 5000;
+    // Delay before reconnecting after a transport fails
+    const retryDelay = 1000;
+
+    function connect(options) {
+        const room = options.room || "general";
+        const onMessage = options.onMessage || function () {};
+        const onUpdate = options.onUpdate || function () {};
+        const onTyping = options.onTyping || function () {};
+        const onPresence = options.onPresence || function () {};
+        const onRead = options.onRead || function () {};
+        const onTransport = options.onTransport || function () {};
+        const forced = new URLSearchParams(window.location.search).get("transport");
+
+        let lastMessageID = options.since || "";
+        let current = null;
+
+        function receive(message) {
+            lastMessageID = message.id;
+            onMessage(message);
+        }
+
+        function query() {
+            return "?room=" + encodeURIComponent(room) +
+                "&since=" + encodeURIComponent(lastMessageID) +
+                (options.username ? "&username=" + encodeURIComponent(options.username) : "");
+        }
+
+        function openWebSocket(transport) {
+            return new Promise((resolve, reject) => {
+                const scheme = window.location.protocol === "https:" ? "wss://" : "ws://";
+                const socket = new WebSocket(scheme + window.location.host + transport.receive + query());
+                const timer = setTimeout(() => socket.close(), connectTimeout);
+                // Sends waiting for their ack or error, by request ID
+                const pending = new Map();
+                let nextRequestID = 1;
+                let open = false;
+
+                // Sends a frame and resolves with the message in its ack
+                function request(type, message, emoji) {
+                    return new Promise((resolve, reject) => {
+                        const id = String(nextRequestID++);
+                        pending.set(id, {resolve, reject});
+                        socket.send(JSON.stringify({type: type, id: id, message: message, emoji: emoji}));
+                    });
+                }
+
+                socket.onopen = () => {
+                    open = true;
+                    clearTimeout(timer);
+                    resolve({
+                        send: message => request("message", message),
+                        edit: (id, content, to) => request("edit", {id: id, content: content, to: to}),
+                        remove: (id, to) => request("delete", {id: id, to: to}),
+                        react: (id, emoji, to) => request("react", {id: id, to: to}, emoji),
+                        unreact: (id, emoji, to) => request("unreact", {id: id, to: to}, emoji),
+                        markRead: (id, to) => request("read", {id: id, to: to}),
+                        typing: () => {
+                            socket.send(JSON.stringify({type: "typing", username: options.username}));
+                            return Promise.resolve();
+                        },
+                    });
+                };
+                socket.onmessage = event => {
+                    const frame = JSON.parse(event.data);
+                    const request = pending.get(frame.id);
+                    switch (frame.type) {
+                    case "message":
+                        receive(frame.message);
+                        break;
+                    case "update":
+                        onUpdate(frame.message);
+                        break;
+                    case "typing":
+                        onTyping(frame.username);
+                        break;
+                    case "presence":
+                        onPresence(frame.presence);
+                        break;
+                    case "read":
+                        onRead(frame.username, frame.message);
+                        break;
+                    case "ack":
+                        if (request) {
+                            pending.delete(frame.id);
+                            request.resolve(frame.message);
+                        }
+                        break;
+                    case "error":
+                        if (request) {
+                            pending.delete(frame.id);
+                            request.reject(new Error(frame.error.message));
+                        } else {
+                            console.log("WebSocket error:", frame.error);
+                        }
+                        break;
+                    }
+                };
+                socket.onclose = () => {
+                    clearTimeout(timer);
+                    pending.forEach(request => request.reject(new Error("connection closed")));
+                    pending.clear();
+                    if (open) {
+                        reconnect();
+                    } else {
+                        reject(new Error("WebSocket did not connect"));
+                    }
+                };
+            });
+        }
+
+        function openEventSource(transport) {
+            return new Promise((resolve, reject) => {
+                const source = new EventSource(transport.receive + query());
+                const timer = setTimeout(() => {
+                    source.close();
+                    reject(new Error("event stream did not connect"));
+                }, connectTimeout);
+
+                source.onopen = () => {
+                    clearTimeout(timer);
+                    resolve(httpSender(transport));
+                };
+                source.addEventListener("message", event => receive(JSON.parse(event.data)));
+                source.addEventListener("update", event => onUpdate(JSON.parse(event.data)));
+                source.addEventListener("typing", event => onTyping(JSON.parse(event.data).username));
+                source.addEventListener("presence", event => onPresence(JSON.parse(event.data).presence));
+                source.addEventListener("read", event => {
+                    const read = JSON.parse(event.data);
+                    onRead(read.username, read.message);
+                });
+                // EventSource reconnects by itself, resuming from the last
+                // event ID; only give up if the server refuses the stream.
+                source.onerror = () => {
+                    if (source.readyState === EventSource.CLOSED) {
+                        clearTimeout(timer);
+                        reject(new Error("event stream closed"));
+                        reconnect();
+                    }
+                };
+            });
+        }
+
+        function openLongPoll(transport) {
+            function poll() {
+                fetch(transport.receive + query() + "&events=1")
+                    .then(response => {
+                        if (!response.ok && response.status !== 204) {
+                            throw new Error("receive failed with status " + response.status);
+                        }
+                        return response.status === 204 ? [] : response.json();
+                    })
+                    .then(events => {
+                        events.forEach(event => {
+                            switch (event.type) {
+                            case "message":
+                                receive(event.message);
+                                break;
+                            case "update":
+                                onUpdate(event.message);
+                                break;
+                            case "typing":
+                                onTyping(event.username);
+                                break;
+                            case "presence":
+                                onPresence(event.presence);
+                                break;
+                            case "read":
+                                onRead(event.username, event.message);
+                                break;
+                            }
+                        });
+                        poll();
+                    })
+                    .catch(err => {
+                        console.log("Error receiving messages:", err);
+                        setTimeout(poll, retryDelay);
+                    });
+            }
+            poll();
+            return Promise.resolve(httpSender(transport));
+        }
+
+        const openers = {
+            websocket: openWebSocket,
+            sse: openEventSource,
+            longpoll: openLongPoll,
+        };
+
+        // Sends, edits, deletes and reacts to messages over HTTP, for the
+        // transports that only receive
+        function httpSender(transport) {
+            return {
+                send: message => request("POST", transport.send, message),
+                edit: (id, content, to) => request("PATCH", messagePath(id, "", to), {content: content}),
+                remove: (id, to) => request("DELETE", messagePath(id, "", to)),
+                react: (id, emoji, to) => request("POST", messagePath(id, "/reactions", to), {emoji: emoji}),
+                unreact: (id, emoji, to) => request("DELETE", messagePath(id, "/reactions", to), {emoji: emoji}),
+                typing: () => request("POST", "/typing", {username: options.username}),
+                markRead: (id, to) => request("POST", to ? "/read?with=" + encodeURIComponent(to.join(",")) : "/read",
+                    {id: id, username: options.username}),
+            };
+        }
+
+        // Path of a message, in the room or, given the to field of a direct
+        // message, in its conversation
+        function messagePath(id, suffix, to) {
+            const path = "/messages/" + encodeURIComponent(id) + suffix;
+            return to ? path + "?with=" + encodeURIComponent(to.join(",")) : path;
+        }
+
+        function request(method, path, body) {
+            const target = path.includes("?") ? "" : "?room=" + encodeURIComponent(room);
+            return fetch(path + target, {
+                method: method,
+                headers: {"Content-Type": "application/json"},
+                body: body === undefined ? undefined : JSON.stringify(body),
+            }).then(response => {
+                if (!response.ok) {
+                    throw new Error(method + " failed with status " + response.status);
+                }
+            });
+        }
+
+        function negotiate() {
+            return fetch("/negotiate")
+                .then(response => response.json())
+                .then(body => body.transports.filter(t =>
+                    openers[t.name] && (!forced || t.name === forced)));
+        }
+
+        async function open() {
+            const offered = await negotiate();
+            for (const transport of offered) {
+                try {
+                    current = await openers[transport.name](transport);
+                    onTransport(transport.name);
+                    return;
+                } catch (err) {
+                    console.log("Transport " + transport.name + " failed:", err);
+                }
+            }
+            throw new Error("no transport connected");
+        }
+
+        function reconnect() {
+            current = null;
+            setTimeout(() => open().catch(err => {
+                console.log(err);
+                reconnect();
+            }), retryDelay);
+        }
+
+        open().catch(err => {
+            console.log(err);
+            reconnect();
+        });
+
+        function whenConnected(f) {
+            if (!current) {
+                return Promise.reject(new Error("not connected"));
+            }
+            return f(current);
+        }
+
+        return {
+            send: message => whenConnected(c => c.send(message)),
+            edit: (id, content, to) => whenConnected(c => c.edit(id, content, to)),
+            remove: (id, to) => whenConnected(c => c.remove(id, to)),
+            react: (id, emoji, to) => whenConnected(c => c.react(id, emoji, to)),
+            unreact: (id, emoji, to) => whenConnected(c => c.unreact(id, emoji, to)),
+            typing: () => whenConnected(c => c.typing()),
+            markRead: (id, to) => whenConnected(c => c.markRead(id, to)),
+        };
+    }
+
+    window.ChatClient = {connect};
+})();
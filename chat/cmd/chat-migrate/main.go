@@ -0,0 +1,34 @@
+// Command chat-migrate copies the messages of a DynamoDB table written by
+// the versions of the chat before rooms, keyed by a numeric ID, into a table
+// with the schema in dynamodb.yaml. The destination is configured like the
+// server, through the CHAT_DYNAMODB_* environment variables; see
+// chat.StoreConfig.FromEnv.
+//
+//	CHAT_DYNAMODB_TABLE=ChatRoomMessages go run ./cmd/chat-migrate -from Messages
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/shubcodes/sdk-k8s_demo/chat"
+)
+
+func main() {
+	from := flag.String("from", "Messages", "table to copy messages from")
+	flag.Parse()
+
+	config := chat.StoreConfig{Backend: chat.StoreDynamoDB, Table: chat.DefaultDynamoTable, Region: "us-west-2"}.FromEnv()
+	if config.Table == *from {
+		log.Fatalf("Source and destination are both %s", *from)
+	}
+	store, err := chat.OpenStore(config)
+	if err != nil {
+		log.Fatal("OpenStore: ", err)
+	}
+	copied, err := store.(*chat.DynamoStore).CopyLegacyMessages(*from)
+	log.Printf("Copied %d messages from %s to %s", copied, *from, config.Table)
+	if err != nil {
+		log.Fatal("CopyLegacyMessages: ", err)
+	}
+}
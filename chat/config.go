@@ -0,0 +1,727 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/redis/go-redis/v9"
+)
+
+// Store backends understood by OpenStore.
+const (
+	StoreMemory   = "memory"
+	StoreFile     = "file"
+	StoreDynamoDB = "dynamodb"
+)
+
+// StoreConfig selects and configures a MessageStore backend.
+type StoreConfig struct {
+	Backend string // One of StoreMemory, StoreFile or StoreDynamoDB
+
+	Path       string // JSON file used by StoreFile
+	CursorPath string // JSON file of read cursors used by StoreFile
+
+	Table       string // Table used by StoreDynamoDB
+	CursorTable string // Table of read cursors used by StoreDynamoDB
+	Region      string // AWS region used by StoreDynamoDB
+	Endpoint    string // Optional DynamoDB endpoint, e.g. http://localhost:8000 for DynamoDB Local
+
+	// MaxRetries is how many times StoreDynamoDB retries a request that
+	// failed transiently, such as a throttled one, backing off
+	// exponentially between attempts. Zero means DefaultDynamoRetries and a
+	// negative value disables retries.
+	MaxRetries int
+
+	envErr error // The first variable FromEnv could not parse
+}
+
+// DefaultDynamoTable is the name dynamodb.yaml gives the messages table.
+// Versions before rooms used a table called Messages with another schema;
+// see DynamoStore.
+const DefaultDynamoTable = "ChatRoomMessages"
+
+// DefaultDynamoRetries is how many times a transiently failed DynamoDB
+// request is retried when StoreConfig.MaxRetries is zero.
+const DefaultDynamoRetries = 5
+
+// Upper bounds on the backoff between DynamoDB retries. They are kept short
+// because a client is waiting on every request.
+const (
+	maxDynamoRetryDelay    = 2 * time.Second
+	maxDynamoThrottleDelay = 5 * time.Second
+)
+
+// FromEnv returns a copy of c with any of the following environment
+// variables applied on top of it:
+//
+//	CHAT_STORE                  backend: memory, file or dynamodb
+//	CHAT_STORE_PATH             JSON file for the file backend
+//	CHAT_CURSOR_PATH            JSON file of read cursors for the file backend
+//	CHAT_DYNAMODB_TABLE         DynamoDB table name
+//	CHAT_DYNAMODB_CURSOR_TABLE  DynamoDB table of read cursors
+//	CHAT_DYNAMODB_REGION        AWS region
+//	CHAT_DYNAMODB_ENDPOINT      DynamoDB endpoint override
+//	CHAT_DYNAMODB_RETRIES       retries for transient DynamoDB errors
+func (c StoreConfig) FromEnv() StoreConfig {
+	setFromEnv(&c.Backend, "CHAT_STORE")
+	setFromEnv(&c.Path, "CHAT_STORE_PATH")
+	setFromEnv(&c.CursorPath, "CHAT_CURSOR_PATH")
+	setFromEnv(&c.Table, "CHAT_DYNAMODB_TABLE")
+	setFromEnv(&c.CursorTable, "CHAT_DYNAMODB_CURSOR_TABLE")
+	setFromEnv(&c.Region, "CHAT_DYNAMODB_REGION")
+	setFromEnv(&c.Endpoint, "CHAT_DYNAMODB_ENDPOINT")
+	setIntFromEnv(&c.MaxRetries, "CHAT_DYNAMODB_RETRIES", &c.envErr)
+	return c
+}
+
+// OpenStore returns the MessageStore selected by c. An empty Backend selects
+// StoreMemory.
+func OpenStore(c StoreConfig) (MessageStore, error) {
+	if c.envErr != nil {
+		return nil, c.envErr
+	}
+	switch c.Backend {
+	case "", StoreMemory:
+		return NewMemoryStore(), nil
+	case StoreFile:
+		if c.Path == "" {
+			return nil, fmt.Errorf("chat: %s store requires a path", StoreFile)
+		}
+		return NewFileStore(c.Path)
+	case StoreDynamoDB:
+		if c.Table == "" {
+			return nil, fmt.Errorf("chat: %s store requires a table", StoreDynamoDB)
+		}
+		svc, err := c.dynamoDB()
+		if err != nil {
+			return nil, err
+		}
+		return NewDynamoStore(svc, c.Table), nil
+	default:
+		return nil, fmt.Errorf("chat: unknown store backend %q", c.Backend)
+	}
+}
+
+// OpenCursors returns the CursorStore that goes with the MessageStore
+// selected by c: a MemoryCursors for StoreMemory, a FileCursors at
+// CursorPath for StoreFile and a DynamoCursors on CursorTable for
+// StoreDynamoDB. CursorPath defaults to DefaultCursorFile next to Path, and
+// CursorTable to Table followed by "Cursors".
+func OpenCursors(c StoreConfig) (CursorStore, error) {
+	if c.envErr != nil {
+		return nil, c.envErr
+	}
+	switch c.Backend {
+	case "", StoreMemory:
+		return NewMemoryCursors(), nil
+	case StoreFile:
+		path := c.CursorPath
+		if path == "" {
+			if c.Path == "" {
+				return nil, fmt.Errorf("chat: %s store requires a path", StoreFile)
+			}
+			path = filepath.Join(filepath.Dir(c.Path), DefaultCursorFile)
+		}
+		return NewFileCursors(path)
+	case StoreDynamoDB:
+		table := c.CursorTable
+		if table == "" {
+			if c.Table == "" {
+				return nil, fmt.Errorf("chat: %s store requires a table", StoreDynamoDB)
+			}
+			table = c.Table + "Cursors"
+		}
+		svc, err := c.dynamoDB()
+		if err != nil {
+			return nil, err
+		}
+		return NewDynamoCursors(svc, table), nil
+	default:
+		return nil, fmt.Errorf("chat: unknown store backend %q", c.Backend)
+	}
+}
+
+// DefaultCursorFile is the name of the file OpenCursors keeps the read
+// cursors of a file store in when CursorPath is not set.
+const DefaultCursorFile = "chat_cursors.json"
+
+// dynamoDB returns a DynamoDB client configured by c.
+func (c StoreConfig) dynamoDB() (*dynamodb.DynamoDB, error) {
+	if c.envErr != nil {
+		return nil, c.envErr
+	}
+	retries := c.MaxRetries
+	switch {
+	case retries == 0:
+		retries = DefaultDynamoRetries
+	case retries < 0:
+		retries = 0
+	}
+	awsConfig := &aws.Config{
+		Retryer: client.DefaultRetryer{
+			NumMaxRetries:    retries,
+			MaxRetryDelay:    maxDynamoRetryDelay,
+			MaxThrottleDelay: maxDynamoThrottleDelay,
+		},
+	}
+	if c.Region != "" {
+		awsConfig.Region = aws.String(c.Region)
+	}
+	if c.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(c.Endpoint)
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return dynamodb.New(sess), nil
+}
+
+// Bus backends understood by OpenBus.
+const (
+	BusNone  = "none"
+	BusRedis = "redis"
+)
+
+// DefaultRedisChannel is the Redis pub/sub channel used when none is set.
+const DefaultRedisChannel = "chat"
+
+// BusConfig selects and configures the Bus that carries messages between
+// replicas.
+type BusConfig struct {
+	Backend string // One of BusNone or BusRedis
+
+	Addr     string // Redis address, host:port
+	Password string // Optional Redis password
+	Channel  string // Redis pub/sub channel, DefaultRedisChannel if empty
+}
+
+// FromEnv returns a copy of c with any of the following environment
+// variables applied on top of it:
+//
+//	CHAT_BUS             backend: none or redis
+//	CHAT_REDIS_ADDR      Redis address, host:port
+//	CHAT_REDIS_PASSWORD  Redis password
+//	CHAT_REDIS_CHANNEL   Redis pub/sub channel
+func (c BusConfig) FromEnv() BusConfig {
+	setFromEnv(&c.Backend, "CHAT_BUS")
+	setFromEnv(&c.Addr, "CHAT_REDIS_ADDR")
+	setFromEnv(&c.Password, "CHAT_REDIS_PASSWORD")
+	setFromEnv(&c.Channel, "CHAT_REDIS_CHANNEL")
+	return c
+}
+
+// OpenBus returns the Bus selected by c, or nil for BusNone. An empty
+// Backend selects BusNone.
+func OpenBus(c BusConfig) (Bus, error) {
+	switch c.Backend {
+	case "", BusNone:
+		return nil, nil
+	case BusRedis:
+		if c.Addr == "" {
+			return nil, fmt.Errorf("chat: %s bus requires an address", BusRedis)
+		}
+		channel := c.Channel
+		if channel == "" {
+			channel = DefaultRedisChannel
+		}
+
+		client := redis.NewClient(&redis.Options{
+			Addr:     c.Addr,
+			Password: c.Password,
+		})
+		return NewRedisBus(client, channel), nil
+	default:
+		return nil, fmt.Errorf("chat: unknown bus backend %q", c.Backend)
+	}
+}
+
+// Overflow policies understood by ConfigureHub.
+const (
+	OverflowDropOldest = "drop-oldest"
+	OverflowDisconnect = "disconnect"
+)
+
+// HubConfig sets how a Hub treats clients that fall behind.
+type HubConfig struct {
+	QueueSize int    // Messages that may wait for one client, DefaultQueueSize if zero
+	Overflow  string // One of OverflowDropOldest or OverflowDisconnect
+
+	envErr error // The first variable FromEnv could not parse
+}
+
+// FromEnv returns a copy of c with any of the following environment
+// variables applied on top of it:
+//
+//	CHAT_QUEUE_SIZE  messages that may wait for one client
+//	CHAT_OVERFLOW    policy for full queues: drop-oldest or disconnect
+func (c HubConfig) FromEnv() HubConfig {
+	setIntFromEnv(&c.QueueSize, "CHAT_QUEUE_SIZE", &c.envErr)
+	setFromEnv(&c.Overflow, "CHAT_OVERFLOW")
+	return c
+}
+
+// ConfigureHub applies c to h. It must be called before h is started.
+// An empty Overflow selects OverflowDropOldest.
+func ConfigureHub(h *Hub, c HubConfig) error {
+	if c.envErr != nil {
+		return c.envErr
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("chat: negative queue size %d", c.QueueSize)
+	}
+	switch c.Overflow {
+	case "", OverflowDropOldest:
+		h.Overflow = DropOldest
+	case OverflowDisconnect:
+		h.Overflow = Disconnect
+	default:
+		return fmt.Errorf("chat: unknown overflow policy %q", c.Overflow)
+	}
+	h.QueueSize = c.QueueSize
+	return nil
+}
+
+// CORSConfig lists the origins of the pages, other than the server's own,
+// that may use a Server.
+type CORSConfig struct {
+	AllowedOrigins []string // Origins such as https://chat.example.com, or AnyOrigin
+}
+
+// FromEnv returns a copy of c with the origins in the following environment
+// variable added:
+//
+//	CHAT_ALLOWED_ORIGINS  comma-separated origins, or * for any
+func (c CORSConfig) FromEnv() CORSConfig {
+	if value := os.Getenv("CHAT_ALLOWED_ORIGINS"); value != "" {
+		origins := append([]string(nil), c.AllowedOrigins...)
+		for _, origin := range strings.Split(value, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				origins = append(origins, origin)
+			}
+		}
+		c.AllowedOrigins = origins
+	}
+	return c
+}
+
+// ConfigureCORS applies c to s. Each origin must be a scheme and host, with
+// an optional port and no path, or AnyOrigin.
+func ConfigureCORS(s *Server, c CORSConfig) error {
+	for _, origin := range c.AllowedOrigins {
+		if origin == AnyOrigin {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("chat: invalid origin %q", origin)
+		}
+	}
+	s.AllowedOrigins = c.AllowedOrigins
+	return nil
+}
+
+// AuthConfig enables and configures user authentication. It is off unless
+// at least one of Users, IdentityHeader and OIDC.Issuer is set.
+type AuthConfig struct {
+	Secret         string        // Key that signs session tokens; random if empty
+	Users          StaticUsers   // Password by username, for password login
+	TTL            time.Duration // Session lifetime, DefaultSessionTTL if zero
+	IdentityHeader string        // Header naming the user signed in by a proxy, e.g. NgrokIdentityHeader
+	Moderators     []string      // Users who may edit and delete anyone's messages
+	OIDC           OIDCConfig    // OpenID Connect login
+
+	envErr error // The first variable FromEnv could not parse
+}
+
+// OIDCConfig configures login with an OpenID Connect provider.
+type OIDCConfig struct {
+	Issuer        string // Provider URL; OIDC login is off if empty
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string // Absolute URL of OIDCCallbackPath, derived from requests if empty
+	UsernameClaim string // ID token claim used as the username, DefaultUsernameClaim if empty
+}
+
+// FromEnv returns a copy of c with any of the following environment
+// variables applied on top of it:
+//
+//	CHAT_AUTH_SECRET          key that signs session tokens
+//	CHAT_USERS                comma-separated username:password pairs, added to Users
+//	CHAT_SESSION_TTL          session lifetime, e.g. 12h
+//	CHAT_IDENTITY_HEADER      header naming the user signed in by a proxy
+//	CHAT_OIDC_ISSUER          OpenID Connect provider URL
+//	CHAT_OIDC_CLIENT_ID       client registered with the provider
+//	CHAT_OIDC_CLIENT_SECRET   the client's secret
+//	CHAT_OIDC_REDIRECT_URL    callback URL registered with the provider
+//	CHAT_OIDC_USERNAME_CLAIM  ID token claim used as the username
+//	CHAT_MODERATORS           comma-separated usernames, added to Moderators
+func (c AuthConfig) FromEnv() AuthConfig {
+	setFromEnv(&c.Secret, "CHAT_AUTH_SECRET")
+	if value := os.Getenv("CHAT_USERS"); value != "" {
+		users := make(StaticUsers, len(c.Users))
+		for username, password := range c.Users {
+			users[username] = password
+		}
+		for _, pair := range strings.Split(value, ",") {
+			if username, password, ok := strings.Cut(strings.TrimSpace(pair), ":"); ok && username != "" {
+				users[username] = password
+			}
+		}
+		c.Users = users
+	}
+	setDurationFromEnv(&c.TTL, "CHAT_SESSION_TTL", &c.envErr)
+	setFromEnv(&c.IdentityHeader, "CHAT_IDENTITY_HEADER")
+	setFromEnv(&c.OIDC.Issuer, "CHAT_OIDC_ISSUER")
+	setFromEnv(&c.OIDC.ClientID, "CHAT_OIDC_CLIENT_ID")
+	setFromEnv(&c.OIDC.ClientSecret, "CHAT_OIDC_CLIENT_SECRET")
+	setFromEnv(&c.OIDC.RedirectURL, "CHAT_OIDC_REDIRECT_URL")
+	setFromEnv(&c.OIDC.UsernameClaim, "CHAT_OIDC_USERNAME_CLAIM")
+	if value := os.Getenv("CHAT_MODERATORS"); value != "" {
+		moderators := append([]string(nil), c.Moderators...)
+		for _, username := range strings.Split(value, ",") {
+			if username = strings.TrimSpace(username); username != "" {
+				moderators = append(moderators, username)
+			}
+		}
+		c.Moderators = moderators
+	}
+	return c
+}
+
+// minSecretLength is the shortest Secret OpenAuth accepts.
+const minSecretLength = 32
+
+// OpenAuth returns the Authenticator configured by c, or nil if c enables no
+// way to authenticate. Without a Secret a random one is used, so sessions do
+// not survive a restart and are not accepted by other replicas. With an OIDC
+// issuer it fetches the provider's configuration.
+func OpenAuth(c AuthConfig) (*Authenticator, error) {
+	if c.envErr != nil {
+		return nil, c.envErr
+	}
+	if len(c.Users) == 0 && c.IdentityHeader == "" && c.OIDC.Issuer == "" {
+		return nil, nil
+	}
+
+	key := []byte(c.Secret)
+	switch {
+	case len(key) == 0:
+		key = make([]byte, minSecretLength)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	case len(key) < minSecretLength:
+		return nil, fmt.Errorf("chat: auth secret must be at least %d bytes", minSecretLength)
+	}
+
+	auth := NewAuthenticator(key, nil)
+	if len(c.Users) > 0 {
+		auth.Passwords = c.Users
+	}
+	auth.TTL = c.TTL
+	auth.IdentityHeader = c.IdentityHeader
+	auth.Moderators = c.Moderators
+
+	if c.OIDC.Issuer != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		oidc, err := NewOIDCClient(ctx, c.OIDC.Issuer, c.OIDC.ClientID, c.OIDC.ClientSecret)
+		if err != nil {
+			return nil, err
+		}
+		oidc.RedirectURL = c.OIDC.RedirectURL
+		oidc.UsernameClaim = c.OIDC.UsernameClaim
+		auth.OIDC = oidc
+	}
+	return auth, nil
+}
+
+// SMSConfig configures the SMS bridge.
+type SMSConfig struct {
+	RegistryPath string // JSON file of registered phone numbers; kept in memory if empty
+	From         string // Twilio phone number texts are sent from
+	AccountSID   string // Twilio account
+	AuthToken    string // The account's auth token
+	APIURL       string // Twilio API base URL, DefaultTwilioAPIURL if empty
+	PublicURL    string // Scheme and host Twilio reaches the bridge at; see SMSBridge.PublicURL
+
+	// AllowUnsigned lets /sms accept texts without a Twilio signature
+	// when AuthToken is empty; see SMSBridge.AllowUnsigned.
+	AllowUnsigned bool
+
+	envErr error // The first variable FromEnv could not parse
+}
+
+// FromEnv returns a copy of c with any of the following environment
+// variables applied on top of it:
+//
+//	CHAT_SMS_REGISTRY    JSON file of registered phone numbers
+//	TWILIO_PHONE_NUMBER  Twilio phone number texts are sent from
+//	TWILIO_ACCOUNT_SID   Twilio account
+//	TWILIO_AUTH_TOKEN    the account's auth token
+//	TWILIO_API_URL       Twilio API base URL
+//	CHAT_SMS_PUBLIC_URL  scheme and host Twilio reaches the bridge at
+//	CHAT_SMS_UNSIGNED    true to accept unsigned texts without an auth token
+func (c SMSConfig) FromEnv() SMSConfig {
+	setFromEnv(&c.RegistryPath, "CHAT_SMS_REGISTRY")
+	setFromEnv(&c.From, "TWILIO_PHONE_NUMBER")
+	setFromEnv(&c.AccountSID, "TWILIO_ACCOUNT_SID")
+	setFromEnv(&c.AuthToken, "TWILIO_AUTH_TOKEN")
+	setFromEnv(&c.APIURL, "TWILIO_API_URL")
+	setFromEnv(&c.PublicURL, "CHAT_SMS_PUBLIC_URL")
+	setBoolFromEnv(&c.AllowUnsigned, "CHAT_SMS_UNSIGNED", &c.envErr)
+	return c
+}
+
+// OpenSMSRegistry returns the SMSRegistry configured by c: a
+// FileSMSRegistry at RegistryPath, or a MemorySMSRegistry if it is empty.
+func OpenSMSRegistry(c SMSConfig) (SMSRegistry, error) {
+	if c.envErr != nil {
+		return nil, c.envErr
+	}
+	if c.RegistryPath == "" {
+		return NewMemorySMSRegistry(), nil
+	}
+	return NewFileSMSRegistry(c.RegistryPath)
+}
+
+// TwilioSMS returns a TwilioSMS that sends with the account and number in c.
+func (c SMSConfig) TwilioSMS() *TwilioSMS {
+	return &TwilioSMS{AccountSID: c.AccountSID, AuthToken: c.AuthToken, From: c.From, APIURL: c.APIURL}
+}
+
+// NotifyConfig configures the notification Dispatcher.
+type NotifyConfig struct {
+	QueuePath string // JSON file of queued notifications; kept in memory if empty
+
+	SMTPAddr     string // Mail server, host:port; email is off if empty
+	SMTPUsername string // Optional PLAIN login
+	SMTPPassword string
+	SMTPFrom     string // Sender address
+
+	SMSRate     RateLimit // DefaultSMSRate if zero
+	EmailRate   RateLimit // DefaultEmailRate if zero
+	WebhookRate RateLimit // DefaultWebhookRate if zero
+
+	envErr error // The first variable FromEnv could not parse
+}
+
+// Default per-channel rate limits. Twilio sends one text a second from a
+// long code number.
+var (
+	DefaultSMSRate     = RateLimit{Count: 1, Per: time.Second}
+	DefaultEmailRate   = RateLimit{Count: 10, Per: time.Second}
+	DefaultWebhookRate = RateLimit{Count: 20, Per: time.Second}
+)
+
+// FromEnv returns a copy of c with any of the following environment
+// variables applied on top of it:
+//
+//	CHAT_NOTIFY_QUEUE         JSON file of queued notifications
+//	CHAT_SMTP_ADDR            mail server, host:port
+//	CHAT_SMTP_USERNAME        mail server login
+//	CHAT_SMTP_PASSWORD        the login's password
+//	CHAT_SMTP_FROM            sender address
+//	CHAT_NOTIFY_SMS_RATE      rate limit for texts, e.g. 1/1s
+//	CHAT_NOTIFY_EMAIL_RATE    rate limit for email, e.g. 100/1m
+//	CHAT_NOTIFY_WEBHOOK_RATE  rate limit for webhooks
+func (c NotifyConfig) FromEnv() NotifyConfig {
+	setFromEnv(&c.QueuePath, "CHAT_NOTIFY_QUEUE")
+	setFromEnv(&c.SMTPAddr, "CHAT_SMTP_ADDR")
+	setFromEnv(&c.SMTPUsername, "CHAT_SMTP_USERNAME")
+	setFromEnv(&c.SMTPPassword, "CHAT_SMTP_PASSWORD")
+	setFromEnv(&c.SMTPFrom, "CHAT_SMTP_FROM")
+	setRateFromEnv(&c.SMSRate, "CHAT_NOTIFY_SMS_RATE", &c.envErr)
+	setRateFromEnv(&c.EmailRate, "CHAT_NOTIFY_EMAIL_RATE", &c.envErr)
+	setRateFromEnv(&c.WebhookRate, "CHAT_NOTIFY_WEBHOOK_RATE", &c.envErr)
+	return c
+}
+
+// OpenDispatcher returns a Dispatcher configured by c, keeping
+// notifications in a FileNotificationQueue at QueuePath or, if it is
+// empty, in memory. It registers ChannelWebhook, ChannelEmail if SMTPAddr
+// is set, and ChannelSMS if sms is not nil. Run must be started for
+// notifications to be sent.
+func OpenDispatcher(c NotifyConfig, sms SMSSender) (*Dispatcher, error) {
+	if c.envErr != nil {
+		return nil, c.envErr
+	}
+	var queue NotificationQueue = NewMemoryNotificationQueue()
+	if c.QueuePath != "" {
+		fileQueue, err := NewFileNotificationQueue(c.QueuePath)
+		if err != nil {
+			return nil, err
+		}
+		queue = fileQueue
+	}
+	d := NewDispatcher(queue)
+
+	d.Register(ChannelWebhook, WebhookNotifier{}, rateOrDefault(c.WebhookRate, DefaultWebhookRate))
+	if c.SMTPAddr != "" {
+		if c.SMTPFrom == "" {
+			return nil, fmt.Errorf("chat: email notifications require a sender address")
+		}
+		notifier := SMTPNotifier{Addr: c.SMTPAddr, From: c.SMTPFrom}
+		if c.SMTPUsername != "" {
+			host, _, _ := strings.Cut(c.SMTPAddr, ":")
+			notifier.Auth = smtp.PlainAuth("", c.SMTPUsername, c.SMTPPassword, host)
+		}
+		d.Register(ChannelEmail, notifier, rateOrDefault(c.EmailRate, DefaultEmailRate))
+	}
+	if sms != nil {
+		d.Register(ChannelSMS, SMSNotifier{Sender: sms}, rateOrDefault(c.SMSRate, DefaultSMSRate))
+	}
+	return d, nil
+}
+
+func rateOrDefault(limit, fallback RateLimit) RateLimit {
+	if limit == (RateLimit{}) {
+		return fallback
+	}
+	return limit
+}
+
+// WebhookConfig configures outgoing and incoming webhooks.
+type WebhookConfig struct {
+	Table      string // DynamoDB table of webhooks and their deliveries, shared by replicas; Path is ignored if set
+	Path       string // JSON file of webhooks and their deliveries; kept in memory if empty
+	AdminToken string // Bearer token for the admin endpoints; see Webhooks.AdminToken
+
+	// DynamoDB gives the region, endpoint and retries used to reach Table.
+	// Its other fields are ignored.
+	DynamoDB StoreConfig
+}
+
+// FromEnv returns a copy of c with any of the following environment
+// variables applied on top of it:
+//
+//	CHAT_WEBHOOKS_TABLE  DynamoDB table of webhooks and their deliveries
+//	CHAT_WEBHOOKS        JSON file of webhooks and their deliveries
+//	CHAT_ADMIN_TOKEN     bearer token for the admin endpoints
+func (c WebhookConfig) FromEnv() WebhookConfig {
+	setFromEnv(&c.Table, "CHAT_WEBHOOKS_TABLE")
+	setFromEnv(&c.Path, "CHAT_WEBHOOKS")
+	setFromEnv(&c.AdminToken, "CHAT_ADMIN_TOKEN")
+	return c
+}
+
+// ErrUnsharedWebhooks is returned by OpenWebhooks for a server with a bus
+// attached when no Table is configured. Webhooks kept in memory or in a
+// file are only known to the replica that added them, so the others would
+// answer their incoming webhooks with 404 and never send their outgoing
+// ones.
+var ErrUnsharedWebhooks = errors.New("chat: webhooks on several replicas need a shared table")
+
+// OpenWebhooks returns Webhooks configured by c that send the events server
+// publishes, keeping them in a DynamoWebhookStore on Table, a
+// FileWebhookStore at Path or, if both are empty, in memory. Run must be
+// started for webhooks to be sent.
+//
+// A server with a bus attached is one of several replicas, so it must share
+// its webhooks with the others through Table; without it, OpenWebhooks
+// returns ErrUnsharedWebhooks. AttachBus must therefore be called first.
+func OpenWebhooks(c WebhookConfig, server *Server) (*Webhooks, error) {
+	var store WebhookStore = NewMemoryWebhookStore()
+	switch {
+	case c.Table != "":
+		svc, err := c.DynamoDB.dynamoDB()
+		if err != nil {
+			return nil, err
+		}
+		store = NewDynamoWebhookStore(svc, c.Table)
+	case server.bus != nil:
+		return nil, ErrUnsharedWebhooks
+	case c.Path != "":
+		fileStore, err := NewFileWebhookStore(c.Path)
+		if err != nil {
+			return nil, err
+		}
+		store = fileStore
+	}
+	webhooks := NewWebhooks(server, store)
+	webhooks.AdminToken = c.AdminToken
+	return webhooks, nil
+}
+
+func setFromEnv(field *string, key string) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		*field = value
+	}
+}
+
+// The following setters leave field alone and record an error in envErr,
+// unless one is already there, if key is set to a value they cannot parse.
+// FromEnv keeps the error in the config for its Open function to return,
+// so that a mistyped setting stops the server at startup rather than
+// quietly leaving the default in place.
+
+func setBoolFromEnv(field *bool, key string, envErr *error) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			invalidEnv(envErr, key, value)
+			return
+		}
+		*field = b
+	}
+}
+
+func setIntFromEnv(field *int, key string, envErr *error) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			invalidEnv(envErr, key, value)
+			return
+		}
+		*field = n
+	}
+}
+
+func setDurationFromEnv(field *time.Duration, key string, envErr *error) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			invalidEnv(envErr, key, value)
+			return
+		}
+		*field = d
+	}
+}
+
+// setRateFromEnv parses a rate limit written as count/duration, such as
+// 1/1s or 100/1m.
+func setRateFromEnv(field *RateLimit, key string, envErr *error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return
+	}
+	count, per, _ := strings.Cut(value, "/")
+	n, err := strconv.Atoi(count)
+	d, perErr := time.ParseDuration(per)
+	if err != nil || perErr != nil || n <= 0 || d <= 0 {
+		invalidEnv(envErr, key, value)
+		return
+	}
+	*field = RateLimit{Count: n, Per: d}
+}
+
+func invalidEnv(envErr *error, key, value string) {
+	if *envErr == nil {
+		*envErr = fmt.Errorf("chat: invalid %s %q", key, value)
+	}
+}
@@ -0,0 +1,54 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvalidEnvFailsOpen(t *testing.T) {
+	for _, test := range []struct {
+		key, value string
+		open       func() error
+	}{
+		{"CHAT_DYNAMODB_RETRIES", "five", func() error {
+			_, err := OpenStore(StoreConfig{}.FromEnv())
+			return err
+		}},
+		{"CHAT_QUEUE_SIZE", "1k", func() error {
+			return ConfigureHub(NewHub(), HubConfig{}.FromEnv())
+		}},
+		{"CHAT_SESSION_TTL", "12", func() error {
+			_, err := OpenAuth(AuthConfig{}.FromEnv())
+			return err
+		}},
+		{"CHAT_SMS_UNSIGNED", "yes please", func() error {
+			_, err := OpenSMSRegistry(SMSConfig{}.FromEnv())
+			return err
+		}},
+		{"CHAT_NOTIFY_SMS_RATE", "1 per second", func() error {
+			_, err := OpenDispatcher(NotifyConfig{}.FromEnv(), nil)
+			return err
+		}},
+		{"CHAT_NOTIFY_EMAIL_RATE", "0/1s", func() error {
+			_, err := OpenDispatcher(NotifyConfig{}.FromEnv(), nil)
+			return err
+		}},
+	} {
+		t.Run(test.key, func(t *testing.T) {
+			t.Setenv(test.key, test.value)
+			if err := test.open(); err == nil || !strings.Contains(err.Error(), test.key) {
+				t.Errorf("opening with %s=%q: %v, want an error naming it", test.key, test.value, err)
+			}
+		})
+	}
+
+	t.Setenv("CHAT_SESSION_TTL", "12h")
+	t.Setenv("CHAT_NOTIFY_SMS_RATE", "2/1s")
+	if c := (AuthConfig{}).FromEnv(); c.TTL != 12*time.Hour || c.envErr != nil {
+		t.Errorf("AuthConfig from a valid CHAT_SESSION_TTL = %+v", c)
+	}
+	if c := (NotifyConfig{}).FromEnv(); c.SMSRate != (RateLimit{Count: 2, Per: time.Second}) || c.envErr != nil {
+		t.Errorf("NotifyConfig from a valid CHAT_NOTIFY_SMS_RATE = %+v", c)
+	}
+}
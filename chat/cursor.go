@@ -0,0 +1,192 @@
+package chat
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// CursorStore persists how far each user has read each room, as the ID of
+// the last message read. Because IDs sort in posting order, cursors only
+// ever move forward.
+type CursorStore interface {
+	// MarkRead moves username's cursor in room to id. It reports false,
+	// leaving the cursor as it is, if the cursor is already at or past id.
+	MarkRead(username, room, id string) (bool, error)
+	// Cursors returns username's cursors by room.
+	Cursors(username string) (map[string]string, error)
+}
+
+// MemoryCursors keeps cursors in process memory. They are lost on restart.
+type MemoryCursors struct {
+	mutex   sync.Mutex
+	cursors cursors
+}
+
+// NewMemoryCursors returns a MemoryCursors with no cursors.
+func NewMemoryCursors() *MemoryCursors {
+	return &MemoryCursors{cursors: make(cursors)}
+}
+
+func (s *MemoryCursors) MarkRead(username, room, id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, moved := s.cursors.mark(username, room, id)
+	return moved, nil
+}
+
+func (s *MemoryCursors) Cursors(username string) (map[string]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.cursors.of(username), nil
+}
+
+// FileCursors keeps cursors in memory and mirrors them to a JSON file,
+// which is rewritten after every change. The file holds an object mapping
+// each username to an object mapping rooms to message IDs.
+type FileCursors struct {
+	mutex   sync.Mutex
+	path    string
+	cursors cursors
+}
+
+// NewFileCursors returns a FileCursors backed by the file at path, loading
+// any cursors it already contains. A missing or empty file holds none.
+func NewFileCursors(path string) (*FileCursors, error) {
+	s := &FileCursors{path: path, cursors: make(cursors)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) || err == nil && len(data) == 0 {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.cursors); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileCursors) MarkRead(username, room, id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, moved := s.cursors.mark(username, room, id)
+	if !moved {
+		return false, nil
+	}
+
+	data, err := json.Marshal(s.cursors)
+	if err == nil {
+		err = writeFile(s.path, data)
+	}
+	if err != nil {
+		// Keep memory and the file in step.
+		if previous == "" {
+			delete(s.cursors[username], room)
+		} else {
+			s.cursors[username][room] = previous
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *FileCursors) Cursors(username string) (map[string]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.cursors.of(username), nil
+}
+
+// cursors maps usernames to their cursors by room. It is shared by
+// MemoryCursors and FileCursors, which guard it with their own mutex.
+type cursors map[string]map[string]string
+
+// mark moves username's cursor in room forward to id, returning where it
+// was and whether it moved.
+func (c cursors) mark(username, room, id string) (previous string, moved bool) {
+	previous = c[username][room]
+	if id <= previous {
+		return previous, false
+	}
+	if c[username] == nil {
+		c[username] = make(map[string]string)
+	}
+	c[username][room] = id
+	return previous, true
+}
+
+// of returns a copy of username's cursors.
+func (c cursors) of(username string) map[string]string {
+	copied := make(map[string]string, len(c[username]))
+	for room, id := range c[username] {
+		copied[room] = id
+	}
+	return copied
+}
+
+// DynamoCursors keeps cursors in a DynamoDB table keyed by the string
+// attributes "Username" (partition key) and "Room" (sort key), holding the
+// cursor in "LastRead", so that one Query reads all of a user's cursors.
+type DynamoCursors struct {
+	svc   dynamodbiface.DynamoDBAPI
+	table string
+}
+
+// NewDynamoCursors returns a DynamoCursors that uses svc to access table.
+func NewDynamoCursors(svc dynamodbiface.DynamoDBAPI, table string) *DynamoCursors {
+	return &DynamoCursors{svc: svc, table: table}
+}
+
+func (s *DynamoCursors) MarkRead(username, room, id string) (bool, error) {
+	// The condition keeps two devices marking concurrently from moving
+	// the cursor back.
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Username": {S: aws.String(username)},
+			"Room":     {S: aws.String(room)},
+		},
+		UpdateExpression:          aws.String("SET #last_read = :id"),
+		ConditionExpression:       aws.String("attribute_not_exists(#last_read) OR #last_read < :id"),
+		ExpressionAttributeNames:  map[string]*string{"#last_read": aws.String("LastRead")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":id": {S: aws.String(id)}},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return false, nil
+	}
+	if err != nil {
+		return false, classify(err)
+	}
+	return true, nil
+}
+
+func (s *DynamoCursors) Cursors(username string) (map[string]string, error) {
+	cursors := make(map[string]string)
+	err := s.svc.QueryPages(&dynamodb.QueryInput{
+		TableName:                 aws.String(s.table),
+		KeyConditionExpression:    aws.String("#username = :username"),
+		ExpressionAttributeNames:  map[string]*string{"#username": aws.String("Username")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":username": {S: aws.String(username)}},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if item["Room"] != nil && item["LastRead"] != nil {
+				cursors[aws.StringValue(item["Room"].S)] = aws.StringValue(item["LastRead"].S)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, classify(err)
+	}
+	return cursors, nil
+}
@@ -0,0 +1,105 @@
+package chat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// MaxParticipants is the most users a direct conversation may have.
+const MaxParticipants = 10
+
+// ErrInvalidConversation is returned when a direct message or a request for
+// a direct conversation does not name between two and MaxParticipants
+// users, one of them the user making it.
+var ErrInvalidConversation = errors.New("invalid conversation")
+
+// conversationPrefix starts the names under which direct conversations are
+// stored. validRoom rejects it, so a conversation's messages can never be
+// read or posted to as a room.
+const conversationPrefix = "@"
+
+// conversation returns the sorted participants of the direct conversation
+// between username and the users in with, and the name under which its
+// messages are stored, which is the same whichever of them asks. The name
+// is a digest, so that it fits the stores' key limits however long the
+// usernames are.
+func conversation(username string, with []string) (room string, participants []string, err error) {
+	if username == "" {
+		return "", nil, ErrInvalidConversation
+	}
+
+	seen := map[string]bool{username: true}
+	participants = []string{username}
+	for _, user := range with {
+		user = strings.TrimSpace(user)
+		if user != "" && !seen[user] {
+			seen[user] = true
+			participants = append(participants, user)
+		}
+	}
+	if len(participants) < 2 || len(participants) > MaxParticipants {
+		return "", nil, ErrInvalidConversation
+	}
+	sort.Strings(participants)
+
+	sum := sha256.Sum256([]byte(strings.Join(participants, "\n")))
+	return conversationPrefix + hex.EncodeToString(sum[:16]), participants, nil
+}
+
+// clientUser returns the user making r: the authenticated user or, if the
+// request is not authenticated, whoever the username query parameter names.
+// Anyone can claim a username that way, so it is only good for rooms.
+func clientUser(r *http.Request) string {
+	if username, ok := User(r); ok {
+		return username
+	}
+	return r.URL.Query().Get("username")
+}
+
+// directUser returns the authenticated user making r, or "" if r is not
+// authenticated. Direct messages are only sent, read and delivered on
+// behalf of authenticated users; for anyone else conversation fails with
+// ErrInvalidConversation.
+func directUser(r *http.Request) string {
+	username, _ := User(r)
+	return username
+}
+
+// targetRoom returns the name under which the messages addressed by r are
+// stored: the direct conversation between the authenticated user and the
+// comma-separated users in the with query parameter, if it is set, and
+// otherwise the room named by the room query parameter, DefaultRoom if
+// unset.
+func targetRoom(r *http.Request) (string, error) {
+	if with := r.URL.Query().Get("with"); with != "" {
+		room, _, err := conversation(directUser(r), strings.Split(with, ","))
+		return room, err
+	}
+	room, ok := roomParam(r)
+	if !ok {
+		return "", ErrInvalidRoom
+	}
+	return room, nil
+}
+
+// writeTargetError answers a request whose targetRoom failed with err.
+func writeTargetError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrInvalidConversation) {
+		WriteError(w, http.StatusBadRequest, CodeInvalidConversation, conversationErrorMessage)
+		return
+	}
+	WriteError(w, http.StatusBadRequest, CodeInvalidRoom, "Invalid room")
+}
+
+var conversationErrorMessage = fmt.Sprintf("Direct messages need a sender and 1 to %d other users", MaxParticipants-1)
+
+// validTarget reports whether name is a room name or the name of a direct
+// conversation.
+func validTarget(name string) bool {
+	return validRoom(name) || strings.HasPrefix(name, conversationPrefix)
+}
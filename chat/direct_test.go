@@ -0,0 +1,200 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDirectMessages(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	s.Auth = NewAuthenticator(testKey, StaticUsers{"ann": "secret", "bob": "secret", "carol": "secret"})
+	go s.Run()
+	mux := http.NewServeMux()
+	s.Register(mux)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	tokens := make(map[string]string)
+	for _, user := range []string{"ann", "bob", "carol"} {
+		_, tokens[user] = login(t, ts, user, "secret")
+	}
+	dial := func(user, room string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?room="+room+"&token="+url.QueryEscape(tokens[user]), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		// Wait for the client to be subscribed.
+		conn.WriteJSON(Frame{Type: FramePing})
+		readFrame(t, conn, FramePong)
+		return conn
+	}
+	get := func(user, query string) (int, []Message) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/past_messages?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+tokens[user])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var messages []Message
+		json.NewDecoder(resp.Body).Decode(&messages)
+		return resp.StatusCode, messages
+	}
+
+	ann := dial("ann", DefaultRoom)
+	bob := dial("bob", DefaultRoom)
+	bobElsewhere := dial("bob", "other")
+	carol := dial("carol", DefaultRoom)
+
+	ann.WriteJSON(Frame{Type: FrameMessage, ID: "r1", Message: &Message{To: []string{"bob"}, Content: "psst"}})
+	ack := readFrame(t, ann, FrameAck)
+	if !reflect.DeepEqual(ack.Message.To, []string{"ann", "bob"}) || validRoom(ack.Message.Room) {
+		t.Fatalf("direct message ack = %+v", ack.Message)
+	}
+	for _, conn := range []*websocket.Conn{bob, bobElsewhere} {
+		if frame := readFrame(t, conn, FrameMessage); frame.Message.Content != "psst" {
+			t.Errorf("bob received %+v, want the direct message", frame.Message)
+		}
+	}
+
+	// Carol's next message is the public one posted after it.
+	s.Post(Message{Username: "ann", Content: "hello all"})
+	if frame := readFrame(t, carol, FrameMessage); frame.Message.Content != "hello all" {
+		t.Errorf("carol received %+v, want only the public message", frame.Message)
+	}
+
+	if _, messages := get("carol", ""); len(messages) != 1 || messages[0].Content != "hello all" {
+		t.Errorf("public history = %+v, want only the public message", messages)
+	}
+	if _, messages := get("bob", "with=ann"); len(messages) != 1 || messages[0].Content != "psst" {
+		t.Errorf("bob's history with ann = %+v, want the direct message", messages)
+	}
+	if _, messages := get("carol", "with=ann"); len(messages) != 0 {
+		t.Errorf("carol's history with ann = %+v, want none", messages)
+	}
+	if status, _ := get("carol", "room="+url.QueryEscape(ack.Message.Room)); status != http.StatusBadRequest {
+		t.Errorf("reading the conversation as a room: status %d, want 400", status)
+	}
+
+	req, _ := http.NewRequest(http.MethodPatch, ts.URL+MessagesPath+ack.Message.ID+"?with=bob", strings.NewReader(`{"content":"psst!"}`))
+	req.Header.Set("Authorization", "Bearer "+tokens["ann"])
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("PATCH of the direct message: status %d", resp.StatusCode)
+	}
+	if frame := readFrame(t, bob, FrameUpdate); frame.Message.Content != "psst!" {
+		t.Errorf("bob's update = %+v", frame.Message)
+	}
+
+	ann.WriteJSON(Frame{Type: FrameMessage, ID: "r2", Message: &Message{To: []string{"ann"}, Content: "note to self"}})
+	if frame := readFrame(t, ann, FrameError); frame.ID != "r2" || frame.Error.Code != CodeInvalidConversation {
+		t.Errorf("message to oneself answered with %+v", frame)
+	}
+}
+
+func TestConversationName(t *testing.T) {
+	room, participants, err := conversation("bob", []string{"carol", "ann", "bob", " ann"})
+	if err != nil || !reflect.DeepEqual(participants, []string{"ann", "bob", "carol"}) {
+		t.Fatalf("conversation = %q, %v, %v", room, participants, err)
+	}
+	if other, _, _ := conversation("ann", []string{"carol", "bob"}); other != room {
+		t.Errorf("participants name the conversation %q and %q", room, other)
+	}
+	if validRoom(room) || !validTarget(room) {
+		t.Errorf("conversation name %q is usable as a room", room)
+	}
+	if _, _, err := conversation("", []string{"bob"}); err != ErrInvalidConversation {
+		t.Errorf("anonymous conversation: %v, want ErrInvalidConversation", err)
+	}
+}
+
+func TestSendToConversationByName(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	go s.Run()
+	room, _, _ := conversation("ann", []string{"bob"})
+
+	body := `{"username": "mallory", "room": "` + room + `", "content": "hi"}`
+	w := httptest.NewRecorder()
+	s.HandleSend(w, httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), CodeInvalidRoom) {
+		t.Errorf("sending to %s by name: %d %s, want %s", room, w.Code, w.Body, CodeInvalidRoom)
+	}
+	if page, _ := s.Store.List(ListQuery{Room: room}); len(page) != 0 {
+		t.Errorf("conversation holds %+v", page)
+	}
+}
+
+// TestDirectMessagesNeedAuthentication checks that without authentication,
+// naming a user in the username query parameter or body neither reads,
+// receives nor sends their direct messages.
+func TestDirectMessagesNeedAuthentication(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	go s.Run()
+	mux := http.NewServeMux()
+	s.Register(mux)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	psst, err := s.Post(Message{Username: "ann", To: []string{"bob"}, Content: "psst"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkRead(psst.Room, "bob", psst.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(ts.URL + "/past_messages?with=ann&username=bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []Message
+	json.NewDecoder(resp.Body).Decode(&messages)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || len(messages) != 0 {
+		t.Errorf("reading ann and bob's conversation as bob: %d %+v, want 400", resp.StatusCode, messages)
+	}
+
+	resp, err = http.Post(ts.URL+"/send", "application/json", strings.NewReader(`{"username": "ann", "to": ["bob"], "content": "it's me"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("sending a direct message as ann: %d, want 400", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ts.URL + "/unread?username=bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unread []Unread
+	json.NewDecoder(resp.Body).Decode(&unread)
+	resp.Body.Close()
+	if len(unread) != 1 || unread[0].Room != DefaultRoom {
+		t.Errorf("unread counts of bob = %+v, want only %s", unread, DefaultRoom)
+	}
+
+	bob := dialWebSocket(t, s, "?username=bob")
+	bob.WriteJSON(Frame{Type: FramePing})
+	readFrame(t, bob, FramePong)
+	s.Post(Message{Username: "ann", To: []string{"bob"}, Content: "psst again"})
+	s.Post(Message{Username: "ann", Content: "hello everyone"})
+	if frame := readFrame(t, bob, FrameMessage); frame.Message.Content != "hello everyone" {
+		t.Errorf("bob received %+v", frame.Message)
+	}
+	if history, _ := s.Store.List(ListQuery{Room: psst.Room}); len(history) != 2 {
+		t.Errorf("conversation history = %+v", history)
+	}
+}
@@ -0,0 +1,343 @@
+package chat
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// DynamoStore keeps messages in a DynamoDB table keyed by the string
+// attributes "Room" (partition key) and "ID" (sort key). Because IDs sort in
+// creation order, a Query on one room returns its messages in order and can
+// start from any ID, so history is read a page at a time instead of with a
+// full table Scan, and each room is its own partition.
+//
+// A message's reactions are a map attribute holding a string set of users
+// per emoji, so that a reaction is added or removed with a single set update
+// rather than by rewriting the item.
+//
+// Transient errors, such as throttling, are retried by svc according to its
+// Retryer; once it gives up they are returned wrapped in ErrUnavailable.
+//
+// dynamodb.yaml in this package defines the table. Versions before rooms
+// kept messages in a table keyed by a numeric "ID" alone, which this store
+// cannot use; CopyLegacyMessages moves them over.
+type DynamoStore struct {
+	svc   dynamodbiface.DynamoDBAPI
+	table string
+}
+
+// NewDynamoStore returns a DynamoStore that uses svc to access table.
+func NewDynamoStore(svc dynamodbiface.DynamoDBAPI, table string) *DynamoStore {
+	return &DynamoStore{svc: svc, table: table}
+}
+
+func (s *DynamoStore) Append(msg Message) error {
+	av, err := dynamodbattribute.MarshalMap(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      av,
+	})
+	return classify(err)
+}
+
+func (s *DynamoStore) List(q ListQuery) ([]Message, error) {
+	keyCondition := "#room = :room"
+	values := map[string]*dynamodb.AttributeValue{
+		":room": {S: aws.String(q.Room)},
+	}
+	names := map[string]*string{"#room": aws.String("Room"), "#id": aws.String("ID")}
+	switch {
+	case q.Before != "":
+		keyCondition += " AND #id < :cursor"
+		values[":cursor"] = &dynamodb.AttributeValue{S: aws.String(q.Before)}
+	case q.After != "":
+		keyCondition += " AND #id > :cursor"
+		values[":cursor"] = &dynamodb.AttributeValue{S: aws.String(q.After)}
+	case q.Thread != "":
+		// Replies are newer than the message they reply to.
+		keyCondition += " AND #id >= :thread"
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.table),
+		KeyConditionExpression:    aws.String(keyCondition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		// Read away from the cursor, newest first unless paging forwards,
+		// so that the limit keeps the messages closest to it.
+		ScanIndexForward: aws.Bool(q.After != ""),
+	}
+	if q.Thread != "" {
+		input.FilterExpression = aws.String("#id = :thread OR #reply_to = :thread")
+		names["#reply_to"] = aws.String("reply_to")
+		values[":thread"] = &dynamodb.AttributeValue{S: aws.String(q.Thread)}
+	}
+	if q.Limit > 0 {
+		input.Limit = aws.Int64(int64(q.Limit))
+	}
+
+	messages := []Message{}
+	var decodeErr error
+	err := s.svc.QueryPages(input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var message Message
+			if message, decodeErr = decodeMessage(item); decodeErr != nil {
+				return false
+			}
+			messages = append(messages, message)
+			if q.Limit > 0 && len(messages) == q.Limit {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, classify(err)
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	if q.After == "" {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	return messages, nil
+}
+
+func (s *DynamoStore) Get(room, id string) (Message, error) {
+	result, err := s.svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key:       messageKey(room, id),
+	})
+	if err != nil {
+		return Message{}, classify(err)
+	}
+	if result.Item == nil {
+		return Message{}, ErrNotFound
+	}
+
+	return decodeMessage(result.Item)
+}
+
+// Update sets the content, edit time and deleted flag of the stored message
+// in place, rather than rewriting the whole item.
+func (s *DynamoStore) Update(msg Message) error {
+	values, err := dynamodbattribute.MarshalMap(struct {
+		Content  string     `dynamodbav:":content"`
+		EditedAt *time.Time `dynamodbav:":edited_at"`
+		Deleted  bool       `dynamodbav:":deleted"`
+	}{msg.Content, msg.EditedAt, msg.Deleted})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.table),
+		Key:                 messageKey(msg.Room, msg.ID),
+		UpdateExpression:    aws.String("SET #content = :content, #edited_at = :edited_at, #deleted = :deleted"),
+		ConditionExpression: aws.String("attribute_exists(#id)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#id":        aws.String("ID"),
+			"#content":   aws.String("content"),
+			"#edited_at": aws.String("edited_at"),
+			"#deleted":   aws.String("deleted"),
+		},
+		ExpressionAttributeValues: values,
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrNotFound
+	}
+	return classify(err)
+}
+
+func (s *DynamoStore) AddReaction(room, id, emoji, username string) (Message, error) {
+	return s.react(room, id, "ADD #reactions.#emoji :user", emoji, username)
+}
+
+func (s *DynamoStore) RemoveReaction(room, id, emoji, username string) (Message, error) {
+	// Removing the last user from a set removes the set.
+	return s.react(room, id, "DELETE #reactions.#emoji :user", emoji, username)
+}
+
+// react applies update, which adds :user to or removes it from the set of
+// users who reacted with #emoji, to a message that is not deleted.
+func (s *DynamoStore) react(room, id, update, emoji, username string) (Message, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.table),
+		Key:                 messageKey(room, id),
+		UpdateExpression:    aws.String(update),
+		ConditionExpression: aws.String("attribute_exists(#id) AND (attribute_not_exists(#deleted) OR #deleted = :false)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#id":        aws.String("ID"),
+			"#deleted":   aws.String("deleted"),
+			"#reactions": aws.String("reactions"),
+			"#emoji":     aws.String(emoji),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":user":  {SS: []*string{aws.String(username)}},
+			":false": {BOOL: aws.Bool(false)},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	}
+
+	result, err := s.svc.UpdateItem(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ValidationException" {
+		// Messages stored before reactions existed have no map to put
+		// the set in; add an empty one and try again.
+		_, err = s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 aws.String(s.table),
+			Key:                       messageKey(room, id),
+			UpdateExpression:          aws.String("SET #reactions = if_not_exists(#reactions, :empty)"),
+			ConditionExpression:       aws.String("attribute_exists(#id)"),
+			ExpressionAttributeNames:  map[string]*string{"#id": aws.String("ID"), "#reactions": aws.String("reactions")},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":empty": {M: map[string]*dynamodb.AttributeValue{}}},
+		})
+		if err == nil {
+			result, err = s.svc.UpdateItem(input)
+		}
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return Message{}, ErrNotFound
+	}
+	if err != nil {
+		return Message{}, classify(err)
+	}
+	return decodeMessage(result.Attributes)
+}
+
+func (s *DynamoStore) Delete(room, id string) error {
+	result, err := s.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:    aws.String(s.table),
+		Key:          messageKey(room, id),
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+	if err != nil {
+		return classify(err)
+	}
+	if result.Attributes == nil {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CopyLegacyMessages copies the messages in legacy, a table keyed by the
+// number attribute "ID" as written before rooms existed, into DefaultRoom of
+// the store's table, and returns how many it copied. Their IDs become
+// zero-padded strings, which sort in the order they were posted and before
+// every ULID. Messages already copied are skipped, so an interrupted copy
+// can be run again.
+func (s *DynamoStore) CopyLegacyMessages(legacy string) (int, error) {
+	copied := 0
+	var putErr error
+	err := s.svc.ScanPages(&dynamodb.ScanInput{TableName: aws.String(legacy)}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if item["ID"] == nil || item["ID"].N == nil {
+				putErr = fmt.Errorf("chat: legacy item without a numeric ID: %v", item)
+				return false
+			}
+			n, err := strconv.ParseUint(aws.StringValue(item["ID"].N), 10, 64)
+			if err != nil {
+				putErr = fmt.Errorf("chat: legacy item ID: %w", err)
+				return false
+			}
+			delete(item, "id")
+			item["ID"] = &dynamodb.AttributeValue{S: aws.String(fmt.Sprintf("%020d", n))}
+			if item["Room"] == nil {
+				item["Room"] = &dynamodb.AttributeValue{S: aws.String(DefaultRoom)}
+			}
+
+			_, err = s.svc.PutItem(&dynamodb.PutItemInput{
+				TableName:                aws.String(s.table),
+				Item:                     item,
+				ConditionExpression:      aws.String("attribute_not_exists(#id)"),
+				ExpressionAttributeNames: map[string]*string{"#id": aws.String("ID")},
+			})
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+				continue
+			}
+			if err != nil {
+				putErr = classify(err)
+				return false
+			}
+			copied++
+		}
+		return true
+	})
+	if err != nil {
+		return copied, classify(err)
+	}
+	return copied, putErr
+}
+
+// decodeMessage decodes an item, giving messages stored before CreatedAt
+// existed the time encoded in their ID, as Message.UnmarshalJSON does.
+func decodeMessage(item map[string]*dynamodb.AttributeValue) (Message, error) {
+	var message Message
+	if err := dynamodbattribute.UnmarshalMap(item, &message); err != nil {
+		return Message{}, err
+	}
+	if message.CreatedAt.IsZero() {
+		message.CreatedAt, _ = idTime(message.ID)
+	}
+	return message, nil
+}
+
+// MarshalDynamoDBAttributeValue stores reactions as a map of string sets. It
+// writes an empty map rather than nothing when there are none, so that
+// reactions can be added to it in place.
+func (r Reactions) MarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
+	av.M = make(map[string]*dynamodb.AttributeValue, len(r))
+	for emoji, users := range r {
+		if len(users) > 0 {
+			av.M[emoji] = &dynamodb.AttributeValue{SS: aws.StringSlice(users)}
+		}
+	}
+	return nil
+}
+
+// UnmarshalDynamoDBAttributeValue reads reactions stored by
+// MarshalDynamoDBAttributeValue, sorting each set's users.
+func (r *Reactions) UnmarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
+	if len(av.M) == 0 {
+		*r = nil
+		return nil
+	}
+	*r = make(Reactions, len(av.M))
+	for emoji, set := range av.M {
+		users := aws.StringValueSlice(set.SS)
+		sort.Strings(users)
+		(*r)[emoji] = users
+	}
+	return nil
+}
+
+func messageKey(room, id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"Room": {S: aws.String(room)},
+		"ID":   {S: aws.String(id)},
+	}
+}
+
+// classify wraps err in ErrUnavailable if it is one that the SDK would have
+// retried, meaning the request failed transiently.
+func classify(err error) error {
+	if err != nil && (request.IsErrorRetryable(err) || request.IsErrorThrottle(err)) {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
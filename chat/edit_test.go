@@ -0,0 +1,151 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEditAndDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.json")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(store)
+	s.Auth = NewAuthenticator(testKey, nil)
+	s.Auth.Moderators = []string{"mod"}
+	go s.Run()
+	_, events := s.Hub.Subscribe(DefaultRoom)
+
+	posted, _ := s.Post(Message{Username: "ann", Content: "helo"})
+	if time.Since(posted.CreatedAt) > time.Minute {
+		t.Errorf("CreatedAt = %v, want now", posted.CreatedAt)
+	}
+	<-events
+
+	if _, err := s.Edit(DefaultRoom, posted.ID, "bob", "spam"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("edit by another user: %v, want ErrForbidden", err)
+	}
+	if _, err := s.Edit(DefaultRoom, "nope", "ann", "hello"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("edit of missing message: %v, want ErrNotFound", err)
+	}
+
+	edited, err := s.Edit(DefaultRoom, posted.ID, "ann", "hello")
+	if err != nil || edited.Content != "hello" || edited.EditedAt == nil || !edited.CreatedAt.Equal(posted.CreatedAt) {
+		t.Fatalf("edit by author = %+v, %v", edited, err)
+	}
+	if event := <-events; event.Type != EventUpdate || event.Message.Content != "hello" {
+		t.Errorf("event after edit = %+v, want an update", event)
+	}
+
+	deleted, err := s.Delete(DefaultRoom, posted.ID, "mod")
+	if err != nil || !deleted.Deleted || deleted.Content != "" {
+		t.Fatalf("delete by moderator = %+v, %v", deleted, err)
+	}
+	if event := <-events; event.Type != EventUpdate || !event.Message.Deleted {
+		t.Errorf("event after delete = %+v, want an update", event)
+	}
+	if _, err := s.Edit(DefaultRoom, posted.ID, "ann", "back"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("edit of deleted message: %v, want ErrNotFound", err)
+	}
+
+	// The deleted message keeps its place in the history, on disk too.
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := reopened.List(ListQuery{Room: DefaultRoom})
+	if len(messages) != 1 || !messages[0].Deleted || messages[0].EditedAt == nil || messages[0].Content != "" {
+		t.Errorf("history after reload = %+v, want one deleted message", messages)
+	}
+}
+
+func TestEditOverHTTPAndWebSocket(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	s.Auth = NewAuthenticator(testKey, StaticUsers{"ann": "secret", "bob": "secret"})
+	go s.Run()
+	mux := http.NewServeMux()
+	s.Register(mux)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	_, annToken := login(t, ts, "ann", "secret")
+	_, bobToken := login(t, ts, "bob", "secret")
+
+	// A client in the room sees every change as an update frame.
+	watcher, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?token="+url.QueryEscape(bobToken), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?token="+url.QueryEscape(annToken), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(Frame{Type: FrameMessage, ID: "r1", Message: &Message{Content: "helo"}})
+	id := readFrame(t, conn, FrameAck).Message.ID
+
+	conn.WriteJSON(Frame{Type: FrameEdit, ID: "r2", Message: &Message{ID: id, Content: "hello"}})
+	if ack := readFrame(t, conn, FrameAck); ack.ID != "r2" || ack.Message.Content != "hello" {
+		t.Errorf("edit ack = %+v", ack)
+	}
+	if update := readFrame(t, watcher, FrameUpdate); update.Message.ID != id || update.Message.Content != "hello" {
+		t.Errorf("update frame = %+v", update)
+	}
+
+	request := func(method, token, body string) (int, Message) {
+		req, _ := http.NewRequest(method, ts.URL+MessagesPath+id, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var message Message
+		json.NewDecoder(resp.Body).Decode(&message)
+		return resp.StatusCode, message
+	}
+
+	if status, _ := request(http.MethodPatch, bobToken, `{"username":"ann","content":"spam"}`); status != http.StatusForbidden {
+		t.Errorf("PATCH by bob: status %d, want 403", status)
+	}
+	if status, _ := request(http.MethodDelete, bobToken, ""); status != http.StatusForbidden {
+		t.Errorf("DELETE by bob: status %d, want 403", status)
+	}
+	if status, message := request(http.MethodDelete, annToken, ""); status != http.StatusOK || !message.Deleted {
+		t.Errorf("DELETE by ann: status %d, message %+v", status, message)
+	}
+	if update := readFrame(t, watcher, FrameUpdate); !update.Message.Deleted {
+		t.Errorf("update frame = %+v, want the deleted message", update)
+	}
+	if status, _ := request(http.MethodPatch, annToken, `{"content":"again"}`); status != http.StatusNotFound {
+		t.Errorf("PATCH of deleted message: status %d, want 404", status)
+	}
+}
+
+func TestMessageCreatedAtFromID(t *testing.T) {
+	id := NewIDGenerator().New()
+	var message Message
+	if err := json.Unmarshal([]byte(`{"id":"`+id+`","username":"ann","content":"hi"}`), &message); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(message.CreatedAt) > time.Minute {
+		t.Errorf("CreatedAt = %v, want the time in the ID", message.CreatedAt)
+	}
+
+	var legacy Message
+	if err := json.Unmarshal([]byte(`{"id":7,"username":"ann","content":"hi"}`), &legacy); err != nil || !legacy.CreatedAt.IsZero() {
+		t.Errorf("legacy message: CreatedAt %v, %v; want zero", legacy.CreatedAt, err)
+	}
+}
@@ -0,0 +1,87 @@
+package chat
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrUnavailable is returned, wrapped around the underlying error, by a
+// MessageStore whose backend failed transiently, for example because
+// DynamoDB throttled it, and kept failing after being retried. The request
+// may succeed if tried again later.
+var ErrUnavailable = errors.New("store temporarily unavailable")
+
+// Error codes sent in ErrorResponse.Code.
+const (
+	CodeMethodNotAllowed    = "method_not_allowed"
+	CodeInvalidBody         = "invalid_body"
+	CodeInvalidRoom         = "invalid_room"
+	CodeInvalidQuery        = "invalid_query"
+	CodeInvalidFrame        = "invalid_frame"
+	CodeInvalidReply        = "invalid_reply"
+	CodeInvalidReaction     = "invalid_reaction"
+	CodeInvalidConversation = "invalid_conversation"
+	CodeInvalidPhone        = "invalid_phone"
+	CodePhoneTaken          = "phone_taken"
+	CodeInvalidCode         = "invalid_code"
+	CodeUpgradeFailed       = "upgrade_failed"
+	CodeOriginNotAllowed    = "origin_not_allowed"
+	CodeUnauthorized        = "unauthorized"
+	CodeInvalidCredentials  = "invalid_credentials"
+	CodeNotFound            = "not_found"
+	CodeForbidden           = "forbidden"
+	CodeRateLimited         = "rate_limited"
+	CodeUnavailable         = "unavailable"
+	CodeInternal            = "internal"
+)
+
+// retryAfter is the Retry-After sent with 503 answers, in seconds.
+const retryAfter = "1"
+
+// ErrorResponse is the JSON body of every error answer.
+type ErrorResponse struct {
+	Code    string `json:"code"`    // Machine-readable, one of the Code constants
+	Message string `json:"message"` // Human-readable description
+}
+
+// WriteError answers with status and an ErrorResponse carrying code and
+// message.
+func WriteError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, ErrorResponse{Code: code, Message: message})
+}
+
+// methodNotAllowed answers a request whose method is not one of allowed.
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	WriteError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Only "+strings.Join(allowed, " or ")+" is allowed")
+}
+
+// WriteStoreError answers a request whose store operation failed with err:
+// 503 if the store is temporarily unavailable, 500 otherwise.
+func WriteStoreError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, ErrUnavailable) {
+		w.Header().Set("Retry-After", retryAfter)
+		WriteError(w, http.StatusServiceUnavailable, CodeUnavailable, message)
+		return
+	}
+	WriteError(w, http.StatusInternalServerError, CodeInternal, message)
+}
+
+// upgradeError answers a request that could not be upgraded to a WebSocket.
+func upgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	log.Println("WebSocket upgrade failed:", reason)
+	WriteError(w, status, CodeUpgradeFailed, reason.Error())
+}
+
+// closeWebSocket sends a close frame with code and reason. The connection
+// still has to be closed afterwards.
+func closeWebSocket(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(writeWait))
+}
@@ -0,0 +1,71 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// failingStore fails every operation with err.
+type failingStore struct{ err error }
+
+func (s failingStore) Append(Message) error                { return s.err }
+func (s failingStore) List(ListQuery) ([]Message, error)   { return nil, s.err }
+func (s failingStore) Get(string, string) (Message, error) { return Message{}, s.err }
+func (s failingStore) Update(Message) error                { return s.err }
+func (s failingStore) Delete(string, string) error         { return s.err }
+
+func (s failingStore) AddReaction(string, string, string, string) (Message, error) {
+	return Message{}, s.err
+}
+
+func (s failingStore) RemoveReaction(string, string, string, string) (Message, error) {
+	return Message{}, s.err
+}
+
+func TestErrorResponses(t *testing.T) {
+	unavailable := fmt.Errorf("%w: throttled", ErrUnavailable)
+	tests := []struct {
+		name    string
+		store   MessageStore
+		handler func(*Server) http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		status  int
+		code    string
+	}{
+		{"wrong method", NewMemoryStore(), sendHandler, http.MethodGet, "/send", "", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{"bad body", NewMemoryStore(), sendHandler, http.MethodPost, "/send", "{", http.StatusBadRequest, CodeInvalidBody},
+		{"bad room", NewMemoryStore(), sendHandler, http.MethodPost, "/send", `{"room":"a b"}`, http.StatusBadRequest, CodeInvalidRoom},
+		{"bad limit", NewMemoryStore(), pastHandler, http.MethodGet, "/past_messages?limit=0", "", http.StatusBadRequest, CodeInvalidQuery},
+		{"store unavailable", failingStore{unavailable}, sendHandler, http.MethodPost, "/send", `{}`, http.StatusServiceUnavailable, CodeUnavailable},
+		{"store broken", failingStore{errors.New("disk full")}, pastHandler, http.MethodGet, "/past_messages", "", http.StatusInternalServerError, CodeInternal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(tt.store)
+			w := httptest.NewRecorder()
+			tt.handler(s)(w, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			var response ErrorResponse
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatalf("decoding error body: %v", err)
+			}
+			if response.Code != tt.code || response.Message == "" {
+				t.Errorf("body %+v, want code %s and a message", response, tt.code)
+			}
+		})
+	}
+}
+
+func sendHandler(s *Server) http.HandlerFunc { return s.HandleSend }
+func pastHandler(s *Server) http.HandlerFunc { return s.HandlePastMessages }
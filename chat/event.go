@@ -0,0 +1,42 @@
+package chat
+
+// Event types delivered by the Hub.
+const (
+	EventMessage  = "message"  // A message was posted
+	EventUpdate   = "update"   // A message was edited, deleted or reacted to
+	EventTyping   = "typing"   // A user is typing
+	EventPresence = "presence" // A user joined or left
+	EventRead     = "read"     // A user read up to a message
+)
+
+// Changes to a message announced by an EventUpdate.
+const (
+	ChangeEdited  = "edited"
+	ChangeDeleted = "deleted"
+	ChangeReacted = "reacted"
+)
+
+// Event is something that happened in a room. The Hub delivers events to
+// the clients subscribed to their room, and the Bus carries them between
+// replicas.
+type Event struct {
+	Type     string    `json:"type"`               // One of the Event constants
+	Room     string    `json:"room"`               // Room the event happened in
+	Message  *Message  `json:"message,omitempty"`  // Message posted or changed, for EventMessage and EventUpdate; only the ID and room of the message read, for EventRead
+	Change   string    `json:"change,omitempty"`   // What changed, one of the Change constants, for EventUpdate
+	Username string    `json:"username,omitempty"` // User concerned, for EventTyping, EventPresence and EventRead
+	Presence *Presence `json:"presence,omitempty"` // Whether the user is online, for EventPresence
+	Origin   string    `json:"origin,omitempty"`   // Replica that published an EventPresence
+	To       []string  `json:"to,omitempty"`       // Participants, for events in a direct conversation
+}
+
+// messageEvent returns the event announcing msg.
+func messageEvent(msg Message) Event {
+	return Event{Type: EventMessage, Room: msg.Room, Message: &msg, To: msg.To}
+}
+
+// updateEvent returns the event announcing that msg was changed as change
+// says.
+func updateEvent(msg Message, change string) Event {
+	return Event{Type: EventUpdate, Room: msg.Room, Message: &msg, Change: change, To: msg.To}
+}
@@ -0,0 +1,163 @@
+package chat
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore keeps messages in memory and mirrors them to a JSON file, which
+// is rewritten after every change. The file holds a single array of
+// messages; each message's room is recorded in its room field.
+type FileStore struct {
+	mutex sync.Mutex
+	path  string
+	rooms rooms
+}
+
+// NewFileStore returns a FileStore backed by the file at path, loading any
+// messages it already contains. A missing or empty file is treated as an
+// empty history, and messages written before rooms existed are placed in
+// DefaultRoom.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, rooms: make(rooms)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// File does not exist yet, no need to load messages
+			return s, nil
+		}
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return s, nil
+	}
+
+	var messages []Message
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, err
+	}
+	for _, message := range messages {
+		if message.Room == "" {
+			message.Room = DefaultRoom
+		}
+		s.rooms.append(message)
+	}
+	return s, nil
+}
+
+func (s *FileStore) Append(msg Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.rooms.append(msg)
+	if err := s.save(); err != nil {
+		s.rooms[msg.Room] = s.rooms[msg.Room][:len(s.rooms[msg.Room])-1]
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) List(q ListQuery) ([]Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return pageOf(s.rooms[q.Room], q), nil
+}
+
+func (s *FileStore) Get(room, id string) (Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.rooms.get(room, id)
+}
+
+func (s *FileStore) Update(msg Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, err := s.rooms.update(msg)
+	if err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		s.rooms.replace(previous)
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) AddReaction(room, id, emoji, username string) (Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.react(room, id, func(r Reactions) { r.add(emoji, username) })
+}
+
+func (s *FileStore) RemoveReaction(room, id, emoji, username string) (Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.react(room, id, func(r Reactions) { r.remove(emoji, username) })
+}
+
+func (s *FileStore) react(room, id string, change func(Reactions)) (Message, error) {
+	msg, previous, err := s.rooms.react(room, id, change)
+	if err != nil {
+		return Message{}, err
+	}
+	if err := s.save(); err != nil {
+		s.rooms.replace(previous)
+		return Message{}, err
+	}
+	return msg, nil
+}
+
+func (s *FileStore) Delete(room, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, err := s.rooms.remove(room, id)
+	if err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		s.rooms[room] = previous
+		return err
+	}
+	return nil
+}
+
+// save writes every message to the store's file.
+func (s *FileStore) save() error {
+	data, err := json.Marshal(s.rooms.all())
+	if err != nil {
+		return err
+	}
+	return writeFile(s.path, data)
+}
+
+// writeFile writes data to a temporary file and renames it over the file at
+// path, so a crash mid-write never leaves a truncated file behind.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,440 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes for HandlePastMessages.
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// HandleSend accepts a JSON message on POST and posts it to the chat. The
+// message goes to the room named in its room field, or else in the room
+// query parameter, or else DefaultRoom. If the request is authenticated the
+// message is posted under the authenticated username. A message with a
+// reply_to field replies to the message with that ID in the same room. A
+// message with a to field listing usernames is a direct message to them,
+// which only an authenticated user may send; see Server.Post.
+func (s *Server) HandleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var message Message
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+
+	if message.Room == "" {
+		message.Room = r.URL.Query().Get("room")
+	}
+	stampUser(r, &message)
+
+	if _, err := s.Post(message); errors.Is(err, ErrInvalidRoom) {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRoom, "Invalid room")
+		return
+	} else if errors.Is(err, ErrInvalidReply) {
+		WriteError(w, http.StatusBadRequest, CodeInvalidReply, "Message to reply to not found")
+		return
+	} else if errors.Is(err, ErrInvalidConversation) {
+		WriteError(w, http.StatusBadRequest, CodeInvalidConversation, conversationErrorMessage)
+		return
+	} else if err != nil {
+		log.Printf("Failed to save message: %v", err)
+		WriteStoreError(w, err, "Failed to save message")
+		return
+	}
+}
+
+// MessagesPath is the prefix under which Register serves HandleMessage.
+const MessagesPath = "/messages/"
+
+// HandleMessage edits or deletes the message whose ID follows MessagesPath,
+// in the room named by the room query parameter, DefaultRoom if unset. PATCH
+// replaces its content with that of the JSON body {"content": "..."}; DELETE
+// removes it. Both answer with the message as changed. Only the message's
+// author or a moderator may change it; if the request is not authenticated,
+// the author is whoever the body's username field names.
+//
+// Requests to the message's path followed by /reactions react to it: POST
+// adds the reaction in the JSON body {"emoji": "..."} and DELETE removes it,
+// on behalf of the authenticated user or the body's username field.
+//
+// A direct message is addressed with the with query parameter instead of
+// room, listing the other participants of its conversation. Only an
+// authenticated participant may change one.
+func (s *Server) HandleMessage(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, MessagesPath)
+	if reactions := strings.TrimSuffix(id, "/reactions"); reactions != id {
+		s.handleReactions(w, r, reactions)
+		return
+	}
+
+	if r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodPatch, http.MethodDelete)
+		return
+	}
+	if !validMessageID(w, id) {
+		return
+	}
+
+	// A DELETE needs no body.
+	var body Message
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !(err == io.EOF && r.Method == http.MethodDelete) {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+	stampUser(r, &body)
+	room, err := targetRoom(r)
+	if err != nil {
+		writeTargetError(w, err)
+		return
+	}
+
+	var message Message
+	if r.Method == http.MethodPatch {
+		message, err = s.Edit(room, id, body.Username, body.Content)
+	} else {
+		message, err = s.Delete(room, id, body.Username)
+	}
+	writeChange(w, id, message, err)
+}
+
+// handleReactions adds or removes a reaction to the message with ID id.
+func (s *Server) handleReactions(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodPost, http.MethodDelete)
+		return
+	}
+	if !validMessageID(w, id) {
+		return
+	}
+
+	var body struct {
+		Emoji    string `json:"emoji"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+	if user, ok := User(r); ok {
+		body.Username = user
+	}
+	room, err := targetRoom(r)
+	if err != nil {
+		writeTargetError(w, err)
+		return
+	}
+
+	var message Message
+	if r.Method == http.MethodPost {
+		message, err = s.React(room, id, body.Username, body.Emoji)
+	} else {
+		message, err = s.Unreact(room, id, body.Username, body.Emoji)
+	}
+	writeChange(w, id, message, err)
+}
+
+// validMessageID checks the message ID taken from the path. If it is
+// invalid it answers the request and reports false.
+func validMessageID(w http.ResponseWriter, id string) bool {
+	if id == "" || strings.Contains(id, "/") {
+		WriteError(w, http.StatusNotFound, CodeNotFound, "Message not found")
+		return false
+	}
+	return true
+}
+
+// writeChange answers a request that changed the message with ID id with
+// the message as changed, or with the error the change failed with.
+func writeChange(w http.ResponseWriter, id string, message Message, err error) {
+	if err != nil {
+		status, code, text := changeError(err)
+		if status >= http.StatusInternalServerError {
+			log.Printf("Failed to change message %s: %v", id, err)
+			WriteStoreError(w, err, text)
+			return
+		}
+		WriteError(w, status, code, text)
+		return
+	}
+	writeJSON(w, http.StatusOK, message)
+}
+
+// changeError returns the status, error code and message that answer an
+// Edit, Delete, React or Unreact that failed with err.
+func changeError(err error) (status int, code, message string) {
+	switch {
+	case errors.Is(err, ErrInvalidRoom):
+		return http.StatusBadRequest, CodeInvalidRoom, "Invalid room"
+	case errors.Is(err, ErrInvalidConversation):
+		return http.StatusBadRequest, CodeInvalidConversation, conversationErrorMessage
+	case errors.Is(err, ErrInvalidReaction):
+		return http.StatusBadRequest, CodeInvalidReaction, fmt.Sprintf("Reactions must be 1 to %d bytes without spaces", MaxEmojiLength)
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, CodeNotFound, "Message not found"
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden, CodeForbidden, "Only the author or a moderator may change this message"
+	case errors.Is(err, ErrUnavailable):
+		return http.StatusServiceUnavailable, CodeUnavailable, "Failed to save message"
+	default:
+		return http.StatusInternalServerError, CodeInternal, "Failed to save message"
+	}
+}
+
+// HandleReceive long-polls for messages in the room named by the room query
+// parameter, DefaultRoom if unset, and answers with them as a JSON array,
+// oldest first. If the since query parameter names a message ID, every
+// message newer than it is returned at once; otherwise, or if there are
+// none, the request waits for the next message to be posted, and answers
+// with it and any that arrived along with it. If nothing arrives within
+// PollWaitPeriod the answer is 204 No Content.
+//
+// Clients that pass the ID of the last message they saw as since never miss
+// a message posted between two polls.
+//
+// Messages edited or deleted while the request waits are answered too, as
+// they now are; clients recognize them by an ID they already have and
+// replace their copy.
+//
+// With the events query parameter set to 1 the answer is instead a JSON
+// array of Events, which also tells of users typing and coming online or
+// going offline; messages newer than since are then message events. A
+// client is online while it keeps polling, as with HandleWebSocket.
+//
+// Direct messages to the authenticated user polling are answered as they
+// arrive too, but never resumed: clients read those they
+// missed with HandlePastMessages.
+func (s *Server) HandleReceive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	room, ok := roomParam(r)
+	if !ok {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRoom, "Invalid room")
+		return
+	}
+	since := r.URL.Query().Get("since")
+	allEvents := r.URL.Query().Get("events") == "1"
+
+	// Only the events the client asked for end a poll.
+	wanted := func(event Event) bool {
+		return allEvents || event.Type == EventMessage || event.Type == EventUpdate
+	}
+
+	clientID, events, backlog, err := s.resume(room, directUser(r), since)
+	if err != nil {
+		log.Printf("Failed to get messages since %s: %v", since, err)
+		WriteStoreError(w, err, "Failed to get messages")
+		return
+	}
+	defer s.Hub.Unsubscribe(clientID)
+	defer s.join(r, room)()
+
+	if len(backlog) > 0 {
+		if allEvents {
+			batch := make([]Event, len(backlog))
+			for i, message := range backlog {
+				batch[i] = messageEvent(message)
+			}
+			writeJSON(w, http.StatusOK, batch)
+			return
+		}
+		writeJSON(w, http.StatusOK, backlog)
+		return
+	}
+
+	timeout := time.After(s.PollWaitPeriod)
+	var batch []Event
+	for batch == nil {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// Evicted for falling behind; the client catches up from
+				// the store on its next poll.
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if wanted(event) {
+				batch = []Event{event}
+			}
+		case <-timeout:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// Answer with everything that has arrived along with the first one.
+collect:
+	for len(batch) < MaxPageSize {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				break collect
+			}
+			if wanted(event) {
+				batch = append(batch, event)
+			}
+		default:
+			break collect
+		}
+	}
+
+	if allEvents {
+		writeJSON(w, http.StatusOK, batch)
+		return
+	}
+	messages := make([]Message, len(batch))
+	for i, event := range batch {
+		messages[i] = *event.Message
+	}
+	writeJSON(w, http.StatusOK, messages)
+}
+
+// HandlePastMessages answers with a page of stored messages as a JSON array,
+// oldest first. Without parameters it returns the newest DefaultPageSize
+// messages of DefaultRoom. The query parameters are:
+//
+//	room    room to read
+//	before  only messages older than this message ID
+//	after   only messages newer than this message ID
+//	limit   page size, at most MaxPageSize
+//	thread  only the message with this ID and the replies to it
+//	with    instead of room, the other users in a direct conversation of
+//	        the authenticated user
+//
+// When more messages exist in the direction being paged, the response carries
+// a Link header with rel="next" pointing at the following page.
+func (s *Server) HandlePastMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	// Direct conversations are addressed by their participants, so only
+	// an authenticated participant can read one.
+	room, err := targetRoom(r)
+	if err != nil {
+		writeTargetError(w, err)
+		return
+	}
+
+	query, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+		return
+	}
+	query.Room = room
+
+	// Ask for one message more than the page holds to learn whether there
+	// is a next page.
+	lookahead := query
+	lookahead.Limit++
+
+	messages, err := s.Store.List(lookahead)
+	if err != nil {
+		log.Printf("Failed to get past messages: %v", err)
+		WriteStoreError(w, err, "Failed to get past messages")
+		return
+	}
+
+	if len(messages) > query.Limit {
+		// Drop the extra message, which is the one furthest from the cursor.
+		var next url.Values
+		if query.After != "" {
+			messages = messages[:query.Limit]
+			next = url.Values{"after": {messages[len(messages)-1].ID}}
+		} else {
+			messages = messages[1:]
+			next = url.Values{"before": {messages[0].ID}}
+		}
+		if with := r.URL.Query().Get("with"); with != "" {
+			next.Set("with", with)
+		} else {
+			next.Set("room", room)
+		}
+		next.Set("limit", strconv.Itoa(query.Limit))
+		if query.Thread != "" {
+			next.Set("thread", query.Thread)
+		}
+
+		link := url.URL{Path: r.URL.Path, RawQuery: next.Encode()}
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, link.String()))
+	}
+
+	if messages == nil {
+		messages = []Message{} // Ensure an empty array is returned if there are no past messages
+	}
+
+	writeJSON(w, http.StatusOK, messages)
+}
+
+// HandleStats answers with the hub's delivery counters as JSON.
+func (s *Server) HandleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.Hub.Stats())
+}
+
+// parseListQuery reads the before, after, limit and thread parameters of a
+// history request.
+func parseListQuery(values url.Values) (ListQuery, error) {
+	query := ListQuery{
+		Before: values.Get("before"),
+		After:  values.Get("after"),
+		Thread: values.Get("thread"),
+		Limit:  DefaultPageSize,
+	}
+	if query.Before != "" && query.After != "" {
+		return ListQuery{}, errors.New("Only one of before and after may be set")
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MaxPageSize {
+			return ListQuery{}, fmt.Errorf("Limit must be between 1 and %d", MaxPageSize)
+		}
+		query.Limit = n
+	}
+	return query, nil
+}
+
+// roomParam returns the room named by the request's room query parameter,
+// or DefaultRoom if it has none. It reports false if the name is invalid.
+func roomParam(r *http.Request) (string, bool) {
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		return DefaultRoom, true
+	}
+	return room, validRoom(room)
+}
+
+// writeJSON answers with status and v as JSON.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode response as JSON: %v", err)
+	}
+}
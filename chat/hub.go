@@ -0,0 +1,305 @@
+package chat
+
+// DefaultQueueSize is how many events may wait for a single client when
+// Hub.QueueSize is not set.
+const DefaultQueueSize = 100
+
+// recentSize is how many of each room's latest messages the hub remembers,
+// so that clients resuming from a recent message need not read the store.
+const recentSize = 256
+
+// OverflowPolicy decides what a Hub does with an event for a client whose
+// queue is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued event to make room, so a
+	// slow client misses events but stays connected.
+	DropOldest OverflowPolicy = iota
+	// Disconnect evicts the client: its channel is closed and it receives
+	// nothing more. Clients are expected to reconnect and catch up from
+	// the history.
+	Disconnect
+)
+
+// HubStats counts what a Hub has done since it was created.
+type HubStats struct {
+	Clients   int    `json:"clients"`   // Currently subscribed clients
+	Delivered uint64 `json:"delivered"` // Events queued for a client
+	Dropped   uint64 `json:"dropped"`   // Events discarded from full queues
+	Evicted   uint64 `json:"evicted"`   // Clients disconnected for falling behind
+}
+
+// Hub fans events out to the clients subscribed to each event's room, except
+// that events in direct conversations, such as direct messages, go to the
+// connections of their participants, whatever room those are subscribed
+// to. Every client has its own bounded queue, which the hub fills without
+// ever waiting, so a client that stops reading cannot delay delivery to
+// others.
+//
+// All of the hub's state is owned by the goroutine running Run. The other
+// methods send it commands and, where they return something, wait for its
+// reply, so none of them may be called before Run has been started.
+type Hub struct {
+	// QueueSize is how many events may wait for one client, or
+	// DefaultQueueSize if zero. It must not be changed once Run has started.
+	QueueSize int
+	// Overflow decides what happens when a client's queue is full. It must
+	// not be changed once Run has started.
+	Overflow OverflowPolicy
+
+	register   chan registration  // Subscribe, SubscribeSince and SubscribeAs requests
+	unregister chan int           // IDs of clients to remove
+	publish    chan Event         // Events to deliver
+	stats      chan chan HubStats // Stats requests
+}
+
+// registration asks Run to subscribe a client to room, replying with the
+// client and, if since is set, the backlog after since.
+type registration struct {
+	room     string
+	username string
+	since    string
+	reply    chan subscription
+}
+
+type subscription struct {
+	clientID int
+	events   chan Event
+	backlog  []Message
+	ok       bool
+}
+
+// hubState is the state owned by Run.
+type hubState struct {
+	clients      map[string]map[int]chan Event // Connected clients by room
+	clientRooms  map[int]string                // Room each client is subscribed to
+	users        map[string]map[int]chan Event // Clients of known users by username
+	clientUsers  map[int]string                // User of each client, if known
+	recent       map[string][]Message          // Latest messages by room, oldest first
+	nextClientID int                           // Next client ID
+	stats        HubStats                      // Counters reported by Stats
+}
+
+// NewHub returns a Hub with no clients that drops the oldest message when a
+// client falls behind. Run must be started for the hub to do anything.
+func NewHub() *Hub {
+	return &Hub{
+		Overflow:   DropOldest,
+		register:   make(chan registration),
+		unregister: make(chan int),
+		publish:    make(chan Event),
+		stats:      make(chan chan HubStats),
+	}
+}
+
+// Run serves the hub's commands, delivering published events to the
+// clients subscribed to their room. It never returns.
+func (h *Hub) Run() {
+	state := &hubState{
+		clients:      make(map[string]map[int]chan Event),
+		clientRooms:  make(map[int]string),
+		users:        make(map[string]map[int]chan Event),
+		clientUsers:  make(map[int]string),
+		recent:       make(map[string][]Message),
+		nextClientID: 1,
+	}
+
+	for {
+		select {
+		case r := <-h.register:
+			r.reply <- h.subscribe(state, r)
+		case clientID := <-h.unregister:
+			state.unsubscribe(clientID)
+		case event := <-h.publish:
+			if len(event.To) > 0 {
+				for _, username := range event.To {
+					for clientID, client := range state.users[username] {
+						h.deliver(state, clientID, client, event)
+					}
+				}
+				continue
+			}
+			switch event.Type {
+			case EventMessage:
+				state.remember(*event.Message)
+			case EventUpdate:
+				state.revise(*event.Message)
+			}
+			for clientID, client := range state.clients[event.Room] {
+				h.deliver(state, clientID, client, event)
+			}
+		case reply := <-h.stats:
+			stats := state.stats
+			stats.Clients = len(state.clientRooms)
+			reply <- stats
+		}
+	}
+}
+
+// deliver queues event for one client without blocking, applying the
+// overflow policy if the client's queue is full.
+func (h *Hub) deliver(state *hubState, clientID int, client chan Event, event Event) {
+	select {
+	case client <- event:
+		state.stats.Delivered++
+		return
+	default:
+	}
+
+	switch h.Overflow {
+	case Disconnect:
+		state.unsubscribe(clientID)
+		state.stats.Evicted++
+	default:
+		// Run is the only sender, so once one event has been removed
+		// there is room for this one, unless the client itself just
+		// emptied the queue, which leaves room as well.
+		select {
+		case <-client:
+			state.stats.Dropped++
+		default:
+		}
+		client <- event
+		state.stats.Delivered++
+	}
+}
+
+// Publish queues event for delivery to every client subscribed to
+// event.Room.
+func (h *Hub) Publish(event Event) {
+	h.publish <- event
+}
+
+// Broadcast publishes the EventMessage for msg.
+func (h *Hub) Broadcast(msg Message) {
+	h.Publish(messageEvent(msg))
+}
+
+// Stats returns the hub's counters.
+func (h *Hub) Stats() HubStats {
+	reply := make(chan HubStats, 1)
+	h.stats <- reply
+	return <-reply
+}
+
+// Subscribe registers a new client for room and returns its ID together with
+// the channel its events are delivered on. The channel is closed when the
+// client unsubscribes or is evicted.
+func (h *Hub) Subscribe(room string) (int, <-chan Event) {
+	s := h.request(registration{room: room})
+	return s.clientID, s.events
+}
+
+// SubscribeSince subscribes to room like Subscribe and also returns the
+// backlog of messages in room newer than the message with ID since. Every
+// message after since is then either in the backlog or delivered on the
+// channel as an EventMessage, exactly once. If since is empty the backlog is
+// empty. ok is false if the hub no longer remembers since, in which case the
+// caller has to read the backlog from the store.
+func (h *Hub) SubscribeSince(room, since string) (clientID int, events <-chan Event, backlog []Message, ok bool) {
+	return h.SubscribeAs(room, "", since)
+}
+
+// SubscribeAs subscribes to room like SubscribeSince on behalf of username,
+// whose direct messages are then delivered on the channel as well. An empty
+// username subscribes anonymously. The backlog only ever holds messages in
+// room.
+func (h *Hub) SubscribeAs(room, username, since string) (clientID int, events <-chan Event, backlog []Message, ok bool) {
+	s := h.request(registration{room: room, username: username, since: since})
+	return s.clientID, s.events, s.backlog, s.ok
+}
+
+func (h *Hub) request(r registration) subscription {
+	r.reply = make(chan subscription, 1)
+	h.register <- r
+	return <-r.reply
+}
+
+// Unsubscribe removes a client and closes its channel. Unsubscribing a
+// client that was already evicted does nothing.
+func (h *Hub) Unsubscribe(clientID int) {
+	h.unregister <- clientID
+}
+
+func (h *Hub) subscribe(state *hubState, r registration) subscription {
+	room, since := r.room, r.since
+	clientID := state.nextClientID
+	state.nextClientID++
+
+	queueSize := h.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+
+	if state.clients[room] == nil {
+		state.clients[room] = make(map[int]chan Event)
+	}
+	client := make(chan Event, queueSize)
+	state.clients[room][clientID] = client
+	state.clientRooms[clientID] = room
+	if r.username != "" {
+		if state.users[r.username] == nil {
+			state.users[r.username] = make(map[int]chan Event)
+		}
+		state.users[r.username][clientID] = client
+		state.clientUsers[clientID] = r.username
+	}
+
+	s := subscription{clientID: clientID, events: client, ok: true}
+	if since == "" {
+		return s
+	}
+
+	recent := state.recent[room]
+	i := indexOf(recent, since)
+	if i < 0 {
+		s.ok = false
+		return s
+	}
+	s.backlog = make([]Message, len(recent)-i-1)
+	copy(s.backlog, recent[i+1:])
+	return s
+}
+
+// remember adds msg to its room's recent messages, forgetting the oldest
+// once there are recentSize of them.
+func (s *hubState) remember(msg Message) {
+	recent := s.recent[msg.Room]
+	if len(recent) == recentSize {
+		copy(recent, recent[1:])
+		recent[len(recent)-1] = msg
+		return
+	}
+	s.recent[msg.Room] = append(recent, msg)
+}
+
+// revise replaces the remembered message with msg's ID, if any, so that
+// clients resuming later see it as changed.
+func (s *hubState) revise(msg Message) {
+	recent := s.recent[msg.Room]
+	if i := indexOf(recent, msg.ID); i >= 0 {
+		recent[i] = msg
+	}
+}
+
+func (s *hubState) unsubscribe(clientID int) {
+	room, ok := s.clientRooms[clientID]
+	if !ok {
+		return
+	}
+	client := s.clients[room][clientID]
+	delete(s.clientRooms, clientID)
+	delete(s.clients[room], clientID)
+	if len(s.clients[room]) == 0 {
+		delete(s.clients, room)
+	}
+	if username, ok := s.clientUsers[clientID]; ok {
+		delete(s.clientUsers, clientID)
+		delete(s.users[username], clientID)
+		if len(s.users[username]) == 0 {
+			delete(s.users, username)
+		}
+	}
+	close(client)
+}
@@ -0,0 +1,254 @@
+package chat
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startHub(t *testing.T, queueSize int, overflow OverflowPolicy) *Hub {
+	t.Helper()
+	h := NewHub()
+	h.QueueSize = queueSize
+	h.Overflow = overflow
+	go h.Run()
+	return h
+}
+
+// receive reads n message events from events, failing the test if they do
+// not arrive in time, and returns their messages.
+func receive(t *testing.T, events <-chan Event, n int) []Message {
+	t.Helper()
+	var received []Message
+	timeout := time.After(5 * time.Second)
+	for len(received) < n {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("channel closed after %d of %d messages", len(received), n)
+			}
+			if event.Type != EventMessage {
+				t.Fatalf("got a %s event, want a message", event.Type)
+			}
+			received = append(received, *event.Message)
+		case <-timeout:
+			t.Fatalf("timed out after %d of %d messages", len(received), n)
+		}
+	}
+	return received
+}
+
+func TestHubDeliversToRoomOnly(t *testing.T) {
+	h := startHub(t, 0, DropOldest)
+
+	_, general := h.Subscribe("general")
+	_, random := h.Subscribe("random")
+
+	h.Broadcast(Message{ID: "1", Room: "general"})
+	h.Broadcast(Message{ID: "2", Room: "random"})
+
+	if got := receive(t, general, 1); got[0].ID != "1" {
+		t.Errorf("general got %q, want 1", got[0].ID)
+	}
+	if got := receive(t, random, 1); got[0].ID != "2" {
+		t.Errorf("random got %q, want 2", got[0].ID)
+	}
+	if stats := h.Stats(); stats.Clients != 2 || stats.Delivered != 2 {
+		t.Errorf("stats = %+v, want 2 clients and 2 delivered", stats)
+	}
+}
+
+func TestHubUnsubscribeClosesChannel(t *testing.T) {
+	h := startHub(t, 0, DropOldest)
+
+	clientID, messages := h.Subscribe("general")
+	h.Unsubscribe(clientID)
+	h.Unsubscribe(clientID) // Unsubscribing twice does nothing.
+
+	if _, ok := <-messages; ok {
+		t.Error("channel still open after Unsubscribe")
+	}
+	if stats := h.Stats(); stats.Clients != 0 {
+		t.Errorf("%d clients after Unsubscribe, want 0", stats.Clients)
+	}
+}
+
+func TestHubDropOldest(t *testing.T) {
+	h := startHub(t, 2, DropOldest)
+
+	_, messages := h.Subscribe("general")
+	for i := 1; i <= 5; i++ {
+		h.Broadcast(Message{ID: fmt.Sprint(i), Room: "general"})
+	}
+
+	stats := h.Stats()
+	if stats.Dropped != 3 || stats.Evicted != 0 {
+		t.Errorf("stats = %+v, want 3 dropped and none evicted", stats)
+	}
+	got := receive(t, messages, 2)
+	if got[0].ID != "4" || got[1].ID != "5" {
+		t.Errorf("got %q and %q, want the newest messages 4 and 5", got[0].ID, got[1].ID)
+	}
+}
+
+func TestHubDisconnect(t *testing.T) {
+	h := startHub(t, 2, Disconnect)
+
+	slowID, slow := h.Subscribe("general")
+	_, fast := h.Subscribe("general")
+	for i := 1; i <= 3; i++ {
+		h.Broadcast(Message{ID: fmt.Sprint(i), Room: "general"})
+		receive(t, fast, 1)
+	}
+
+	stats := h.Stats()
+	if stats.Evicted != 1 || stats.Clients != 1 {
+		t.Errorf("stats = %+v, want 1 evicted and 1 client left", stats)
+	}
+
+	// The evicted client gets what was queued before it fell behind.
+	receive(t, slow, 2)
+	if _, ok := <-slow; ok {
+		t.Error("evicted client's channel still open")
+	}
+	h.Unsubscribe(slowID) // Unsubscribing an evicted client does nothing.
+}
+
+func TestHubSubscribeSince(t *testing.T) {
+	h := startHub(t, 0, DropOldest)
+
+	for i := 1; i <= 3; i++ {
+		h.Broadcast(Message{ID: fmt.Sprint(i), Room: "general"})
+	}
+
+	_, _, backlog, ok := h.SubscribeSince("general", "1")
+	if !ok || len(backlog) != 2 || backlog[0].ID != "2" || backlog[1].ID != "3" {
+		t.Errorf("backlog since 1 = %v, %v; want messages 2 and 3", backlog, ok)
+	}
+
+	_, _, backlog, ok = h.SubscribeSince("general", "unknown")
+	if ok || len(backlog) != 0 {
+		t.Errorf("backlog since unknown = %v, %v; want empty and not ok", backlog, ok)
+	}
+}
+
+// TestHubSubscribeSinceWhilePublishing checks that a client resuming while
+// messages are being published sees every message after its cursor exactly
+// once, split between the backlog and the channel.
+func TestHubSubscribeSinceWhilePublishing(t *testing.T) {
+	const total = 200
+	h := startHub(t, total, DropOldest)
+
+	h.Broadcast(Message{ID: "000", Room: "general"})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= total; i++ {
+			h.Broadcast(Message{ID: fmt.Sprintf("%03d", i), Room: "general"})
+		}
+	}()
+
+	_, messages, backlog, ok := h.SubscribeSince("general", "000")
+	if !ok {
+		t.Fatal("hub forgot the cursor")
+	}
+	<-done
+
+	got := append(backlog, receive(t, messages, total-len(backlog))...)
+	for i, message := range got {
+		if want := fmt.Sprintf("%03d", i+1); message.ID != want {
+			t.Fatalf("message %d is %q, want %q", i, message.ID, want)
+		}
+	}
+}
+
+// TestHubConcurrentUse hammers the hub with publishers, steady subscribers,
+// clients that keep joining and leaving, and stats readers all at once. Run
+// it with -race.
+func TestHubConcurrentUse(t *testing.T) {
+	const (
+		publishers = 8
+		perRoom    = 200
+		churners   = 8
+	)
+	rooms := []string{"general", "random"}
+	h := startHub(t, publishers*perRoom, DropOldest)
+
+	// Steady subscribers must see every message in their room, with each
+	// publisher's messages in the order they were published.
+	steady := make(map[string]<-chan Event)
+	for _, room := range rooms {
+		_, steady[room] = h.Subscribe(room)
+	}
+
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	for i := 0; i < churners; i++ {
+		background.Add(1)
+		go func(i int) {
+			defer background.Done()
+			room := rooms[i%len(rooms)]
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				clientID, messages, _, _ := h.SubscribeSince(room, "unknown")
+				select {
+				case <-messages:
+				default:
+				}
+				h.Unsubscribe(clientID)
+			}
+		}(i)
+	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				h.Stats()
+			}
+		}
+	}()
+
+	var publishing sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		publishing.Add(1)
+		go func(p int) {
+			defer publishing.Done()
+			for _, room := range rooms {
+				for i := 0; i < perRoom; i++ {
+					h.Broadcast(Message{Room: room, Username: fmt.Sprint(p), Content: fmt.Sprint(i)})
+				}
+			}
+		}(p)
+	}
+	publishing.Wait()
+	close(stop)
+	background.Wait()
+
+	for _, room := range rooms {
+		next := make(map[string]int)
+		for _, message := range receive(t, steady[room], publishers*perRoom) {
+			if message.Room != room {
+				t.Fatalf("%s subscriber got a message for %s", room, message.Room)
+			}
+			if want := fmt.Sprint(next[message.Username]); message.Content != want {
+				t.Fatalf("%s: publisher %s's message %s arrived when %s was expected",
+					room, message.Username, message.Content, want)
+			}
+			next[message.Username]++
+		}
+	}
+
+	if stats := h.Stats(); stats.Clients != len(rooms) {
+		t.Errorf("%d clients left, want %d", stats.Clients, len(rooms))
+	}
+}
@@ -0,0 +1,105 @@
+package chat
+
+import (
+	"crypto/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// crockford is the Crockford base32 alphabet used to encode IDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// IDGenerator produces ULIDs: 26-character IDs made of a 48-bit millisecond
+// timestamp followed by 80 random bits. They sort lexicographically in
+// creation order, and because the random part needs no coordination they
+// stay unique across replicas and restarts. IDs from one generator are
+// strictly increasing, even within a millisecond or if the clock steps back.
+type IDGenerator struct {
+	mutex   sync.Mutex
+	lastMS  uint64
+	entropy [10]byte
+	now     func() time.Time
+}
+
+// NewIDGenerator returns an IDGenerator that reads the system clock.
+func NewIDGenerator() *IDGenerator {
+	return &IDGenerator{now: time.Now}
+}
+
+// New returns a new ID.
+func (g *IDGenerator) New() string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	ms := uint64(g.now().UnixMilli())
+	if ms > g.lastMS {
+		g.lastMS = ms
+		if _, err := rand.Read(g.entropy[:]); err != nil {
+			panic("chat: reading random bytes: " + err.Error())
+		}
+	} else if !increment(g.entropy[:]) {
+		// The random part overflowed within one millisecond; borrow the next.
+		g.lastMS++
+	}
+
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(g.lastMS >> (40 - 8*i))
+	}
+	copy(id[6:], g.entropy[:])
+	return encodeID(id)
+}
+
+// increment adds one to b as a big-endian number, reporting false if it
+// wrapped around to zero.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeID writes the 128 bits of id as 26 base32 characters, most
+// significant first, padding the front with two zero bits.
+func encodeID(id [16]byte) string {
+	var out [26]byte
+	for i := range out {
+		// Bit offset of this character within the padded 130-bit value.
+		bit := i*5 - 2
+		var v byte
+		for j := 0; j < 5; j++ {
+			b := bit + j
+			v <<= 1
+			if b >= 0 && id[b/8]&(0x80>>(b%8)) != 0 {
+				v |= 1
+			}
+		}
+		out[i] = crockford[v]
+	}
+	return string(out[:])
+}
+
+// idTime returns the time encoded in a ULID, or false if id is not one.
+func idTime(id string) (time.Time, bool) {
+	if len(id) != 26 {
+		return time.Time{}, false
+	}
+	// The first 10 characters hold the 48-bit timestamp, after the two
+	// bits of padding.
+	var ms uint64
+	for i := 0; i < 10; i++ {
+		v := strings.IndexByte(crockford, id[i])
+		if v < 0 {
+			return time.Time{}, false
+		}
+		ms = ms<<5 | uint64(v)
+	}
+	if ms >= 1<<48 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(int64(ms)).UTC(), true
+}
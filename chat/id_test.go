@@ -0,0 +1,92 @@
+package chat
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIDGenerator(t *testing.T) {
+	clock := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	g := &IDGenerator{now: func() time.Time { return clock }}
+
+	var ids []string
+	for _, step := range []time.Duration{
+		0, 0, 0, // Within one millisecond
+		time.Millisecond,
+		-time.Second, -time.Second, // The clock steps back
+		2 * time.Second,
+		-time.Hour,
+	} {
+		clock = clock.Add(step)
+		ids = append(ids, g.New())
+	}
+	for i, id := range ids {
+		if len(id) != 26 {
+			t.Errorf("ID %q is %d characters long, want 26", id, len(id))
+		}
+		if i > 0 && id <= ids[i-1] {
+			t.Errorf("ID %d %s does not sort after %s", i, id, ids[i-1])
+		}
+	}
+	// IDs carry the clock, except while it is behind the last one used.
+	if at, ok := idTime(ids[0]); !ok || !at.Equal(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)) {
+		t.Errorf("time of the first ID = %v, %v", at, ok)
+	}
+	latest, _ := idTime(ids[3])
+	for _, id := range ids[4:6] {
+		if at, _ := idTime(id); !at.Equal(latest) {
+			t.Errorf("ID made while the clock was behind carries %v, want the latest time used, %v", at, latest)
+		}
+	}
+
+	// The random part running out moves on to the next millisecond.
+	before, _ := idTime(g.New())
+	for i := range g.entropy {
+		g.entropy[i] = 0xff
+	}
+	last := g.New()
+	if after, _ := idTime(last); after != before.Add(time.Millisecond) {
+		t.Errorf("time after the random part overflowed = %v, want %v", after, before.Add(time.Millisecond))
+	}
+	if next := g.New(); next <= last {
+		t.Errorf("ID %s after an overflow does not sort after %s", next, last)
+	}
+
+	for _, id := range []string{"", "42", "!1HV0000000000000000000000", "ZZZZZZZZZZZZZZZZZZZZZZZZZZ"} {
+		if _, ok := idTime(id); ok {
+			t.Errorf("idTime(%q) succeeded", id)
+		}
+	}
+}
+
+func TestIDGeneratorConcurrentUse(t *testing.T) {
+	g := NewIDGenerator()
+	const goroutines, each = 8, 1000
+
+	results := make([][]string, goroutines)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				results[i] = append(results[i], g.New())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, ids := range results {
+		for j, id := range ids {
+			if seen[id] {
+				t.Fatalf("ID %s generated twice", id)
+			}
+			seen[id] = true
+			if j > 0 && id <= ids[j-1] {
+				t.Fatalf("ID %s does not sort after %s from the same goroutine", id, ids[j-1])
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// IncomingWebhooksPath is the prefix under which Webhooks.Register serves
+// HandleIncoming. An incoming webhook's token follows it.
+const IncomingWebhooksPath = "/hooks/"
+
+// DefaultIncomingUsername is who messages posted through an incoming
+// webhook are from if it is not given a username.
+const DefaultIncomingUsername = "webhook"
+
+// IncomingWebhook lets scripts post messages to a room by sending them to a
+// secret URL, without signing in.
+type IncomingWebhook struct {
+	ID        string    `json:"id"`
+	Room      string    `json:"room"`
+	Username  string    `json:"username"`        // Who the messages are from
+	Token     string    `json:"token,omitempty"` // Secret part of the URL; only shown when the webhook is created
+	Path      string    `json:"path,omitempty"`  // Path messages are posted to; only shown when the webhook is created
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// incomingPayload is the body of a request to an incoming webhook: either
+// {"content": "..."} or a Slack message, of which text and attachments are
+// used.
+type incomingPayload struct {
+	Content     string `json:"content"`
+	Text        string `json:"text"`
+	Attachments []struct {
+		Fallback string `json:"fallback"`
+		Pretext  string `json:"pretext"`
+		Text     string `json:"text"`
+	} `json:"attachments"`
+}
+
+// text returns the message p posts, or "" if it has none.
+func (p incomingPayload) text() string {
+	if p.Content != "" {
+		return p.Content
+	}
+	lines := []string{fromSlack(p.Text)}
+	for _, attachment := range p.Attachments {
+		lines = append(lines, fromSlack(attachment.Pretext))
+		if attachment.Text != "" {
+			lines = append(lines, fromSlack(attachment.Text))
+		} else {
+			lines = append(lines, fromSlack(attachment.Fallback))
+		}
+	}
+
+	var nonEmpty []string
+	for _, line := range lines {
+		if line != "" {
+			nonEmpty = append(nonEmpty, line)
+		}
+	}
+	return strings.Join(nonEmpty, "\n")
+}
+
+// slackLink matches a link in Slack's markup: <url> or <url|label>.
+var slackLink = regexp.MustCompile(`<([^<>|]+)(?:\|([^<>]+))?>`)
+
+// fromSlack converts text in Slack's markup to plain text, writing links as
+// "label (url)".
+func fromSlack(text string) string {
+	text = slackLink.ReplaceAllStringFunc(text, func(link string) string {
+		match := slackLink.FindStringSubmatch(link)
+		if match[2] == "" {
+			return match[1]
+		}
+		return match[2] + " (" + match[1] + ")"
+	})
+	// Slack escapes &, < and > as entities.
+	return html.UnescapeString(strings.TrimSpace(text))
+}
+
+// HandleIncoming posts the message in the body of a POST to an incoming
+// webhook's path, IncomingWebhooksPath followed by its token, to the
+// webhook's room as its username, and answers with the message posted. The
+// body is JSON, either {"content": "..."} or a Slack message such as
+// {"text": "Deployed <https://example.com|v1.2>"}, or a form with the Slack
+// message in its payload field. The channel and username a Slack message
+// names are ignored, so that scripts cannot post anywhere else or as anyone
+// else.
+//
+// The webhook is looked up in the store on every request, so replicas
+// sharing a DynamoWebhookStore each accept posts to the webhooks added
+// through any of them, and stop as soon as one is removed.
+func (h *Webhooks) HandleIncoming(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	hook, err := h.incoming(strings.TrimPrefix(r.URL.Path, IncomingWebhooksPath))
+	if errors.Is(err, ErrNotFound) {
+		WriteError(w, http.StatusNotFound, CodeNotFound, "Webhook not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to read incoming webhooks: %v", err)
+		WriteStoreError(w, err, "Failed to read webhooks")
+		return
+	}
+
+	var payload incomingPayload
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		err = json.Unmarshal([]byte(r.PostFormValue("payload")), &payload)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&payload)
+	}
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+	content := payload.text()
+	if content == "" {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Message text is required")
+		return
+	}
+
+	msg, err := h.Server.Post(Message{Room: hook.Room, Username: hook.Username, Content: content})
+	if err != nil {
+		log.Printf("Failed to save message from incoming webhook %s: %v", hook.ID, err)
+		WriteStoreError(w, err, "Failed to save message")
+		return
+	}
+	writeJSON(w, http.StatusOK, msg)
+}
+
+// incoming returns the incoming webhook with the given token, or
+// ErrNotFound.
+func (h *Webhooks) incoming(token string) (IncomingWebhook, error) {
+	hooks, err := h.Store.IncomingWebhooks()
+	if err != nil {
+		return IncomingWebhook{}, err
+	}
+	for _, hook := range hooks {
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(hook.Token)) == 1 {
+			return hook, nil
+		}
+	}
+	return IncomingWebhook{}, ErrNotFound
+}
+
+func (h *Webhooks) listIncoming(w http.ResponseWriter) {
+	hooks, err := h.Store.IncomingWebhooks()
+	if err != nil {
+		log.Printf("Failed to read incoming webhooks: %v", err)
+		WriteStoreError(w, err, "Failed to read webhooks")
+		return
+	}
+	for i := range hooks {
+		hooks[i].Token = ""
+	}
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+func (h *Webhooks) addIncoming(w http.ResponseWriter, r *http.Request) {
+	var hook IncomingWebhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+	if !validRoom(hook.Room) {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRoom, "Invalid room")
+		return
+	}
+	if hook.Username == "" {
+		hook.Username = DefaultIncomingUsername
+	}
+
+	hook.ID = h.ids.New()
+	hook.Token = randomToken()
+	hook.Path = ""
+	hook.CreatedAt = time.Now().UTC()
+	if err := h.Store.PutIncomingWebhook(hook); err != nil {
+		log.Printf("Failed to add incoming webhook: %v", err)
+		WriteStoreError(w, err, "Failed to add webhook")
+		return
+	}
+	hook.Path = IncomingWebhooksPath + hook.Token
+	w.Header().Set("Location", WebhooksPath+"/incoming/"+hook.ID)
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+func (h *Webhooks) removeIncoming(w http.ResponseWriter, id string) {
+	if err := h.Store.RemoveIncomingWebhook(id); errors.Is(err, ErrNotFound) {
+		WriteError(w, http.StatusNotFound, CodeNotFound, "Webhook not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to remove incoming webhook %s: %v", id, err)
+		WriteStoreError(w, err, "Failed to remove webhook")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
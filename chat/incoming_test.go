@@ -0,0 +1,131 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIncomingWebhooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	store, err := NewFileWebhookStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, ts := startWebhooks(t, store)
+	_, events := s.Hub.Subscribe("deploys")
+
+	var ci, bot IncomingWebhook
+	if status := admin(t, ts, testAdminToken, http.MethodPost, WebhooksPath+"/incoming", `{"room": "deploys", "username": "ci"}`, &ci); status != http.StatusCreated || ci.Path != IncomingWebhooksPath+ci.Token {
+		t.Fatalf("adding an incoming webhook: %d %+v", status, ci)
+	}
+	admin(t, ts, testAdminToken, http.MethodPost, WebhooksPath+"/incoming", `{"room": "deploys"}`, &bot)
+	if status := admin(t, ts, testAdminToken, http.MethodPost, WebhooksPath+"/incoming", `{"room": ""}`, nil); status != http.StatusBadRequest {
+		t.Errorf("adding an incoming webhook without a room: %d, want 400", status)
+	}
+
+	post := func(path, contentType, body string) (int, Message) {
+		resp, err := http.Post(ts.URL+path, contentType, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var msg Message
+		json.NewDecoder(resp.Body).Decode(&msg)
+		return resp.StatusCode, msg
+	}
+	for _, test := range []struct {
+		hook              IncomingWebhook
+		contentType, body string
+		username, content string
+	}{
+		{ci, "application/json", `{"content": "Deployed <b>v1</b>", "username": "ann"}`, "ci", "Deployed <b>v1</b>"},
+		{ci, "application/json", `{"text": "Deployed <https://example.com/v2|v2> &amp; migrated", "channel": "#general"}`, "ci", "Deployed v2 (https://example.com/v2) & migrated"},
+		{bot, "application/x-www-form-urlencoded", "payload=" + url.QueryEscape(`{"attachments": [{"pretext": "Build failed", "fallback": "see <https://ci.example.com>"}]}`), DefaultIncomingUsername, "Build failed\nsee https://ci.example.com"},
+	} {
+		status, msg := post(test.hook.Path, test.contentType, test.body)
+		if status != http.StatusOK || msg.Room != "deploys" || msg.Username != test.username || msg.Content != test.content {
+			t.Errorf("posting %s: %d %+v, want %s saying %q", test.body, status, msg, test.username, test.content)
+		}
+		if event := <-events; event.Message == nil || event.Message.ID != msg.ID {
+			t.Errorf("event after posting %s = %+v", test.body, event)
+		}
+	}
+	if past, _ := s.Store.List(ListQuery{Room: "deploys"}); len(past) != 3 {
+		t.Errorf("stored %d messages, want 3", len(past))
+	}
+
+	for _, test := range []struct {
+		path, body string
+		want       int
+	}{
+		{ci.Path, `{"text": ""}`, http.StatusBadRequest},
+		{ci.Path, `not json`, http.StatusBadRequest},
+		{IncomingWebhooksPath + "wrong", `{"text": "hi"}`, http.StatusNotFound},
+		{IncomingWebhooksPath, `{"text": "hi"}`, http.StatusNotFound},
+	} {
+		if status, _ := post(test.path, "application/json", test.body); status != test.want {
+			t.Errorf("posting %s to %s: %d, want %d", test.body, test.path, status, test.want)
+		}
+	}
+
+	var listed []IncomingWebhook
+	admin(t, ts, testAdminToken, http.MethodGet, WebhooksPath+"/incoming", "", &listed)
+	if len(listed) != 2 || listed[0].Token != "" || listed[0].Path != "" || listed[0].Username != "ci" {
+		t.Errorf("listed incoming webhooks = %+v", listed)
+	}
+	if status := admin(t, ts, testAdminToken, http.MethodDelete, WebhooksPath+"/incoming/"+ci.ID, "", nil); status != http.StatusNoContent {
+		t.Errorf("removing an incoming webhook: %d", status)
+	}
+	if status, _ := post(ci.Path, "application/json", `{"text": "too late"}`); status != http.StatusNotFound {
+		t.Errorf("posting to a removed webhook: %d, want 404", status)
+	}
+
+	reopened, err := NewFileWebhookStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hooks, _ := reopened.IncomingWebhooks(); len(hooks) != 1 || hooks[0].Token != bot.Token {
+		t.Errorf("incoming webhooks after reload = %+v", hooks)
+	}
+}
+
+func TestIncomingWebhooksAcrossReplicas(t *testing.T) {
+	store := NewDynamoWebhookStore(newFakeDynamoDB("Kind", "ID"), DefaultWebhookTable)
+	_, b, tsA, tsB := startWebhookReplicas(t, store)
+
+	var ci IncomingWebhook
+	if status := admin(t, tsA, testAdminToken, http.MethodPost, WebhooksPath+"/incoming", `{"room": "deploys", "username": "ci"}`, &ci); status != http.StatusCreated {
+		t.Fatalf("adding an incoming webhook: %d", status)
+	}
+	post := func(ts *httptest.Server) int {
+		resp, err := http.Post(ts.URL+ci.Path, "application/json", strings.NewReader(`{"text": "Deployed v3"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// Whichever replica the post reaches accepts it.
+	for _, ts := range []*httptest.Server{tsA, tsB} {
+		if status := post(ts); status != http.StatusOK {
+			t.Errorf("posting to a replica: %d, want 200", status)
+		}
+	}
+	if past, _ := b.Store.List(ListQuery{Room: "deploys"}); len(past) != 1 || past[0].Username != "ci" {
+		t.Errorf("messages posted on b = %+v", past)
+	}
+
+	if status := admin(t, tsB, testAdminToken, http.MethodDelete, WebhooksPath+"/incoming/"+ci.ID, "", nil); status != http.StatusNoContent {
+		t.Fatalf("removing an incoming webhook: %d", status)
+	}
+	for _, ts := range []*httptest.Server{tsA, tsB} {
+		if status := post(ts); status != http.StatusNotFound {
+			t.Errorf("posting to a replica after removal: %d, want 404", status)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Package chat contains the pieces shared by every version of the chat
+// server: the message model, the hub that fans messages out to connected
+// clients, the storage interface and the HTTP handlers.
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// DefaultRoom is the room used when a client does not name one.
+const DefaultRoom = "general"
+
+// maxRoomLength is the longest room name accepted from clients.
+const maxRoomLength = 64
+
+// Message represents a chat message. The ID and Room attributes are the
+// DynamoDB table's key and keep their capitalized names there.
+type Message struct {
+	ID        string     `json:"id" dynamodbav:"ID"`
+	Room      string     `json:"room" dynamodbav:"Room"`
+	Username  string     `json:"username"`
+	Content   string     `json:"content"`
+	CreatedAt time.Time  `json:"created_at"`                                 // When the message was posted
+	EditedAt  *time.Time `json:"edited_at,omitempty"`                        // When the content was last edited, if ever
+	Deleted   bool       `json:"deleted,omitempty"`                          // Removed; the content is gone
+	ReplyTo   string     `json:"reply_to,omitempty"`                         // ID of the message starting the thread this one replies in
+	Reactions Reactions  `json:"reactions,omitempty" dynamodbav:"reactions"` // Who reacted with which emoji
+	To        []string   `json:"to,omitempty"`                               // Participants of the direct conversation the message is in, in name order
+}
+
+// Direct reports whether msg is a direct message rather than one posted to
+// a room.
+func (m Message) Direct() bool {
+	return len(m.To) > 0
+}
+
+// Reactions maps each emoji a message was reacted to with to the users who
+// reacted with it, in name order.
+type Reactions map[string][]string
+
+// add records username's reaction with emoji.
+func (r Reactions) add(emoji, username string) {
+	users := r[emoji]
+	i := sort.SearchStrings(users, username)
+	if i < len(users) && users[i] == username {
+		return
+	}
+	users = append(users, "")
+	copy(users[i+1:], users[i:])
+	users[i] = username
+	r[emoji] = users
+}
+
+// remove forgets username's reaction with emoji, if any.
+func (r Reactions) remove(emoji, username string) {
+	users := r[emoji]
+	i := sort.SearchStrings(users, username)
+	if i == len(users) || users[i] != username {
+		return
+	}
+	if len(users) == 1 {
+		delete(r, emoji)
+		return
+	}
+	r[emoji] = append(users[:i:i], users[i+1:]...)
+}
+
+// clone returns a copy of r that shares no slices with it.
+func (r Reactions) clone() Reactions {
+	if r == nil {
+		return nil
+	}
+	c := make(Reactions, len(r))
+	for emoji, users := range r {
+		c[emoji] = append([]string(nil), users...)
+	}
+	return c
+}
+
+// UnmarshalJSON decodes a message, also accepting the integer IDs written
+// by earlier versions so existing chat_messages.json files still load.
+// Messages written before CreatedAt existed get the time encoded in their
+// ID, if it has one.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type message Message
+	aux := struct {
+		*message
+		ID json.RawMessage `json:"id"`
+	}{message: (*message)(m)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	switch {
+	case len(aux.ID) == 0 || bytes.Equal(aux.ID, []byte("null")):
+		m.ID = ""
+	case aux.ID[0] == '"':
+		if err := json.Unmarshal(aux.ID, &m.ID); err != nil {
+			return err
+		}
+	default:
+		var id json.Number
+		if err := json.Unmarshal(aux.ID, &id); err != nil {
+			return err
+		}
+		m.ID = id.String()
+	}
+
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt, _ = idTime(m.ID)
+	}
+	return nil
+}
+
+// validRoom reports whether name is usable as a room name: 1 to 64 letters,
+// digits, '-', '_' or '.'.
+func validRoom(name string) bool {
+	if name == "" || len(name) > maxRoomLength {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
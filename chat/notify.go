@@ -0,0 +1,559 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channels OpenDispatcher registers notifiers for.
+const (
+	ChannelSMS     = "sms"
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+)
+
+// Defaults for the Dispatcher's retry policy.
+const (
+	DefaultNotifyAttempts     = 8
+	DefaultNotifyBackoff      = time.Second
+	DefaultNotifyMaxBackoff   = 10 * time.Minute
+	DefaultNotifyPollInterval = time.Second
+)
+
+// maxInflight is how many notifications a Dispatcher sends at once over
+// each channel.
+const maxInflight = 10
+
+// ErrUndeliverable is returned, wrapped around the reason, by a Notifier
+// whose notification cannot be delivered however often it is retried, such
+// as one to an unknown address. The Dispatcher gives up on it at once.
+var ErrUndeliverable = errors.New("undeliverable")
+
+// undeliverable wraps err in ErrUndeliverable.
+func undeliverable(err error) error {
+	return fmt.Errorf("%w: %v", ErrUndeliverable, err)
+}
+
+// Notification is something to tell someone over a channel, such as a text
+// message to a phone number.
+type Notification struct {
+	ID      string `json:"id"`
+	Channel string `json:"channel"`           // One of the Channel constants, or any registered channel
+	To      string `json:"to"`                // Phone number, email address or URL, as the channel expects
+	Subject string `json:"subject,omitempty"` // Email subject; ignored by SMS
+	Body    string `json:"body"`
+
+	Attempts    int       `json:"attempts"`             // Failed attempts so far
+	NextAttempt time.Time `json:"next_attempt"`         // When to try sending next
+	LastError   string    `json:"last_error,omitempty"` // Why the last attempt failed
+}
+
+// Notifier sends notifications over one channel.
+type Notifier interface {
+	// Notify sends n. It returns an error wrapping ErrUndeliverable if
+	// retrying cannot help.
+	Notify(n Notification) error
+}
+
+// NotificationQueue persists the notifications a Dispatcher has yet to
+// send, so that they survive a restart.
+type NotificationQueue interface {
+	// Put adds n, replacing any notification with the same ID.
+	Put(n Notification) error
+	// Due returns up to limit notifications for channel, or for any
+	// channel if it is empty, whose NextAttempt is not after now, earliest
+	// first.
+	Due(channel string, now time.Time, limit int) ([]Notification, error)
+	// Remove removes the notification with ID id, if any.
+	Remove(id string) error
+}
+
+// MemoryNotificationQueue keeps notifications in process memory. They are
+// lost on restart.
+type MemoryNotificationQueue struct {
+	mutex         sync.Mutex
+	notifications notifications
+}
+
+// NewMemoryNotificationQueue returns an empty MemoryNotificationQueue.
+func NewMemoryNotificationQueue() *MemoryNotificationQueue {
+	return &MemoryNotificationQueue{notifications: make(notifications)}
+}
+
+func (q *MemoryNotificationQueue) Put(n Notification) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.notifications[n.ID] = n
+	return nil
+}
+
+func (q *MemoryNotificationQueue) Due(channel string, now time.Time, limit int) ([]Notification, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.notifications.due(channel, now, limit), nil
+}
+
+func (q *MemoryNotificationQueue) Remove(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	delete(q.notifications, id)
+	return nil
+}
+
+// FileNotificationQueue keeps notifications in memory and mirrors them to a
+// JSON file, which is rewritten after every change. The file holds an
+// object mapping each notification's ID to the notification.
+type FileNotificationQueue struct {
+	mutex         sync.Mutex
+	path          string
+	notifications notifications
+}
+
+// NewFileNotificationQueue returns a FileNotificationQueue backed by the
+// file at path, loading any notifications it already contains. A missing
+// or empty file holds none.
+func NewFileNotificationQueue(path string) (*FileNotificationQueue, error) {
+	q := &FileNotificationQueue{path: path, notifications: make(notifications)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) || err == nil && len(data) == 0 {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &q.notifications); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *FileNotificationQueue) Put(n Notification) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	previous, existed := q.notifications[n.ID]
+	q.notifications[n.ID] = n
+	if err := q.save(); err != nil {
+		// Keep memory and the file in step.
+		if existed {
+			q.notifications[n.ID] = previous
+		} else {
+			delete(q.notifications, n.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (q *FileNotificationQueue) Due(channel string, now time.Time, limit int) ([]Notification, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.notifications.due(channel, now, limit), nil
+}
+
+func (q *FileNotificationQueue) Remove(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	previous, existed := q.notifications[id]
+	if !existed {
+		return nil
+	}
+	delete(q.notifications, id)
+	if err := q.save(); err != nil {
+		q.notifications[id] = previous
+		return err
+	}
+	return nil
+}
+
+// save writes the notifications to the file. The caller must hold the
+// mutex.
+func (q *FileNotificationQueue) save() error {
+	data, err := json.Marshal(q.notifications)
+	if err != nil {
+		return err
+	}
+	return writeFile(q.path, data)
+}
+
+// notifications maps IDs to notifications. It is shared by
+// MemoryNotificationQueue and FileNotificationQueue, which guard it with
+// their own mutex.
+type notifications map[string]Notification
+
+func (q notifications) due(channel string, now time.Time, limit int) []Notification {
+	var due []Notification
+	for _, n := range q {
+		if (channel == "" || n.Channel == channel) && !n.NextAttempt.After(now) {
+			due = append(due, n)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttempt.Equal(due[j].NextAttempt) {
+			return due[i].NextAttempt.Before(due[j].NextAttempt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due
+}
+
+// RateLimit caps how many notifications a Dispatcher sends over a channel:
+// at most Count in any period of length Per. The zero RateLimit is no limit.
+type RateLimit struct {
+	Count int
+	Per   time.Duration
+}
+
+// rateLimiter is a token bucket holding up to limit.Count tokens, refilled
+// at limit.Count per limit.Per.
+type rateLimiter struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{limit: limit, tokens: float64(limit.Count)}
+}
+
+// allow takes a token at now, reporting false if there is none.
+func (l *rateLimiter) allow(now time.Time) bool {
+	if l.limit.Count <= 0 || l.limit.Per <= 0 {
+		return true
+	}
+	if !l.last.IsZero() {
+		l.tokens += float64(l.limit.Count) * float64(now.Sub(l.last)) / float64(l.limit.Per)
+		if l.tokens > float64(l.limit.Count) {
+			l.tokens = float64(l.limit.Count)
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// channel is a Notifier registered with a Dispatcher, with its rate limit
+// and the notifications being sent over it.
+type channel struct {
+	notifier Notifier
+	limiter  *rateLimiter
+	inflight int
+}
+
+// delivery is the outcome of an attempt to send a notification.
+type delivery struct {
+	notification Notification
+	err          error
+}
+
+// Dispatcher sends notifications in the background, so that whoever sends
+// one does not wait on the channel. Notifications are kept in a
+// NotificationQueue until they are sent; failed attempts are retried with
+// exponential backoff, up to MaxAttempts, and each channel is held to its
+// RateLimit.
+//
+// Each channel's notifications are taken from the queue separately, so
+// that one held back by its rate limit or a slow notifier does not delay
+// the others. Notifications for a channel that is not registered stay in
+// the queue.
+//
+// Like the Hub, the dispatcher's state is owned by the goroutine running
+// Run. Channels must be registered and the fields set before Run starts.
+type Dispatcher struct {
+	Queue NotificationQueue
+
+	MaxAttempts  int           // Attempts before giving up
+	Backoff      time.Duration // Wait after the first failed attempt, doubled after each further one
+	MaxBackoff   time.Duration // Longest wait between attempts
+	PollInterval time.Duration // How often the queue is checked for notifications due again
+
+	ids        *IDGenerator
+	channels   map[string]*channel
+	inflight   map[string]bool // IDs being sent
+	wake       chan struct{}
+	deliveries chan delivery
+}
+
+// NewDispatcher returns a Dispatcher that keeps notifications in queue,
+// with the default retry policy and no channels.
+func NewDispatcher(queue NotificationQueue) *Dispatcher {
+	return &Dispatcher{
+		Queue:        queue,
+		MaxAttempts:  DefaultNotifyAttempts,
+		Backoff:      DefaultNotifyBackoff,
+		MaxBackoff:   DefaultNotifyMaxBackoff,
+		PollInterval: DefaultNotifyPollInterval,
+		ids:          NewIDGenerator(),
+		channels:     make(map[string]*channel),
+		inflight:     make(map[string]bool),
+		wake:         make(chan struct{}, 1),
+		deliveries:   make(chan delivery),
+	}
+}
+
+// Register makes notifier send the notifications for name, at most as
+// often as limit allows.
+func (d *Dispatcher) Register(name string, notifier Notifier, limit RateLimit) {
+	d.channels[name] = &channel{notifier: notifier, limiter: newRateLimiter(limit)}
+}
+
+// Send queues n to be sent over its channel as soon as the channel's rate
+// limit allows, assigning it an ID. It returns once n is in the queue.
+func (d *Dispatcher) Send(n Notification) error {
+	if _, ok := d.channels[n.Channel]; !ok {
+		return fmt.Errorf("chat: no notifier for channel %q", n.Channel)
+	}
+	n.ID = d.ids.New()
+	n.Attempts, n.NextAttempt, n.LastError = 0, time.Now(), ""
+	if err := d.Queue.Put(n); err != nil {
+		return err
+	}
+	d.poke()
+	return nil
+}
+
+// poke makes Run check the queue now rather than at its next poll, for a
+// notification just added to it.
+func (d *Dispatcher) poke() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SMS returns an SMSSender that queues each text as a notification on
+// ChannelSMS, for an SMSBridge that should not wait on the carrier.
+func (d *Dispatcher) SMS() SMSSender {
+	return queuedSMS{d}
+}
+
+type queuedSMS struct{ dispatcher *Dispatcher }
+
+func (q queuedSMS) SendSMS(to, body string) error {
+	return q.dispatcher.Send(Notification{Channel: ChannelSMS, To: to, Body: body})
+}
+
+// Run sends queued notifications as they fall due, including those left in
+// the queue by an earlier process. It never returns.
+func (d *Dispatcher) Run() {
+	interval := d.PollInterval
+	if interval <= 0 {
+		interval = DefaultNotifyPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		d.dispatch()
+		select {
+		case <-d.wake:
+		case <-ticker.C:
+		case result := <-d.deliveries:
+			d.finish(result)
+		}
+	}
+}
+
+// dispatch starts sending the notifications that are due, as far as each
+// channel's rate limit and maxInflight allow.
+func (d *Dispatcher) dispatch() {
+	now := time.Now()
+	for name, ch := range d.channels {
+		if ch.inflight >= maxInflight {
+			continue
+		}
+		// The notifications being sent are still in the queue, so at most
+		// maxInflight due ones include all that can be started.
+		due, err := d.Queue.Due(name, now, maxInflight)
+		if err != nil {
+			log.Printf("Failed to read the %s notification queue: %v", name, err)
+			continue
+		}
+
+		for _, n := range due {
+			if d.inflight[n.ID] {
+				continue
+			}
+			if ch.inflight >= maxInflight || !ch.limiter.allow(now) {
+				break
+			}
+
+			ch.inflight++
+			d.inflight[n.ID] = true
+			go func(n Notification, notifier Notifier) {
+				d.deliveries <- delivery{n, notifier.Notify(n)}
+			}(n, ch.notifier)
+		}
+	}
+}
+
+// finish records the outcome of an attempt: the notification leaves the
+// queue if it was sent or cannot be, and is scheduled again otherwise.
+func (d *Dispatcher) finish(result delivery) {
+	n := result.notification
+	delete(d.inflight, n.ID)
+	if ch, ok := d.channels[n.Channel]; ok {
+		ch.inflight--
+	}
+
+	if result.err == nil {
+		if err := d.Queue.Remove(n.ID); err != nil {
+			log.Printf("Failed to remove sent notification %s: %v", n.ID, err)
+		}
+		return
+	}
+
+	n.Attempts++
+	n.LastError = result.err.Error()
+	if errors.Is(result.err, ErrUndeliverable) || n.Attempts >= d.MaxAttempts {
+		d.giveUp(n, result.err)
+		return
+	}
+	n.NextAttempt = time.Now().Add(backoff(d.Backoff, d.MaxBackoff, n.Attempts))
+	if err := d.Queue.Put(n); err != nil {
+		log.Printf("Failed to reschedule notification %s: %v", n.ID, err)
+	}
+}
+
+// backoff returns how long to wait after the given number of failed
+// attempts: base after the first, doubling after each further one, up to
+// max.
+func backoff(base, max time.Duration, attempts int) time.Duration {
+	wait := base
+	for i := 1; i < attempts && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+func (d *Dispatcher) giveUp(n Notification, err error) {
+	log.Printf("Giving up on %s notification %s to %s after %d attempts: %v", n.Channel, n.ID, n.To, n.Attempts, err)
+	if err := d.Queue.Remove(n.ID); err != nil {
+		log.Printf("Failed to remove notification %s: %v", n.ID, err)
+	}
+}
+
+// SMSNotifier sends notifications as text messages through an SMSSender.
+type SMSNotifier struct {
+	Sender SMSSender
+}
+
+func (s SMSNotifier) Notify(n Notification) error {
+	err := s.Sender.SendSMS(n.To, n.Body)
+	var twilioErr *TwilioError
+	if errors.Is(err, ErrSMSOptedOut) || errors.As(err, &twilioErr) && twilioErr.Status >= 400 && twilioErr.Status < 500 && twilioErr.Status != http.StatusTooManyRequests {
+		return undeliverable(err)
+	}
+	return err
+}
+
+// SMTPNotifier sends notifications as plain text email.
+type SMTPNotifier struct {
+	Addr string    // Server address, host:port
+	From string    // Sender address
+	Auth smtp.Auth // Optional; net/smtp only sends it over TLS or to localhost
+}
+
+func (s SMTPNotifier) Notify(n Notification) error {
+	// A line break would let the value end its header and add others.
+	for _, value := range []string{s.From, n.To, n.Subject} {
+		if strings.ContainsAny(value, "\r\n") {
+			return undeliverable(fmt.Errorf("line break in email header value %q", value))
+		}
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", s.From)
+	fmt.Fprintf(&message, "To: %s\r\n", n.To)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", n.Subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Message-ID: <%s@chat>\r\n", n.ID)
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(strings.ReplaceAll(n.Body, "\r\n", "\n"), "\n", "\r\n"))
+	message.WriteString("\r\n")
+
+	err := smtp.SendMail(s.Addr, s.Auth, s.From, []string{n.To}, message.Bytes())
+	// 5xx replies, such as an unknown mailbox, are permanent failures.
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return undeliverable(err)
+	}
+	return err
+}
+
+// WebhookNotifier sends notifications as JSON posts to the URL in their To
+// field:
+//
+//	{"id": "01H...", "subject": "...", "body": "..."}
+type WebhookNotifier struct {
+	Client *http.Client // Sends the requests; one with a 10 second timeout if nil
+}
+
+func (s WebhookNotifier) Notify(n Notification) error {
+	payload, err := json.Marshal(struct {
+		ID      string `json:"id"`
+		Subject string `json:"subject,omitempty"`
+		Body    string `json:"body"`
+	}{n.ID, n.Subject, n.Body})
+	if err != nil {
+		return undeliverable(err)
+	}
+	resp, err := webhookClient(s.Client).Post(n.To, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return webhookStatusError(resp)
+}
+
+// webhookClient returns client, or one with a 10 second timeout if it is
+// nil.
+func webhookClient(client *http.Client) *http.Client {
+	if client == nil {
+		return &http.Client{Timeout: 10 * time.Second}
+	}
+	return client
+}
+
+// webhookStatusError returns the error a webhook's answer resp means: nil
+// for a 2xx status, and one wrapping ErrUndeliverable for a 4xx status
+// other than 408 and 429, which retrying will not change.
+func webhookStatusError(resp *http.Response) error {
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return undeliverable(fmt.Errorf("webhook answered %s", resp.Status))
+	default:
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+}
@@ -0,0 +1,272 @@
+package chat
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startFakeSMTP runs a mail server that accepts mail for anyone but nobody@
+// addresses and sends each message it receives on the returned channel.
+func startFakeSMTP(t *testing.T) (addr string, mail <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan string, 10)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				tp := textproto.NewConn(conn)
+				defer tp.Close()
+				tp.PrintfLine("220 fake ESMTP")
+				for {
+					line, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					switch verb, _, _ := strings.Cut(strings.ToUpper(line), " "); verb {
+					case "RCPT":
+						if strings.Contains(line, "nobody@") {
+							tp.PrintfLine("550 No such user")
+						} else {
+							tp.PrintfLine("250 OK")
+						}
+					case "DATA":
+						tp.PrintfLine("354 Go ahead")
+						data, _ := tp.ReadDotBytes()
+						received <- string(data)
+						tp.PrintfLine("250 OK")
+					case "QUIT":
+						tp.PrintfLine("221 Bye")
+						return
+					default:
+						tp.PrintfLine("250 fake")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+// notifierFunc adapts a function to the Notifier interface.
+type notifierFunc func(Notification) error
+
+func (f notifierFunc) Notify(n Notification) error { return f(n) }
+
+// startDispatcher returns a running Dispatcher on queue that retries quickly.
+func startDispatcher(queue NotificationQueue, register func(*Dispatcher)) *Dispatcher {
+	d := NewDispatcher(queue)
+	d.Backoff = 20 * time.Millisecond
+	d.PollInterval = 5 * time.Millisecond
+	register(d)
+	go d.Run()
+	return d
+}
+
+// waitEmpty waits for queue to have nothing left to send.
+func waitEmpty(t *testing.T, queue NotificationQueue) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if due, _ := queue.Due("", time.Now().Add(time.Hour), 1); len(due) == 0 {
+			return
+		}
+	}
+	t.Fatal("timed out waiting for the queue to empty")
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	var mutex sync.Mutex
+	var attempts []time.Time
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts = append(attempts, time.Now())
+		if len(attempts) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(webhook.Close)
+
+	queue := NewMemoryNotificationQueue()
+	d := startDispatcher(queue, func(d *Dispatcher) {
+		d.Register(ChannelWebhook, WebhookNotifier{}, RateLimit{})
+	})
+	d.Send(Notification{Channel: ChannelWebhook, To: webhook.URL + "/gone", Body: "lost"})
+	d.Send(Notification{Channel: ChannelWebhook, To: webhook.URL + "/hook", Body: "hello"})
+	waitEmpty(t, queue)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(attempts) != 3 {
+		t.Fatalf("webhook called %d times, want 3", len(attempts))
+	}
+	// The wait doubles after each failure.
+	for i, want := range []time.Duration{d.Backoff, 2 * d.Backoff} {
+		if gap := attempts[i+1].Sub(attempts[i]); gap < want {
+			t.Errorf("attempt %d came %v after the previous one, want at least %v", i+2, gap, want)
+		}
+	}
+
+	if err := d.Send(Notification{Channel: "pigeon", To: "roof"}); err == nil {
+		t.Error("sending over an unregistered channel succeeded")
+	}
+}
+
+func TestDispatcherRateLimit(t *testing.T) {
+	sent := make(chan time.Time, 10)
+	d := startDispatcher(NewMemoryNotificationQueue(), func(d *Dispatcher) {
+		d.Register("test", notifierFunc(func(Notification) error {
+			sent <- time.Now()
+			return nil
+		}), RateLimit{Count: 2, Per: 100 * time.Millisecond})
+	})
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		d.Send(Notification{Channel: "test", To: "anyone"})
+	}
+	var times []time.Time
+	for i := 0; i < 4; i++ {
+		times = append(times, <-sent)
+	}
+	// Two go out at once, then one every 50ms.
+	if elapsed := times[3].Sub(start); elapsed < 90*time.Millisecond {
+		t.Errorf("four notifications took %v at two per 100ms", elapsed)
+	}
+	if gap := times[3].Sub(times[2]); gap < 40*time.Millisecond {
+		t.Errorf("rate-limited notifications %v apart, want about 50ms", gap)
+	}
+}
+
+func TestDispatcherChannelsIndependent(t *testing.T) {
+	texted, mailed := make(chan Notification, 100), make(chan Notification, 1)
+	queue := NewMemoryNotificationQueue()
+	d := NewDispatcher(queue)
+	d.Register(ChannelSMS, notifierFunc(func(n Notification) error {
+		texted <- n
+		return nil
+	}), RateLimit{Count: 1, Per: time.Hour})
+	d.Register(ChannelEmail, notifierFunc(func(n Notification) error {
+		mailed <- n
+		return nil
+	}), RateLimit{})
+
+	// A backlog of texts is queued before the email, so that it is due
+	// earlier than the email but can only be sent one an hour.
+	for i := 0; i < 3*maxInflight; i++ {
+		d.Send(Notification{Channel: ChannelSMS, To: "+14155550100", Body: "hi"})
+	}
+	d.Send(Notification{Channel: ChannelEmail, To: "ann@example.com", Body: "hello"})
+	go d.Run()
+
+	select {
+	case n := <-mailed:
+		if n.To != "ann@example.com" {
+			t.Errorf("mailed %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("email held up behind rate-limited texts")
+	}
+	if len(texted) != 1 {
+		t.Errorf("%d texts sent, want 1 in the first hour", len(texted))
+	}
+}
+
+func TestDispatcherQueueSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	queue, err := NewFileNotificationQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first process queues a notification and dies before sending it.
+	failing := NewDispatcher(queue)
+	failing.Register("test", notifierFunc(func(Notification) error { return errors.New("down") }), RateLimit{})
+	if err := failing.Send(Notification{Channel: "test", To: "ann", Body: "still there?"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileNotificationQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan Notification, 1)
+	startDispatcher(reopened, func(d *Dispatcher) {
+		d.Register("test", notifierFunc(func(n Notification) error {
+			sent <- n
+			return nil
+		}), RateLimit{})
+	})
+	select {
+	case n := <-sent:
+		if n.To != "ann" || n.Body != "still there?" {
+			t.Errorf("sent %+v after restart", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued notification not sent after restart")
+	}
+	waitEmpty(t, reopened)
+}
+
+func TestNotifiers(t *testing.T) {
+	smtpAddr, mail := startFakeSMTP(t)
+	twilio := startFakeTwilio(t)
+	d, err := OpenDispatcher(NotifyConfig{SMTPAddr: smtpAddr, SMTPFrom: "chat@example.com"}, SMSConfig{From: testSMSNumber, AccountSID: testAccountSID, AuthToken: testAuthToken, APIURL: twilio.URL}.TwilioSMS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Backoff, d.PollInterval = 20*time.Millisecond, 5*time.Millisecond
+	go d.Run()
+
+	d.Send(Notification{Channel: ChannelEmail, To: "nobody@example.com", Subject: "Lost", Body: "nobody reads this"})
+	d.Send(Notification{Channel: ChannelEmail, To: "ann@example.com", Subject: "Unread messages ✉", Body: "bob: hi\nbob: there"})
+	d.SMS().SendSMS("+14155550100", "bob: hi")
+
+	message := <-mail
+	for _, want := range []string{"From: chat@example.com\n", "To: ann@example.com\n", "Subject: =?utf-8?q?Unread_messages_=E2=9C=89?=\n", "\n\nbob: hi\nbob: there\n"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("email lacks %q:\n%s", want, message)
+		}
+	}
+	if to, body := twilio.next(t); to != "+14155550100" || body != "bob: hi" {
+		t.Errorf("texted %q to %s", body, to)
+	}
+	waitEmpty(t, d.Queue)
+
+	// Header values cannot smuggle in other headers.
+	for _, test := range []struct {
+		notifier SMTPNotifier
+		n        Notification
+	}{
+		{SMTPNotifier{Addr: smtpAddr, From: "chat@example.com"}, Notification{To: "ann@example.com\r\nBcc: eve@example.com", Subject: "Hi"}},
+		{SMTPNotifier{Addr: smtpAddr, From: "chat@example.com"}, Notification{To: "ann@example.com", Subject: "Hi\nBcc: eve@example.com"}},
+		{SMTPNotifier{Addr: smtpAddr, From: "chat@example.com\rBcc: eve@example.com"}, Notification{To: "ann@example.com", Subject: "Hi"}},
+	} {
+		if err := test.notifier.Notify(test.n); !errors.Is(err, ErrUndeliverable) {
+			t.Errorf("email from %q to %q about %q: %v, want ErrUndeliverable", test.notifier.From, test.n.To, test.n.Subject, err)
+		}
+	}
+	select {
+	case message := <-mail:
+		t.Errorf("email with a line break in a header was sent:\n%s", message)
+	default:
+	}
+}
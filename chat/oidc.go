@@ -0,0 +1,433 @@
+package chat
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths of the OpenID Connect login under Register.
+const (
+	OIDCLoginPath    = "/login/oidc"
+	OIDCCallbackPath = "/login/oidc/callback"
+)
+
+// DefaultUsernameClaim is the ID token claim used as the username when
+// OIDCClient.UsernameClaim is not set. It matches the user NgrokIdentityHeader
+// names, so a user keeps their name whichever way they sign in.
+const DefaultUsernameClaim = "email"
+
+// oidcStateCookie holds the state, nonce and PKCE verifier of a login in
+// progress, signed so that the browser cannot change them.
+const (
+	oidcStateCookie = "chat_oidc"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+// OIDCClient signs users in with an OpenID Connect identity provider, using
+// the authorization code flow with PKCE, for servers that are not behind an
+// authenticating proxy such as an ngrok edge.
+type OIDCClient struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the absolute URL of OIDCCallbackPath registered with
+	// the provider. If empty it is derived from each login request.
+	RedirectURL string
+	// Scopes requested besides openid; email and profile if nil.
+	Scopes []string
+	// UsernameClaim is the ID token claim used as the username, or
+	// DefaultUsernameClaim if empty.
+	UsernameClaim string
+	HTTPClient    *http.Client
+
+	authorizationEndpoint string
+	tokenEndpoint         string
+	jwksURI               string
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey // Provider signing keys by key ID
+}
+
+// NewOIDCClient returns a client for the provider at issuer, whose endpoints
+// it discovers from the provider's /.well-known/openid-configuration.
+func NewOIDCClient(ctx context.Context, issuer, clientID, clientSecret string) (*OIDCClient, error) {
+	c := &OIDCClient{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+	}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := c.getJSON(ctx, c.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("chat: OIDC discovery: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != c.Issuer {
+		return nil, fmt.Errorf("chat: OIDC discovery: issuer %q does not match %q", discovery.Issuer, c.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("chat: OIDC discovery: endpoints missing")
+	}
+	c.authorizationEndpoint = discovery.AuthorizationEndpoint
+	c.tokenEndpoint = discovery.TokenEndpoint
+	c.jwksURI = discovery.JWKSURI
+	return c, nil
+}
+
+// AuthCodeURL returns the provider URL to send the user to.
+func (c *OIDCClient) AuthCodeURL(redirectURL, state, nonce, verifier string) string {
+	scopes := c.Scopes
+	if scopes == nil {
+		scopes = []string{"email", "profile"}
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.ClientID},
+		"redirect_uri":          {redirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(c.authorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return c.authorizationEndpoint + separator + query.Encode()
+}
+
+// Exchange redeems an authorization code and returns the username from the
+// ID token, after checking the token's signature, issuer, audience, expiry
+// and nonce.
+func (c *OIDCClient) Exchange(ctx context.Context, code, redirectURL, verifier, nonce string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := c.doJSON(req, &tokens); err != nil {
+		return "", fmt.Errorf("token exchange: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token exchange: no ID token")
+	}
+
+	claims, err := c.verify(ctx, tokens.IDToken)
+	if err != nil {
+		return "", err
+	}
+	return c.username(claims, nonce)
+}
+
+// verify checks an ID token's RS256 signature and returns its claims.
+func (c *OIDCClient) verify(ctx context.Context, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	key, err := c.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid ID token signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed ID token claims")
+	}
+	return claims, nil
+}
+
+// username checks the claims of a verified ID token and returns the user's
+// name.
+func (c *OIDCClient) username(claims map[string]any, nonce string) (string, error) {
+	if issuer, _ := claims["iss"].(string); strings.TrimSuffix(issuer, "/") != c.Issuer {
+		return "", fmt.Errorf("ID token issued by %q", issuer)
+	}
+	if !audienceContains(claims["aud"], c.ClientID) {
+		return "", errors.New("ID token not issued for this client")
+	}
+	if exp, _ := claims["exp"].(float64); time.Now().Unix() >= int64(exp) {
+		return "", errors.New("ID token expired")
+	}
+	if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return "", errors.New("ID token nonce mismatch")
+	}
+
+	claim := c.UsernameClaim
+	if claim == "" {
+		claim = DefaultUsernameClaim
+	}
+	if claim == "email" && claims["email_verified"] == false {
+		return "", errors.New("email not verified")
+	}
+	username, _ := claims[claim].(string)
+	if username == "" {
+		return "", fmt.Errorf("ID token has no %q claim", claim)
+	}
+	return username, nil
+}
+
+func audienceContains(aud any, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []any:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the provider's signing key with the given ID, fetching the
+// key set again if it is not known, as happens after the provider rotates
+// its keys.
+func (c *OIDCClient) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := c.getJSON(ctx, c.jwksURI, &set); err != nil {
+		return nil, fmt.Errorf("fetching provider keys: %w", err)
+	}
+	c.keys = make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		c.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown ID token key %q", kid)
+}
+
+func (c *OIDCClient) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	return c.doJSON(req, v)
+}
+
+func (c *OIDCClient) doJSON(req *http.Request, v any) error {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// oidcState is what the state cookie remembers between HandleOIDCLogin and
+// HandleOIDCCallback.
+type oidcState struct {
+	State     string `json:"state"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// HandleOIDCLogin sends the browser to the identity provider to sign in.
+func (s *Server) HandleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if s.Auth == nil || s.Auth.OIDC == nil {
+		WriteError(w, http.StatusNotFound, CodeNotFound, "OpenID Connect login is not enabled")
+		return
+	}
+
+	state := oidcState{
+		State:     randomToken(),
+		Nonce:     randomToken(),
+		Verifier:  randomToken(),
+		ExpiresAt: time.Now().Add(oidcStateTTL).Unix(),
+	}
+	payload, _ := json.Marshal(state)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    encoded + "." + s.Auth.sign(encoded),
+		Path:     OIDCCallbackPath,
+		MaxAge:   int(oidcStateTTL / time.Second),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		// Lax, not Strict, so that the cookie comes back with the
+		// provider's top-level redirect to the callback.
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	oidc := s.Auth.OIDC
+	http.Redirect(w, r, oidc.AuthCodeURL(oidc.redirectURL(r), state.State, state.Nonce, state.Verifier), http.StatusFound)
+}
+
+// HandleOIDCCallback completes a login started by HandleOIDCLogin: it
+// redeems the provider's authorization code, starts a session for the user
+// in the ID token and sends the browser back to the site.
+func (s *Server) HandleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if s.Auth == nil || s.Auth.OIDC == nil {
+		WriteError(w, http.StatusNotFound, CodeNotFound, "OpenID Connect login is not enabled")
+		return
+	}
+
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		WriteError(w, http.StatusUnauthorized, CodeInvalidCredentials, "Login refused by the identity provider: "+reason)
+		return
+	}
+
+	state, ok := s.oidcState(r)
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: OIDCCallbackPath, MaxAge: -1})
+	if !ok || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state.State)) != 1 {
+		WriteError(w, http.StatusUnauthorized, CodeUnauthorized, "Login expired or invalid, try again")
+		return
+	}
+
+	oidc := s.Auth.OIDC
+	username, err := oidc.Exchange(r.Context(), query.Get("code"), oidc.redirectURL(r), state.Verifier, state.Nonce)
+	if err != nil {
+		log.Println("OIDC login failed:", err)
+		WriteError(w, http.StatusUnauthorized, CodeInvalidCredentials, "Login failed")
+		return
+	}
+
+	s.setSessionCookie(w, r, username)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// oidcState returns the login state from r's state cookie, if it is present,
+// correctly signed and not expired.
+func (s *Server) oidcState(r *http.Request) (oidcState, bool) {
+	var state oidcState
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return state, false
+	}
+	encoded, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok || subtle.ConstantTimeCompare([]byte(signature), []byte(s.Auth.sign(encoded))) != 1 {
+		return state, false
+	}
+	if err := decodeSegment(encoded, &state); err != nil || time.Now().Unix() >= state.ExpiresAt {
+		return state, false
+	}
+	return state, true
+}
+
+// redirectURL returns c.RedirectURL or, if empty, the callback URL on the
+// host r was sent to.
+func (c *OIDCClient) redirectURL(r *http.Request) string {
+	if c.RedirectURL != "" {
+		return c.RedirectURL
+	}
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + OIDCCallbackPath
+}
+
+// randomToken returns 32 random bytes, base64url encoded.
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,226 @@
+package chat
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockIdP is a minimal OpenID Connect provider that signs in a fixed user
+// without asking, as if they already had a session with it.
+type mockIdP struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]any // Claims added to, or overriding, the ID token's
+
+	// Set by the authorization endpoint, checked by the token endpoint.
+	nonce, challenge, redirectURI string
+}
+
+func startMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, claims: map[string]any{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		e := big.NewInt(int64(key.E)).Bytes()
+		writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(e),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		idp.nonce, idp.challenge, idp.redirectURI = q.Get("nonce"), q.Get("code_challenge"), q.Get("redirect_uri")
+		http.Redirect(w, r, idp.redirectURI+"?code=abc&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if id != "chat" || secret != "s3cret" || r.FormValue("code") != "abc" ||
+			r.FormValue("redirect_uri") != idp.redirectURI ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != idp.challenge {
+			WriteError(w, http.StatusBadRequest, "invalid_grant", "bad token request")
+			return
+		}
+		claims := map[string]any{
+			"iss":   idp.URL,
+			"aud":   "chat",
+			"sub":   "1234",
+			"email": "ann@example.com",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": idp.nonce,
+		}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"id_token": idp.sign(t, claims)})
+	})
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdP) sign(t *testing.T, claims map[string]any) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"test"}`))
+	payload, _ := json.Marshal(claims)
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func startOIDCServer(t *testing.T, idp *mockIdP) *httptest.Server {
+	t.Helper()
+	auth, err := OpenAuth(AuthConfig{OIDC: OIDCConfig{Issuer: idp.URL, ClientID: "chat", ClientSecret: "s3cret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(NewMemoryStore())
+	s.Auth = auth
+	go s.Run()
+	mux := http.NewServeMux()
+	s.Register(mux)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// oidcLogin runs the browser's side of a login and returns the status of
+// the callback and the user the server then reports.
+func oidcLogin(t *testing.T, ts *httptest.Server) (int, string) {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	var status int
+	browser := &http.Client{Jar: jar, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if req.URL.Path == "/" {
+			status = via[len(via)-1].Response.StatusCode
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}}
+
+	resp, err := browser.Get(ts.URL + OIDCLoginPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if status == 0 {
+		status = resp.StatusCode
+	}
+
+	resp, err = browser.Get(ts.URL + "/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var me struct{ Username string }
+	json.NewDecoder(resp.Body).Decode(&me)
+	return status, me.Username
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := startMockIdP(t)
+	ts := startOIDCServer(t, idp)
+
+	if status, username := oidcLogin(t, ts); status != http.StatusFound || username != "ann@example.com" {
+		t.Errorf("login: callback status %d, user %q; want 302 and ann@example.com", status, username)
+	}
+
+	resp, err := http.Get(ts.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var methods struct{ Password, OIDC bool }
+	json.NewDecoder(resp.Body).Decode(&methods)
+	resp.Body.Close()
+	if methods.Password || !methods.OIDC {
+		t.Errorf("login methods = %+v, want OIDC only", methods)
+	}
+}
+
+func TestOIDCLoginRejected(t *testing.T) {
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+		key    *rsa.PrivateKey
+	}{
+		{"wrong audience", map[string]any{"aud": "someone-else"}, nil},
+		{"wrong issuer", map[string]any{"iss": "https://evil.example"}, nil},
+		{"expired", map[string]any{"exp": time.Now().Add(-time.Minute).Unix()}, nil},
+		{"replayed nonce", map[string]any{"nonce": "old"}, nil},
+		{"unverified email", map[string]any{"email_verified": false}, nil},
+		{"signed by another key", nil, other},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := startMockIdP(t)
+			ts := startOIDCServer(t, idp)
+			idp.claims = tt.claims
+			if tt.key != nil {
+				idp.key = tt.key
+			}
+			if status, username := oidcLogin(t, ts); status != http.StatusUnauthorized || username != "" {
+				t.Errorf("callback status %d, user %q; want 401 and no session", status, username)
+			}
+		})
+	}
+
+	t.Run("forged state", func(t *testing.T) {
+		idp := startMockIdP(t)
+		ts := startOIDCServer(t, idp)
+		// A callback the browser never started, as a login CSRF attack
+		// would send.
+		resp, err := http.Get(ts.URL + OIDCCallbackPath + "?code=abc&state=forged")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || len(resp.Cookies()) != 1 || resp.Cookies()[0].Name != oidcStateCookie {
+			t.Errorf("status %d, cookies %v; want 401 and no session", resp.StatusCode, resp.Cookies())
+		}
+	})
+}
+
+func TestNewOIDCClientIssuerMismatch(t *testing.T) {
+	idp := startMockIdP(t)
+	// Reached under another name, the provider reports an issuer that does
+	// not match the configured one.
+	issuer := strings.Replace(idp.URL, "127.0.0.1", "localhost", 1)
+	if _, err := NewOIDCClient(context.Background(), issuer, "chat", "s3cret"); err == nil {
+		t.Error("client created for mismatched issuer")
+	}
+}
@@ -0,0 +1,80 @@
+package chat
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// corsMaxAge is how long, in seconds, browsers may cache a preflight answer.
+const corsMaxAge = 600
+
+// Methods and request headers that cross-origin pages may use.
+const (
+	corsAllowMethods = "GET, POST, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders = "Authorization, Content-Type, Last-Event-ID"
+)
+
+// AnyOrigin in Server.AllowedOrigins allows pages from every origin.
+const AnyOrigin = "*"
+
+// originAllowed reports whether r may be served given its Origin header.
+// Requests without one come from non-browser clients or same-origin
+// navigation and are allowed. Requests from a page on the server's own host
+// are allowed, as are those from the origins in s.AllowedOrigins.
+func (s *Server) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range s.AllowedOrigins {
+		if allowed == AnyOrigin || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS wraps handler so that it only serves cross-origin requests from
+// allowed origins, as decided for HandleWebSocket. It answers preflight
+// requests itself and adds the CORS headers that let allowed pages read the
+// response. Requests from other origins are refused with 403 Forbidden
+// rather than served with the response hidden, so that a hostile page cannot
+// post messages either.
+func (s *Server) CORS(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !s.originAllowed(r) {
+			WriteError(w, http.StatusForbidden, CodeOriginNotAllowed, "Origin not allowed")
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "Link")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,155 @@
+package chat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+const trustedOrigin = "https://chat.example.com"
+
+func startCORSServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	s := NewServer(NewMemoryStore())
+	if err := ConfigureCORS(s, CORSConfig{AllowedOrigins: []string{trustedOrigin}}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Run()
+	mux := http.NewServeMux()
+	s.Register(mux)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// TestWebSocketOrigin checks that a page on another site cannot open a
+// WebSocket to the server, which would let it act as any user whose browser
+// visits it (cross-site WebSocket hijacking).
+func TestWebSocketOrigin(t *testing.T) {
+	_, ts := startCORSServer(t)
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},            // Not a browser
+		{ts.URL, true},        // The server's own page
+		{trustedOrigin, true}, // Allowed
+		{"https://evil.example", false},
+		{"https://chat.example.com.evil.example", false},
+		{"http://chat.example.com", false}, // Wrong scheme
+		{"null", false},                    // Sandboxed iframe or file: page
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("origin %q: dial failed: %v", tt.origin, err)
+				continue
+			}
+			conn.Close()
+			continue
+		}
+		if err == nil {
+			conn.Close()
+			t.Errorf("origin %q: WebSocket opened, want it refused", tt.origin)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("origin %q: dial error %v, want 403 Forbidden", tt.origin, err)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	s, ts := startCORSServer(t)
+
+	t.Run("preflight from allowed origin", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodOptions, ts.URL+"/send", nil)
+		req.Header.Set("Origin", trustedOrigin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent ||
+			resp.Header.Get("Access-Control-Allow-Origin") != trustedOrigin ||
+			!strings.Contains(resp.Header.Get("Access-Control-Allow-Methods"), http.MethodPost) {
+			t.Errorf("status %d, headers %v", resp.StatusCode, resp.Header)
+		}
+	})
+
+	t.Run("preflight from other origin", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodOptions, ts.URL+"/send", nil)
+		req.Header.Set("Origin", "https://evil.example")
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("status %d, headers %v", resp.StatusCode, resp.Header)
+		}
+	})
+
+	t.Run("simple post from other origin", func(t *testing.T) {
+		// A form or text/plain POST needs no preflight, so the server
+		// itself has to refuse it.
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/send", strings.NewReader(`{"content":"pwned"}`))
+		req.Header.Set("Origin", "https://evil.example")
+		req.Header.Set("Content-Type", "text/plain")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("status %d, want 403", resp.StatusCode)
+		}
+		if messages, _ := s.Store.List(ListQuery{Room: DefaultRoom}); len(messages) != 0 {
+			t.Errorf("message stored: %+v", messages)
+		}
+	})
+
+	first, _ := s.Post(Message{Content: "first"})
+	s.Post(Message{Content: "second"})
+	for _, path := range []string{"/receive?since=" + first.ID, "/past_messages"} {
+		t.Run("get "+path+" from allowed origin", func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+			req.Header.Set("Origin", trustedOrigin)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != trustedOrigin {
+				t.Errorf("status %d, headers %v", resp.StatusCode, resp.Header)
+			}
+		})
+	}
+}
+
+func TestConfigureCORS(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	for _, origin := range []string{"chat.example.com", "https://chat.example.com/app", "https://"} {
+		if err := ConfigureCORS(s, CORSConfig{AllowedOrigins: []string{origin}}); err == nil {
+			t.Errorf("origin %q accepted", origin)
+		}
+	}
+	for _, origin := range []string{AnyOrigin, "https://chat.example.com", "http://localhost:8080"} {
+		if err := ConfigureCORS(s, CORSConfig{AllowedOrigins: []string{origin}}); err != nil {
+			t.Errorf("origin %q: %v", origin, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPastMessagesPaging(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	go s.Run()
+	var ids []string
+	for i := 0; i < 7; i++ {
+		msg, err := s.Post(Message{Room: "ops", Username: "ann", Content: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	s.Post(Message{Username: "ann", Content: "elsewhere"})
+
+	for _, test := range []struct {
+		query  string
+		want   string // Contents of the page, joined
+		link   string // The Link header; none if empty
+		status int
+	}{
+		{query: "room=ops", want: "0123456"},
+		{query: "room=ops&limit=3", want: "456", link: "before=" + ids[4] + "&limit=3&room=ops"},
+		{query: "room=ops&limit=3&before=" + ids[4], want: "123", link: "before=" + ids[1] + "&limit=3&room=ops"},
+		{query: "room=ops&limit=3&before=" + ids[1], want: "0"},
+		{query: "room=ops&limit=2&after=" + ids[2], want: "34", link: "after=" + ids[4] + "&limit=2&room=ops"},
+		{query: "room=ops&limit=2&after=" + ids[4], want: "56"},
+		{query: "room=ops&limit=1&thread=" + ids[0], want: "0"},
+		{query: fmt.Sprintf("room=ops&limit=%d", MaxPageSize), want: "0123456"},
+
+		// A cursor no message has pages from where it would sort.
+		{query: "room=ops&limit=2&after=" + strings.Repeat("0", 26), want: "01", link: "after=" + ids[1] + "&limit=2&room=ops"},
+		{query: "room=ops&before=" + strings.Repeat("Z", 26), want: "0123456"},
+		{query: "room=ops&before=" + strings.Repeat("0", 26), want: ""},
+
+		{query: "room=ops&before=" + ids[4] + "&after=" + ids[1], status: http.StatusBadRequest},
+		{query: "room=ops&limit=0", status: http.StatusBadRequest},
+		{query: fmt.Sprintf("room=ops&limit=%d", MaxPageSize+1), status: http.StatusBadRequest},
+		{query: "room=ops&limit=ten", status: http.StatusBadRequest},
+		{query: "room=no%20spaces", status: http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		s.HandlePastMessages(w, httptest.NewRequest(http.MethodGet, "/past_messages?"+test.query, nil))
+		if test.status == 0 {
+			test.status = http.StatusOK
+		}
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.query, w.Code, test.status)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		var messages []Message
+		json.NewDecoder(w.Body).Decode(&messages)
+		var got strings.Builder
+		for _, msg := range messages {
+			got.WriteString(msg.Content)
+		}
+		if got.String() != test.want {
+			t.Errorf("%s: page %q, want %q", test.query, got.String(), test.want)
+		}
+		want := ""
+		if test.link != "" {
+			want = `</past_messages?` + test.link + `>; rel="next"`
+		}
+		if link := w.Header().Get("Link"); link != want {
+			t.Errorf("%s: Link %q, want %q", test.query, link, want)
+		}
+	}
+
+	// Stores give an empty page for a query with both cursors the wrong
+	// way round rather than failing.
+	if page, err := s.Store.List(ListQuery{Room: "ops", After: ids[4], Before: ids[2]}); err != nil || !reflect.DeepEqual(page, []Message{}) {
+		t.Errorf("List with After past Before = %+v, %v", page, err)
+	}
+	if page, _ := s.Store.List(ListQuery{Room: "ops", After: ids[1], Before: ids[4]}); len(page) != 2 || page[0].ID != ids[2] {
+		t.Errorf("List between two cursors = %+v", page)
+	}
+}
@@ -0,0 +1,308 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultPresenceTimeout is how long a replica's word that a user is online
+// lasts when Server.PresenceTimeout is not set.
+const DefaultPresenceTimeout = 30 * time.Second
+
+// presenceMemory is how long a replica remembers when users who went
+// offline were last seen.
+const presenceMemory = 24 * time.Hour
+
+// Presence tells whether a user is connected to a room.
+type Presence struct {
+	Username string    `json:"username"`
+	Online   bool      `json:"online"`
+	LastSeen time.Time `json:"last_seen"` // When the user was last connected; now, if online
+}
+
+// presence keeps track of who is connected to each room, on this replica
+// and, through the presence events every replica publishes, on all of them.
+// Nothing it knows is ever stored.
+//
+// Each replica announces that a user is online when the user's first
+// connection to a room opens, and offline once the last one has been closed
+// for a while, so that long-poll clients, which reconnect for every poll,
+// and clients that briefly lose their connection do not flicker. While a
+// user stays connected the replica repeats its announcement, and a user
+// announced only by a replica that has gone quiet for the timeout, because
+// it crashed, say, goes offline.
+type presence struct {
+	origin string // ID of this replica in the events it publishes
+
+	mutex    sync.Mutex
+	timeout  time.Duration // How long an announcement lasts
+	local    map[roomUser]*localPresence
+	replicas map[roomUser]map[string]time.Time // When each replica's announcement expires
+	lastSeen map[roomUser]time.Time            // When users now offline went offline
+}
+
+type roomUser struct {
+	room, username string
+}
+
+// localPresence counts a user's connections to a room on this replica.
+type localPresence struct {
+	connections int
+	seen        time.Time // When the last connection closed
+}
+
+func newPresence(origin string) *presence {
+	return &presence{
+		origin:   origin,
+		timeout:  DefaultPresenceTimeout,
+		local:    make(map[roomUser]*localPresence),
+		replicas: make(map[roomUser]map[string]time.Time),
+		lastSeen: make(map[roomUser]time.Time),
+	}
+}
+
+// connect records a new connection by username to room. It returns the
+// event announcing the user, if this is the user's first connection to the
+// room on this replica, and a function to call when the connection closes.
+func (p *presence) connect(room, username string) (announce *Event, disconnect func()) {
+	key := roomUser{room, username}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	local := p.local[key]
+	if local == nil {
+		local = &localPresence{}
+		p.local[key] = local
+		announce = p.event(key, true, time.Now())
+	}
+	local.connections++
+
+	var once sync.Once
+	return announce, func() {
+		once.Do(func() {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			local.connections--
+			local.seen = time.Now()
+		})
+	}
+}
+
+// apply updates the roster with a presence event published by any replica,
+// including this one. It returns the event to deliver to the room's
+// clients, and false if the user's presence has not changed.
+func (p *presence) apply(event Event) (Event, bool) {
+	if event.Presence == nil {
+		return Event{}, false
+	}
+	key := roomUser{event.Room, event.Presence.Username}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	wasOnline := len(p.replicas[key]) > 0
+	if event.Presence.Online {
+		if p.replicas[key] == nil {
+			p.replicas[key] = make(map[string]time.Time)
+		}
+		p.replicas[key][event.Origin] = time.Now().Add(p.timeout)
+		delete(p.lastSeen, key)
+	} else {
+		delete(p.replicas[key], event.Origin)
+		if len(p.replicas[key]) == 0 {
+			delete(p.replicas, key)
+			p.lastSeen[key] = event.Presence.LastSeen
+		}
+	}
+
+	if online := len(p.replicas[key]) > 0; online == wasOnline {
+		return Event{}, false
+	}
+	event.Origin = ""
+	return event, true
+}
+
+// sweep returns the events this replica has to publish: announcements for
+// the users connected to it and departures for those whose connections
+// closed before since. It forgets users offline for longer than
+// presenceMemory. It also forgets the announcements that have expired,
+// those of replicas that went away, returning the departures this causes,
+// which are only to be delivered to this replica's clients.
+func (p *presence) sweep(since time.Time) (publish, expired []Event) {
+	now := time.Now()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for key, local := range p.local {
+		switch {
+		case local.connections > 0:
+			publish = append(publish, *p.event(key, true, now))
+		case local.seen.Before(since):
+			delete(p.local, key)
+			publish = append(publish, *p.event(key, false, local.seen))
+		}
+	}
+
+	for key, seen := range p.lastSeen {
+		if now.Sub(seen) > presenceMemory {
+			delete(p.lastSeen, key)
+		}
+	}
+
+	for key, replicas := range p.replicas {
+		for origin, expires := range replicas {
+			if expires.Before(now) {
+				delete(replicas, origin)
+			}
+		}
+		if len(replicas) == 0 {
+			delete(p.replicas, key)
+			p.lastSeen[key] = now.Add(-p.timeout)
+			event := p.event(key, false, p.lastSeen[key])
+			event.Origin = ""
+			expired = append(expired, *event)
+		}
+	}
+	return publish, expired
+}
+
+// list returns the presence of every user seen in room since the replica
+// started, or in the last presenceMemory, sorted by username.
+func (p *presence) list(room string) []Presence {
+	now := time.Now()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	users := []Presence{}
+	for key := range p.replicas {
+		if key.room == room {
+			users = append(users, Presence{Username: key.username, Online: true, LastSeen: now})
+		}
+	}
+	for key, seen := range p.lastSeen {
+		if key.room == room {
+			users = append(users, Presence{Username: key.username, LastSeen: seen})
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+func (p *presence) event(key roomUser, online bool, seen time.Time) *Event {
+	return &Event{
+		Type:     EventPresence,
+		Room:     key.room,
+		Username: key.username,
+		Presence: &Presence{Username: key.username, Online: online, LastSeen: seen.UTC()},
+		Origin:   p.origin,
+	}
+}
+
+// trackPresence keeps this replica's presence announcements current until
+// the process exits.
+func (s *Server) trackPresence() {
+	timeout := s.PresenceTimeout
+	if timeout <= 0 {
+		timeout = DefaultPresenceTimeout
+	}
+	s.presence.mutex.Lock()
+	s.presence.timeout = timeout
+	s.presence.mutex.Unlock()
+
+	interval := timeout / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		publish, expired := s.presence.sweep(time.Now().Add(-interval))
+		for _, event := range publish {
+			// Repeated announcements are not news to observers.
+			if event.Presence.Online {
+				s.broadcast(event)
+			} else {
+				s.publish(event)
+			}
+		}
+		for _, event := range expired {
+			s.Hub.Publish(event)
+		}
+	}
+}
+
+// join records that the client making r is connected to room until the
+// returned function is called. Clients are known by their authenticated
+// username or, failing that, by the username query parameter; anonymous
+// clients are not tracked.
+func (s *Server) join(r *http.Request, room string) (leave func()) {
+	username := clientUser(r)
+	if username == "" {
+		return func() {}
+	}
+
+	announce, leave := s.presence.connect(room, username)
+	if announce != nil {
+		s.publish(*announce)
+	}
+	return leave
+}
+
+// Typing tells the clients in room that username is typing.
+func (s *Server) Typing(room, username string) {
+	s.publish(Event{Type: EventTyping, Room: room, Username: username})
+}
+
+// HandleTyping tells the clients in the room named by the room query
+// parameter, DefaultRoom if unset, that the user posting to it is typing,
+// for clients that cannot send a typing frame over a WebSocket. The user is
+// the authenticated one or whoever the JSON body {"username": "..."} names.
+func (s *Server) HandleTyping(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	room, ok := roomParam(r)
+	if !ok {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRoom, "Invalid room")
+		return
+	}
+	var body Message
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+	stampUser(r, &body)
+	if body.Username == "" {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Username is required")
+		return
+	}
+
+	s.Typing(room, body.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandlePresence answers with the presence of the users seen in the room
+// named by the room query parameter, DefaultRoom if unset, on any replica
+// since this one started, or in the last day, as a JSON array sorted by
+// username:
+//
+//	[{"username": "ann", "online": true, "last_seen": "2024-01-02T15:04:05Z"}, ...]
+func (s *Server) HandlePresence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	room, ok := roomParam(r)
+	if !ok {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRoom, "Invalid room")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.presence.list(room))
+}
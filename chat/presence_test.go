@@ -0,0 +1,169 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startReplicas starts two servers sharing bus, as replicas behind a load
+// balancer would.
+func startReplicas(t *testing.T, bus Bus) (a, b *httptest.Server) {
+	t.Helper()
+	start := func() *httptest.Server {
+		s := NewServer(NewMemoryStore())
+		s.PresenceTimeout = 300 * time.Millisecond
+		if err := s.AttachBus(bus); err != nil {
+			t.Fatal(err)
+		}
+		go s.Run()
+		mux := http.NewServeMux()
+		s.Register(mux)
+		ts := httptest.NewServer(mux)
+		t.Cleanup(ts.Close)
+		return ts
+	}
+	return start(), start()
+}
+
+// readPresence reads frames until one tells of username's presence.
+func readPresence(t *testing.T, conn *websocket.Conn, username string) Presence {
+	t.Helper()
+	for {
+		frame := readFrame(t, conn, FramePresence)
+		if frame.Presence != nil && frame.Presence.Username == username {
+			return *frame.Presence
+		}
+	}
+}
+
+func TestPresenceAcrossReplicas(t *testing.T) {
+	a, b := startReplicas(t, NewMemoryBus())
+	dial := func(ts *httptest.Server, query string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	bob := dial(b, "?username=bob")
+	readPresence(t, bob, "bob")
+
+	ann := dial(a, "?username=ann")
+	if presence := readPresence(t, bob, "ann"); !presence.Online {
+		t.Errorf("ann's presence = %+v, want online", presence)
+	}
+
+	resp, err := http.Get(b.URL + "/presence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []Presence
+	json.NewDecoder(resp.Body).Decode(&users)
+	resp.Body.Close()
+	if len(users) != 2 || users[0].Username != "ann" || !users[0].Online || users[1].Username != "bob" || !users[1].Online {
+		t.Errorf("presence on the other replica = %+v, want ann and bob online", users)
+	}
+
+	// A second connection for ann announces nothing new.
+	dial(a, "?username=ann").Close()
+
+	ann.WriteJSON(Frame{Type: FrameTyping, Username: "ann"})
+	if frame := readFrame(t, bob, FrameTyping); frame.Username != "ann" {
+		t.Errorf("typing frame = %+v, want ann", frame)
+	}
+
+	ann.Close()
+	presence := readPresence(t, bob, "ann")
+	if presence.Online || presence.LastSeen.IsZero() {
+		t.Errorf("ann's presence after leaving = %+v, want offline with a last-seen time", presence)
+	}
+}
+
+func TestTypingOverLongPoll(t *testing.T) {
+	a, b := startReplicas(t, NewMemoryBus())
+
+	done := make(chan []Event)
+	go func() {
+		resp, err := http.Get(b.URL + "/receive?events=1")
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		defer resp.Body.Close()
+		var events []Event
+		json.NewDecoder(resp.Body).Decode(&events)
+		done <- events
+	}()
+
+	// Keep typing until the poll, which may not have started yet, hears it.
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case events := <-done:
+			if len(events) == 0 || events[0].Type != EventTyping || events[0].Username != "ann" {
+				t.Errorf("long-poll events = %+v, want ann typing", events)
+			}
+			return
+		case <-ticker.C:
+			resp, err := http.Post(a.URL+"/typing", "application/json", strings.NewReader(`{"username":"ann"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("POST /typing: status %d, want 204", resp.StatusCode)
+			}
+		}
+	}
+}
+
+func TestPresenceExpiresWithReplica(t *testing.T) {
+	p := newPresence("here")
+	p.timeout = 10 * time.Millisecond
+
+	elsewhere := Event{Type: EventPresence, Room: DefaultRoom, Presence: &Presence{Username: "ann", Online: true}, Origin: "elsewhere"}
+	if event, changed := p.apply(elsewhere); !changed || event.Origin != "" {
+		t.Errorf("first announcement: %+v, %v; want it delivered without its origin", event, changed)
+	}
+	if _, changed := p.apply(elsewhere); changed {
+		t.Error("repeated announcement was delivered again")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	publish, expired := p.sweep(time.Now())
+	if len(publish) != 0 {
+		t.Errorf("sweep published %+v for a replica with no clients", publish)
+	}
+	if len(expired) != 1 || expired[0].Presence.Online || expired[0].Presence.Username != "ann" {
+		t.Errorf("sweep expired %+v, want ann offline", expired)
+	}
+	if users := p.list(DefaultRoom); len(users) != 1 || users[0].Online {
+		t.Errorf("list = %+v, want ann offline", users)
+	}
+}
+
+func TestPresenceForgetsUsersOfflineForADay(t *testing.T) {
+	p := newPresence("here")
+	for username, offline := range map[string]time.Duration{"ann": time.Hour, "bob": 25 * time.Hour} {
+		p.apply(Event{Type: EventPresence, Room: DefaultRoom, Presence: &Presence{Username: username, Online: true}, Origin: "elsewhere"})
+		p.apply(Event{Type: EventPresence, Room: DefaultRoom, Presence: &Presence{Username: username, LastSeen: time.Now().Add(-offline)}, Origin: "elsewhere"})
+	}
+
+	p.sweep(time.Now())
+	if users := p.list(DefaultRoom); len(users) != 1 || users[0].Username != "ann" {
+		t.Errorf("list after a sweep = %+v, want only ann", users)
+	}
+	if len(p.lastSeen) != 1 {
+		t.Errorf("%d users remembered, want 1", len(p.lastSeen))
+	}
+}
@@ -0,0 +1,157 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestThreads(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	go s.Run()
+	mux := http.NewServeMux()
+	s.Register(mux)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	root, _ := s.Post(Message{Username: "ann", Content: "lunch?"})
+	s.Post(Message{Username: "bob", Content: "unrelated"})
+	reply, err := s.Post(Message{Username: "bob", Content: "yes", ReplyTo: root.ID})
+	if err != nil || reply.ReplyTo != root.ID {
+		t.Fatalf("reply = %+v, %v", reply, err)
+	}
+	// A reply to a reply joins the same thread.
+	nested, _ := s.Post(Message{Username: "ann", Content: "noon", ReplyTo: reply.ID})
+	if nested.ReplyTo != root.ID {
+		t.Errorf("reply to a reply has ReplyTo %q, want %q", nested.ReplyTo, root.ID)
+	}
+
+	if _, err := s.Post(Message{Username: "ann", Content: "?", ReplyTo: "nope"}); !errors.Is(err, ErrInvalidReply) {
+		t.Errorf("reply to a missing message: %v, want ErrInvalidReply", err)
+	}
+	if _, err := s.Post(Message{Room: "other", Content: "?", ReplyTo: root.ID}); !errors.Is(err, ErrInvalidReply) {
+		t.Errorf("reply across rooms: %v, want ErrInvalidReply", err)
+	}
+
+	resp, err := http.Get(ts.URL + "/past_messages?thread=" + root.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var messages []Message
+	json.NewDecoder(resp.Body).Decode(&messages)
+	var contents []string
+	for _, message := range messages {
+		contents = append(contents, message.Content)
+	}
+	if want := []string{"lunch?", "yes", "noon"}; !reflect.DeepEqual(contents, want) {
+		t.Errorf("thread = %q, want %q", contents, want)
+	}
+
+	resp, err = http.Post(ts.URL+"/send", "application/json", strings.NewReader(`{"username":"ann","content":"?","reply_to":"nope"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST /send replying to a missing message: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestReactions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.json")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(store)
+	go s.Run()
+	_, events := s.Hub.Subscribe(DefaultRoom)
+
+	posted, _ := s.Post(Message{Username: "ann", Content: "hello"})
+	<-events
+
+	s.React(DefaultRoom, posted.ID, "bob", "👍")
+	s.React(DefaultRoom, posted.ID, "ann", "👍")
+	s.React(DefaultRoom, posted.ID, "bob", "👍")
+	reacted, err := s.React(DefaultRoom, posted.ID, "bob", "🎉")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Reactions{"👍": {"ann", "bob"}, "🎉": {"bob"}}); !reflect.DeepEqual(reacted.Reactions, want) {
+		t.Errorf("reactions = %v, want %v", reacted.Reactions, want)
+	}
+	if event := <-events; event.Type != EventUpdate || len(event.Message.Reactions) != 1 {
+		t.Errorf("event after reacting = %+v, want an update", event)
+	}
+
+	unreacted, _ := s.Unreact(DefaultRoom, posted.ID, "bob", "🎉")
+	if _, ok := unreacted.Reactions["🎉"]; ok {
+		t.Errorf("reactions after the last 🎉 was taken back = %v", unreacted.Reactions)
+	}
+
+	for _, emoji := range []string{"", "two words", strings.Repeat("x", MaxEmojiLength+1)} {
+		if _, err := s.React(DefaultRoom, posted.ID, "bob", emoji); !errors.Is(err, ErrInvalidReaction) {
+			t.Errorf("React(%q): %v, want ErrInvalidReaction", emoji, err)
+		}
+	}
+	if _, err := s.React(DefaultRoom, "nope", "bob", "👍"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("reaction to a missing message: %v, want ErrNotFound", err)
+	}
+
+	// Editing keeps the reactions, on disk too.
+	s.Edit(DefaultRoom, posted.ID, "ann", "hello!")
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := reopened.Get(DefaultRoom, posted.ID)
+	if want := (Reactions{"👍": {"ann", "bob"}}); stored.Content != "hello!" || !reflect.DeepEqual(stored.Reactions, want) {
+		t.Errorf("stored message = %+v", stored)
+	}
+
+	s.Delete(DefaultRoom, posted.ID, "ann")
+	if _, err := s.React(DefaultRoom, posted.ID, "bob", "👍"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("reaction to a deleted message: %v, want ErrNotFound", err)
+	}
+}
+
+func TestReactionsOverHTTPAndWebSocket(t *testing.T) {
+	s, ts := startAuthServer(t)
+	_, token := login(t, ts, "ann", "secret")
+	posted, _ := s.Post(Message{Username: "bob", Content: "hi"})
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+MessagesPath+posted.ID+"/reactions", strings.NewReader(`{"emoji":"👍","username":"mallory"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message Message
+	json.NewDecoder(resp.Body).Decode(&message)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !reflect.DeepEqual(message.Reactions, Reactions{"👍": {"ann"}}) {
+		t.Errorf("POST reactions: status %d, message %+v", resp.StatusCode, message)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(Frame{Type: FrameUnreact, ID: "r1", Message: &Message{ID: posted.ID}, Emoji: "👍"})
+	if ack := readFrame(t, conn, FrameAck); ack.ID != "r1" || len(ack.Message.Reactions) != 0 {
+		t.Errorf("unreact ack = %+v", ack)
+	}
+	conn.WriteJSON(Frame{Type: FrameReact, ID: "r2", Message: &Message{ID: posted.ID}, Emoji: "no spaces"})
+	if frame := readFrame(t, conn, FrameError); frame.ID != "r2" || frame.Error.Code != CodeInvalidReaction {
+		t.Errorf("invalid reaction answered with %+v", frame)
+	}
+}
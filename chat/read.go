@@ -0,0 +1,183 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// MaxUnread is the most unread messages Unread counts in one room.
+const MaxUnread = 99
+
+// ErrNoUser is returned when reading is recorded without saying who read.
+var ErrNoUser = errors.New("no user")
+
+// Unread tells how much of a room a user has yet to read.
+type Unread struct {
+	Room     string `json:"room"`
+	LastRead string `json:"last_read,omitempty"` // ID of the last message read, if any
+	Count    int    `json:"count"`               // Messages by others since then, at most MaxUnread
+}
+
+// MarkRead records that username has read room up to the message with ID
+// id and, unless the user had already read further, tells the clients in
+// the room. The message must exist.
+func (s *Server) MarkRead(room, username, id string) error {
+	if username == "" {
+		return ErrNoUser
+	}
+	if !validTarget(room) {
+		return ErrInvalidRoom
+	}
+
+	msg, err := s.Store.Get(room, id)
+	if err != nil {
+		return err
+	}
+	moved, err := s.Cursors.MarkRead(username, room, id)
+	if err != nil || !moved {
+		return err
+	}
+
+	s.publish(Event{Type: EventRead, Room: room, Username: username, Message: &Message{ID: id, Room: room}, To: msg.To})
+	return nil
+}
+
+// Unread returns how many messages username has yet to read in each of
+// rooms, or if rooms is empty in DefaultRoom and every room and direct
+// conversation the user has read, sorted by room. Messages by the user
+// and deleted messages do not count.
+func (s *Server) Unread(username string, rooms []string) ([]Unread, error) {
+	if username == "" {
+		return nil, ErrNoUser
+	}
+	cursors, err := s.Cursors.Cursors(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rooms) == 0 {
+		rooms = []string{DefaultRoom}
+		for room := range cursors {
+			if room != DefaultRoom {
+				rooms = append(rooms, room)
+			}
+		}
+		sort.Strings(rooms)
+	}
+
+	unread := make([]Unread, 0, len(rooms))
+	for _, room := range rooms {
+		// Reading a page more than the limit leaves room for the user's
+		// own and deleted messages.
+		messages, err := s.Store.List(ListQuery{Room: room, After: cursors[room], Limit: 2 * MaxUnread})
+		if err != nil {
+			return nil, err
+		}
+		count := 0
+		for _, message := range messages {
+			if message.Username != username && !message.Deleted && count < MaxUnread {
+				count++
+			}
+		}
+		unread = append(unread, Unread{Room: room, LastRead: cursors[room], Count: count})
+	}
+	return unread, nil
+}
+
+// HandleRead records that the user has read the room named by the room
+// query parameter, DefaultRoom if unset, or the direct conversation named
+// by the with parameter, up to the message whose ID is in the JSON body
+// {"id": "..."}. The user is the authenticated one or whoever the body's
+// username field names. Clients in the room are sent a read event.
+func (s *Server) HandleRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var body Message
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ID == "" {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+	stampUser(r, &body)
+	room, err := targetRoom(r)
+	if err != nil {
+		writeTargetError(w, err)
+		return
+	}
+
+	if err := s.MarkRead(room, body.Username, body.ID); err != nil {
+		status, code, text := readError(err)
+		if status >= http.StatusInternalServerError {
+			log.Printf("Failed to mark %s read: %v", body.ID, err)
+			WriteStoreError(w, err, text)
+			return
+		}
+		WriteError(w, status, code, text)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleUnread answers with the user's Unread counts as a JSON array, for
+// the rooms named by the room query parameters, which may be repeated, or
+// if there are none for the rooms Server.Unread picks:
+//
+//	[{"room": "general", "last_read": "01H...", "count": 3}, ...]
+//
+// The user is the authenticated one or whoever the username query
+// parameter names, in which case direct conversations are left out.
+func (s *Server) HandleUnread(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	rooms := r.URL.Query()["room"]
+	for _, room := range rooms {
+		if !validRoom(room) {
+			WriteError(w, http.StatusBadRequest, CodeInvalidRoom, "Invalid room")
+			return
+		}
+	}
+
+	_, authenticated := User(r)
+	unread, err := s.Unread(clientUser(r), rooms)
+	if err != nil {
+		status, code, text := readError(err)
+		if status >= http.StatusInternalServerError {
+			log.Printf("Failed to count unread messages: %v", err)
+			WriteStoreError(w, err, "Failed to count unread messages")
+			return
+		}
+		WriteError(w, status, code, text)
+		return
+	}
+	if !authenticated {
+		visible := unread[:0]
+		for _, u := range unread {
+			if validRoom(u.Room) {
+				visible = append(visible, u)
+			}
+		}
+		unread = visible
+	}
+	writeJSON(w, http.StatusOK, unread)
+}
+
+// readError returns the status, error code and message that answer a
+// MarkRead or Unread that failed with err.
+func readError(err error) (status int, code, message string) {
+	switch {
+	case errors.Is(err, ErrNoUser):
+		return http.StatusBadRequest, CodeInvalidBody, "Username is required"
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, CodeNotFound, "Message not found"
+	default:
+		return changeError(err)
+	}
+}
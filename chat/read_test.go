@@ -0,0 +1,113 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReadReceipts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cursors.json")
+	cursors, err := NewFileCursors(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(NewMemoryStore())
+	s.Cursors = cursors
+	go s.Run()
+	_, events := s.Hub.Subscribe(DefaultRoom)
+
+	var posted []Message
+	for _, content := range []string{"one", "two", "three"} {
+		msg, _ := s.Post(Message{Username: "ann", Content: content})
+		posted = append(posted, msg)
+		<-events
+	}
+	s.Post(Message{Username: "bob", Content: "mine"})
+	<-events
+
+	if err := s.MarkRead(DefaultRoom, "bob", posted[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event.Type != EventRead || event.Username != "bob" || event.Message.ID != posted[1].ID {
+		t.Errorf("event after reading = %+v, want bob's read receipt", event)
+	}
+
+	// Reading an older message leaves the cursor where it is.
+	if err := s.MarkRead(DefaultRoom, "bob", posted[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	unread, err := s.Unread("bob", nil)
+	if want := []Unread{{Room: DefaultRoom, LastRead: posted[1].ID, Count: 1}}; err != nil || !reflect.DeepEqual(unread, want) {
+		t.Errorf("bob's unread = %+v, %v; want %+v", unread, err, want)
+	}
+	if unread, _ := s.Unread("carol", []string{DefaultRoom, "other"}); len(unread) != 2 || unread[0].Count != 4 || unread[1].Count != 0 {
+		t.Errorf("carol's unread = %+v, want everything in general and nothing in other", unread)
+	}
+
+	if err := s.MarkRead(DefaultRoom, "bob", "nope"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("reading a missing message: %v, want ErrNotFound", err)
+	}
+	if err := s.MarkRead(DefaultRoom, "", posted[2].ID); !errors.Is(err, ErrNoUser) {
+		t.Errorf("reading anonymously: %v, want ErrNoUser", err)
+	}
+
+	// The cursor is still there on another device after a restart.
+	reopened, err := NewFileCursors(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := reopened.Cursors("bob"); !reflect.DeepEqual(got, map[string]string{DefaultRoom: posted[1].ID}) {
+		t.Errorf("cursors after reload = %v", got)
+	}
+}
+
+func TestReadReceiptsOverHTTPAndWebSocket(t *testing.T) {
+	s, ts := startAuthServer(t)
+	_, token := login(t, ts, "ann", "secret")
+	first, _ := s.Post(Message{Username: "bob", Content: "hi"})
+	second, _ := s.Post(Message{Username: "bob", Content: "there"})
+
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	if resp := do(http.MethodPost, "/read", `{"id":"`+first.ID+`","username":"mallory"}`); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("POST /read: status %d, want 204", resp.StatusCode)
+	}
+	var unread []Unread
+	json.NewDecoder(do(http.MethodGet, "/unread?username=mallory", "").Body).Decode(&unread)
+	if len(unread) != 1 || unread[0].LastRead != first.ID || unread[0].Count != 1 {
+		t.Errorf("GET /unread = %+v, want one unread message after the first", unread)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(Frame{Type: FrameRead, ID: "r1", Message: &Message{ID: second.ID}})
+	if ack := readFrame(t, conn, FrameAck); ack.ID != "r1" {
+		t.Errorf("read ack = %+v", ack)
+	}
+	if frame := readFrame(t, conn, FrameRead); frame.Username != "ann" || frame.Message.ID != second.ID {
+		t.Errorf("read frame = %+v, want ann's receipt", frame)
+	}
+	conn.WriteJSON(Frame{Type: FrameRead, ID: "r2", Message: &Message{ID: "nope"}})
+	if frame := readFrame(t, conn, FrameError); frame.ID != "r2" || frame.Error.Code != CodeNotFound {
+		t.Errorf("read of a missing message answered with %+v", frame)
+	}
+}
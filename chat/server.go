@@ -0,0 +1,360 @@
+package chat
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultPollWaitPeriod is the maximum wait period for a long poll.
+const DefaultPollWaitPeriod = 30 * time.Second
+
+// Server ties a Hub to a MessageStore and exposes both over HTTP.
+type Server struct {
+	Hub   *Hub
+	Store MessageStore
+
+	// Cursors records how far each user has read each room.
+	Cursors CursorStore
+
+	// Upgrader is used by HandleWebSocket. If its CheckOrigin is nil, the
+	// origin is checked against AllowedOrigins.
+	Upgrader websocket.Upgrader
+
+	// AllowedOrigins lists the origins, such as https://chat.example.com,
+	// of pages other than the server's own that may use it, or AnyOrigin.
+	// Pages from any other origin cannot open a WebSocket or make
+	// cross-origin requests to handlers wrapped by CORS.
+	AllowedOrigins []string
+
+	// PollWaitPeriod is how long HandleReceive waits for a message before
+	// answering with 204 No Content.
+	PollWaitPeriod time.Duration
+
+	// Auth, if set, makes the handlers wrapped by Authenticate require a
+	// session token and post messages under the token's username rather
+	// than the one the client sends.
+	Auth *Authenticator
+
+	// IDs generates the ID assigned to each posted message.
+	IDs *IDGenerator
+
+	// Transports lists the transports HandleNegotiate offers clients, most
+	// preferred first.
+	Transports []string
+
+	// PresenceTimeout is how long a user connected to another replica stays
+	// online after that replica was last heard from. Replicas repeat their
+	// announcements three times as often, and departures are announced
+	// within a third of it. It must not be changed once Run has started.
+	PresenceTimeout time.Duration
+
+	bus       Bus
+	observers []func(Event)
+	presence  *presence
+	posting   sync.Mutex // Keeps messages stored in ID order
+}
+
+// NewServer returns a Server backed by store. Run must be started before
+// messages are delivered to clients.
+func NewServer(store MessageStore) *Server {
+	return &Server{
+		Hub:             NewHub(),
+		Store:           store,
+		Cursors:         NewMemoryCursors(),
+		PollWaitPeriod:  DefaultPollWaitPeriod,
+		IDs:             NewIDGenerator(),
+		Transports:      DefaultTransports,
+		PresenceTimeout: DefaultPresenceTimeout,
+		presence:        newPresence(randomToken()),
+	}
+}
+
+// Run starts delivering messages to connected clients and keeping track of
+// who is connected. It never returns.
+func (s *Server) Run() {
+	go s.trackPresence()
+	s.Hub.Run()
+}
+
+// AttachBus makes the server publish its events, such as posted messages,
+// on bus and deliver every event it receives from bus to the local clients,
+// so that clients connected to any replica see each other's messages. A nil
+// bus leaves delivery local to this replica. AttachBus must be called before
+// the server starts handling requests.
+func (s *Server) AttachBus(bus Bus) error {
+	if bus == nil {
+		return nil
+	}
+
+	events, err := bus.Subscribe()
+	if err != nil {
+		return err
+	}
+	s.bus = bus
+
+	go func() {
+		for event := range events {
+			s.deliver(event)
+		}
+	}()
+	return nil
+}
+
+// resume subscribes to room, and to the direct messages of username if set,
+// and returns the messages in room newer than the message with ID since,
+// from the hub if it still remembers since and from the store otherwise, in
+// which case at most MaxPageSize are returned and some of them may also be
+// delivered on the channel. If the store fails the client is unsubscribed
+// again.
+func (s *Server) resume(room, username, since string) (clientID int, events <-chan Event, backlog []Message, err error) {
+	clientID, events, backlog, ok := s.Hub.SubscribeAs(room, username, since)
+	if ok {
+		return clientID, events, backlog, nil
+	}
+
+	backlog, err = s.Store.List(ListQuery{Room: room, After: since, Limit: MaxPageSize})
+	if err != nil {
+		s.Hub.Unsubscribe(clientID)
+		return 0, nil, nil, err
+	}
+	return clientID, events, backlog, nil
+}
+
+// ErrInvalidRoom is returned by Post when a message names an invalid room.
+var ErrInvalidRoom = errors.New("invalid room")
+
+// ErrInvalidReply is returned by Post when a message replies to a message
+// that does not exist in its room or was deleted.
+var ErrInvalidReply = errors.New("invalid reply")
+
+// Post assigns msg an ID, stores it and broadcasts it to the clients in its
+// room. A message without a room is posted to DefaultRoom. A reply to a
+// reply joins the thread of the message the latter replies to, so that
+// threads are one level deep.
+//
+// A message addressed to other users in To is instead a direct message from
+// msg.Username to them. It is stored apart from every room, in the
+// conversation of exactly these users, and only delivered to their
+// connections; its Room and To are set to the conversation's.
+//
+// Posts are stored one at a time, each with the next ID, so that a reader
+// resuming after an ID cannot miss a message stored later with a smaller
+// one. A replica therefore posts no faster than its store appends: a slow
+// or throttled DynamoDB write holds up every post on it until it succeeds
+// or its retries run out.
+func (s *Server) Post(msg Message) (Message, error) {
+	if msg.Direct() {
+		room, participants, err := conversation(msg.Username, msg.To)
+		if err != nil {
+			return Message{}, err
+		}
+		msg.Room, msg.To = room, participants
+	} else if msg.Room == "" {
+		msg.Room = DefaultRoom
+	} else if !validRoom(msg.Room) {
+		// Only conversation names its members' direct messages, so a
+		// message naming a conversation as its room is refused.
+		return Message{}, ErrInvalidRoom
+	}
+	if msg.ReplyTo != "" {
+		parent, err := s.Store.Get(msg.Room, msg.ReplyTo)
+		if errors.Is(err, ErrNotFound) || err == nil && parent.Deleted {
+			return Message{}, ErrInvalidReply
+		}
+		if err != nil {
+			return Message{}, err
+		}
+		if parent.ReplyTo != "" {
+			msg.ReplyTo = parent.ReplyTo
+		}
+	}
+
+	// Stores keep each room in append order and page it by ID, so IDs
+	// must be stored in the order they are assigned.
+	s.posting.Lock()
+	msg.ID = s.IDs.New()
+	msg.CreatedAt, _ = idTime(msg.ID)
+	msg.EditedAt, msg.Deleted, msg.Reactions = nil, false, nil
+	err := s.Store.Append(msg)
+	s.posting.Unlock()
+	if err != nil {
+		return Message{}, err
+	}
+
+	s.publish(messageEvent(msg))
+	return msg, nil
+}
+
+// ErrForbidden is returned by Edit and Delete when the user is neither the
+// message's author nor a moderator.
+var ErrForbidden = errors.New("not allowed to change this message")
+
+// Edit replaces the content of the message with ID id in room on behalf of
+// username, and broadcasts the edited message to the clients in the room.
+// Deleted messages cannot be edited.
+func (s *Server) Edit(room, id, username, content string) (Message, error) {
+	return s.change(room, id, username, func(msg *Message) {
+		now := time.Now().UTC()
+		msg.Content = content
+		msg.EditedAt = &now
+	})
+}
+
+// Delete removes the content of the message with ID id in room on behalf of
+// username, leaving it marked Deleted in its place in the history, and
+// broadcasts the deleted message to the clients in the room.
+func (s *Server) Delete(room, id, username string) (Message, error) {
+	return s.change(room, id, username, func(msg *Message) {
+		msg.Content = ""
+		msg.Deleted = true
+	})
+}
+
+func (s *Server) change(room, id, username string, apply func(*Message)) (Message, error) {
+	if room == "" {
+		room = DefaultRoom
+	}
+	if !validTarget(room) {
+		return Message{}, ErrInvalidRoom
+	}
+
+	msg, err := s.Store.Get(room, id)
+	if err != nil {
+		return Message{}, err
+	}
+	if msg.Deleted {
+		return Message{}, ErrNotFound
+	}
+	if !s.mayChange(username, msg) {
+		return Message{}, ErrForbidden
+	}
+
+	apply(&msg)
+	if err := s.Store.Update(msg); err != nil {
+		return Message{}, err
+	}
+
+	change := ChangeEdited
+	if msg.Deleted {
+		change = ChangeDeleted
+	}
+	s.publish(updateEvent(msg, change))
+	return msg, nil
+}
+
+// MaxEmojiLength is the longest reaction, in bytes, that React accepts.
+const MaxEmojiLength = 32
+
+// ErrInvalidReaction is returned by React and Unreact when the reaction is
+// not a short run of printable characters, or no user is reacting.
+var ErrInvalidReaction = errors.New("invalid reaction")
+
+// React adds username's reaction emoji to the message with ID id in room,
+// and broadcasts the message to the clients in the room. Reacting twice
+// with the same emoji has no further effect. Deleted messages cannot be
+// reacted to.
+func (s *Server) React(room, id, username, emoji string) (Message, error) {
+	return s.react(room, id, username, emoji, s.Store.AddReaction)
+}
+
+// Unreact removes username's reaction emoji from the message with ID id in
+// room, and broadcasts the message to the clients in the room.
+func (s *Server) Unreact(room, id, username, emoji string) (Message, error) {
+	return s.react(room, id, username, emoji, s.Store.RemoveReaction)
+}
+
+func (s *Server) react(room, id, username, emoji string, apply func(room, id, emoji, username string) (Message, error)) (Message, error) {
+	if room == "" {
+		room = DefaultRoom
+	}
+	if !validTarget(room) {
+		return Message{}, ErrInvalidRoom
+	}
+	if username == "" || !validEmoji(emoji) {
+		return Message{}, ErrInvalidReaction
+	}
+
+	msg, err := apply(room, id, emoji, username)
+	if err != nil {
+		return Message{}, err
+	}
+
+	s.publish(updateEvent(msg, ChangeReacted))
+	return msg, nil
+}
+
+// validEmoji reports whether emoji is short and has no spaces or control
+// characters. Anything else is allowed, since an emoji may be several code
+// points long.
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > MaxEmojiLength || !utf8.ValidString(emoji) {
+		return false
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// mayChange reports whether username may edit or delete msg: it must be the
+// author or, if the server authenticates users, a moderator.
+func (s *Server) mayChange(username string, msg Message) bool {
+	if username == "" {
+		return false
+	}
+	return username == msg.Username || s.Auth != nil && s.Auth.IsModerator(username)
+}
+
+// Observe makes the server call observer with every event it publishes,
+// such as a message posted through it, before the event is delivered.
+// Events published by other replicas are not observed, so however many
+// replicas run, each event is observed once, and nor are the repeated
+// presence announcements that keep users online. Observe must be called
+// before the server starts handling requests, and observer must not block
+// for long, since it holds up whoever published the event.
+func (s *Server) Observe(observer func(Event)) {
+	s.observers = append(s.observers, observer)
+}
+
+// publish hands event to the observers, then broadcasts it.
+func (s *Server) publish(event Event) {
+	for _, observer := range s.observers {
+		observer(event)
+	}
+	s.broadcast(event)
+}
+
+// broadcast delivers event through the bus if one is attached, and straight
+// to the local hub otherwise. If publishing fails the event is still
+// delivered locally; other replicas will only see messages in the history.
+func (s *Server) broadcast(event Event) {
+	if s.bus != nil {
+		err := s.bus.Publish(event)
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to publish %s event: %v", event.Type, err)
+	}
+
+	s.deliver(event)
+}
+
+// deliver hands a published event to the hub. Presence events only update
+// the roster unless they change whether the user is online.
+func (s *Server) deliver(event Event) {
+	if event.Type == EventPresence {
+		var changed bool
+		if event, changed = s.presence.apply(event); !changed {
+			return
+		}
+	}
+	s.Hub.Publish(event)
+}
@@ -0,0 +1,85 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestServerConcurrentSendAndHistory sends messages from many goroutines
+// while others read the history and long-poll. Run it with -race.
+func TestServerConcurrentSendAndHistory(t *testing.T) {
+	const (
+		senders    = 8
+		perSender  = 50
+		historians = 4
+	)
+	s := NewServer(NewMemoryStore())
+	go s.Run()
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < historians; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				w := httptest.NewRecorder()
+				s.HandlePastMessages(w, httptest.NewRequest(http.MethodGet, "/past_messages", nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("past_messages: status %d", w.Code)
+					return
+				}
+			}
+		}()
+	}
+
+	var sending sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		sending.Add(1)
+		go func(i int) {
+			defer sending.Done()
+			for j := 0; j < perSender; j++ {
+				body := fmt.Sprintf(`{"username":"%d","content":"%d"}`, i, j)
+				w := httptest.NewRecorder()
+				s.HandleSend(w, httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(body)))
+				if w.Code != http.StatusOK {
+					t.Errorf("send: status %d", w.Code)
+					return
+				}
+			}
+		}(i)
+	}
+	sending.Wait()
+	close(stop)
+	readers.Wait()
+
+	w := httptest.NewRecorder()
+	s.HandlePastMessages(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/past_messages?limit=%d", MaxPageSize), nil))
+	var messages []Message
+	if err := json.NewDecoder(w.Body).Decode(&messages); err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != senders*perSender {
+		t.Fatalf("got %d messages, want %d", len(messages), senders*perSender)
+	}
+	seen := make(map[string]bool)
+	for i, message := range messages {
+		if seen[message.ID] {
+			t.Fatalf("duplicate ID %s", message.ID)
+		}
+		seen[message.ID] = true
+		if i > 0 && message.ID <= messages[i-1].ID {
+			t.Fatalf("IDs out of order: %s after %s", message.ID, messages[i-1].ID)
+		}
+	}
+}
@@ -0,0 +1,765 @@
+package chat
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxSMSLength is the most characters of a chat message texted to a phone,
+// including the sender's name. Longer messages are cut short; carriers
+// split anything over 160 characters into several segments anyway.
+const MaxSMSLength = 1600
+
+// SMSSubscriptionPath is where the SMS bridge serves HandleSubscription.
+const SMSSubscriptionPath = "/sms/subscription"
+
+// Errors returned by the SMS bridge.
+var (
+	// ErrInvalidPhone is returned for a phone number not in E.164 form,
+	// such as +14155550100.
+	ErrInvalidPhone = errors.New("invalid phone number")
+	// ErrSMSOptedOut is returned, possibly wrapped, by an SMSSender asked
+	// to text a number that has opted out with the carrier.
+	ErrSMSOptedOut = errors.New("phone number opted out")
+)
+
+// SMSSubscriber is a phone number registered with the SMS bridge. Once the
+// number is verified, texts from it are posted to Room as Username, and
+// messages posted to Room by other users are texted to it unless it has
+// opted out.
+type SMSSubscriber struct {
+	Phone    string `json:"phone"`               // E.164, e.g. +14155550100
+	Username string `json:"username"`            // User texts are posted as
+	Room     string `json:"room"`                // Room texted to and from
+	OptedOut bool   `json:"opted_out,omitempty"` // Texted STOP and not START since
+	Verified bool   `json:"verified"`            // Confirmed with a texted code
+
+	// Code is the confirmation code texted to a number not yet verified,
+	// CodeSentAt when it was texted and Attempts the number of wrong codes
+	// given for it. None of them is shown to clients.
+	Code       string     `json:"code,omitempty"`
+	CodeSentAt *time.Time `json:"code_sent_at,omitempty"`
+	Attempts   int        `json:"attempts,omitempty"`
+}
+
+// withoutCode returns a copy of s fit to show its user.
+func (s SMSSubscriber) withoutCode() SMSSubscriber {
+	s.Code, s.CodeSentAt, s.Attempts = "", nil, 0
+	return s
+}
+
+// pending reports whether s is waiting, at now, for the code texted to it.
+func (s SMSSubscriber) pending(now time.Time) bool {
+	return s.Code != "" && s.CodeSentAt != nil && now.Before(s.CodeSentAt.Add(smsCodeTTL))
+}
+
+// SMSRegistry persists the phone numbers registered with the SMS bridge.
+type SMSRegistry interface {
+	// Subscriber returns the subscriber with phone number phone, or
+	// ErrNotFound.
+	Subscriber(phone string) (SMSSubscriber, error)
+	// Subscribers returns the subscribers to room, sorted by phone number.
+	Subscribers(room string) ([]SMSSubscriber, error)
+	// Put adds subscriber, replacing any with the same phone number.
+	Put(subscriber SMSSubscriber) error
+	// Remove removes the subscriber with phone number phone, if any.
+	Remove(phone string) error
+}
+
+// MemorySMSRegistry keeps subscribers in process memory. They are lost on
+// restart.
+type MemorySMSRegistry struct {
+	mutex       sync.Mutex
+	subscribers smsSubscribers
+}
+
+// NewMemorySMSRegistry returns a MemorySMSRegistry with no subscribers.
+func NewMemorySMSRegistry() *MemorySMSRegistry {
+	return &MemorySMSRegistry{subscribers: make(smsSubscribers)}
+}
+
+func (r *MemorySMSRegistry) Subscriber(phone string) (SMSSubscriber, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.subscribers.get(phone)
+}
+
+func (r *MemorySMSRegistry) Subscribers(room string) ([]SMSSubscriber, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.subscribers.in(room), nil
+}
+
+func (r *MemorySMSRegistry) Put(subscriber SMSSubscriber) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.subscribers[subscriber.Phone] = subscriber
+	return nil
+}
+
+func (r *MemorySMSRegistry) Remove(phone string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.subscribers, phone)
+	return nil
+}
+
+// FileSMSRegistry keeps subscribers in memory and mirrors them to a JSON
+// file, which is rewritten after every change. The file holds an object
+// mapping each phone number to its SMSSubscriber.
+type FileSMSRegistry struct {
+	mutex       sync.Mutex
+	path        string
+	subscribers smsSubscribers
+}
+
+// NewFileSMSRegistry returns a FileSMSRegistry backed by the file at path,
+// loading any subscribers it already contains. A missing or empty file
+// holds none.
+func NewFileSMSRegistry(path string) (*FileSMSRegistry, error) {
+	r := &FileSMSRegistry{path: path, subscribers: make(smsSubscribers)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) || err == nil && len(data) == 0 {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &r.subscribers); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *FileSMSRegistry) Subscriber(phone string) (SMSSubscriber, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.subscribers.get(phone)
+}
+
+func (r *FileSMSRegistry) Subscribers(room string) ([]SMSSubscriber, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.subscribers.in(room), nil
+}
+
+func (r *FileSMSRegistry) Put(subscriber SMSSubscriber) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	previous, existed := r.subscribers[subscriber.Phone]
+	r.subscribers[subscriber.Phone] = subscriber
+	if err := r.save(); err != nil {
+		// Keep memory and the file in step.
+		if existed {
+			r.subscribers[subscriber.Phone] = previous
+		} else {
+			delete(r.subscribers, subscriber.Phone)
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *FileSMSRegistry) Remove(phone string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	previous, existed := r.subscribers[phone]
+	if !existed {
+		return nil
+	}
+	delete(r.subscribers, phone)
+	if err := r.save(); err != nil {
+		r.subscribers[phone] = previous
+		return err
+	}
+	return nil
+}
+
+// save writes the subscribers to the file. The caller must hold the mutex.
+func (r *FileSMSRegistry) save() error {
+	data, err := json.MarshalIndent(r.subscribers, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(r.path, data)
+}
+
+// smsSubscribers maps phone numbers to their subscribers. It is shared by
+// MemorySMSRegistry and FileSMSRegistry, which guard it with their own
+// mutex.
+type smsSubscribers map[string]SMSSubscriber
+
+func (s smsSubscribers) get(phone string) (SMSSubscriber, error) {
+	subscriber, ok := s[phone]
+	if !ok {
+		return SMSSubscriber{}, ErrNotFound
+	}
+	return subscriber, nil
+}
+
+func (s smsSubscribers) in(room string) []SMSSubscriber {
+	var subscribers []SMSSubscriber
+	for _, subscriber := range s {
+		if subscriber.Room == room {
+			subscribers = append(subscribers, subscriber)
+		}
+	}
+	sort.Slice(subscribers, func(i, j int) bool { return subscribers[i].Phone < subscribers[j].Phone })
+	return subscribers
+}
+
+// e164 matches phone numbers in E.164 form, which is how Twilio sends them.
+var e164 = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// normalizePhone returns phone in E.164 form, without the spaces, dashes,
+// dots and parentheses people write phone numbers with, or ErrInvalidPhone.
+func normalizePhone(phone string) (string, error) {
+	phone = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" -.()", r) {
+			return -1
+		}
+		return r
+	}, phone)
+	if !e164.MatchString(phone) {
+		return "", ErrInvalidPhone
+	}
+	return phone, nil
+}
+
+// SMSSender sends text messages.
+type SMSSender interface {
+	// SendSMS texts body to the phone number to.
+	SendSMS(to, body string) error
+}
+
+// DefaultTwilioAPIURL is the base URL of Twilio's REST API.
+const DefaultTwilioAPIURL = "https://api.twilio.com"
+
+// twilioCodeUnsubscribed is the Twilio error code for a recipient that
+// has texted STOP to the sending number.
+const twilioCodeUnsubscribed = 21610
+
+// TwilioSMS is an SMSSender that sends through Twilio's Messages API.
+type TwilioSMS struct {
+	AccountSID string
+	AuthToken  string
+	From       string       // Twilio phone number texts are sent from
+	APIURL     string       // Base URL of the API, DefaultTwilioAPIURL if empty
+	Client     *http.Client // http.DefaultClient if nil
+}
+
+// TwilioError is returned by TwilioSMS when Twilio refuses a message.
+type TwilioError struct {
+	Status  int    `json:"status"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *TwilioError) Error() string {
+	return fmt.Sprintf("twilio: %s (error %d, status %d)", e.Message, e.Code, e.Status)
+}
+
+// Unwrap makes a refusal to text an unsubscribed number match
+// ErrSMSOptedOut.
+func (e *TwilioError) Unwrap() error {
+	if e.Code == twilioCodeUnsubscribed {
+		return ErrSMSOptedOut
+	}
+	return nil
+}
+
+func (t *TwilioSMS) SendSMS(to, body string) error {
+	apiURL := t.APIURL
+	if apiURL == "" {
+		apiURL = DefaultTwilioAPIURL
+	}
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	form := url.Values{"To": {to}, "From": {t.From}, "Body": {body}}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(apiURL, "/")+"/2010-04-01/Accounts/"+url.PathEscape(t.AccountSID)+"/Messages.json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	twilioErr := &TwilioError{Status: resp.StatusCode}
+	if json.NewDecoder(resp.Body).Decode(twilioErr) != nil || twilioErr.Message == "" {
+		twilioErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return twilioErr
+}
+
+// smsOutboxSize is how many messages may wait to be texted. Messages posted
+// while the outbox is full are not texted.
+const smsOutboxSize = 100
+
+// smsKeywords maps the keywords texted to opt out of messages to true and
+// those texted to opt back in to false, as Twilio's default opt-out
+// handling understands them.
+var smsKeywords = map[string]bool{
+	"STOP": true, "STOPALL": true, "STOP ALL": true, "UNSUBSCRIBE": true, "CANCEL": true,
+	"END": true, "QUIT": true, "OPTOUT": true, "REVOKE": true,
+	"START": false, "YES": false, "UNSTOP": false,
+}
+
+// SMSBridge connects phone numbers to chat rooms. Messages posted to a room
+// are texted, prefixed with their author's name, to the numbers registered
+// to it, except the author's own. Texts to the bridge's number, forwarded
+// by Twilio to HandleSMS, are posted to the sender's room as the user the
+// number is registered to.
+type SMSBridge struct {
+	Server   *Server
+	Registry SMSRegistry
+	Sender   SMSSender
+
+	// AuthToken makes HandleSMS reject requests that do not carry Twilio's
+	// signature made with this auth token, so that only Twilio can post
+	// texts. Without it HandleSMS rejects every request, unless
+	// AllowUnsigned is set.
+	AuthToken string
+
+	// AllowUnsigned makes HandleSMS accept any request when AuthToken is
+	// empty, so that anyone can post texts as any registered number. It is
+	// meant for trying the bridge out locally.
+	AllowUnsigned bool
+
+	// PublicURL is the scheme and host Twilio reaches the bridge at, such
+	// as https://chat.ngrok.app, against which signatures are checked. If
+	// empty it is taken from the request's Host header and, through
+	// isHTTPS, its X-Forwarded-Proto header, which an ngrok edge passes
+	// through and sets. Set it if a proxy rewrites the host.
+	PublicURL string
+
+	outbox     chan Message
+	codeMutex  sync.Mutex
+	codeLimits map[string]*rateLimiter // By "user " + username and "phone " + number
+}
+
+// NewSMSBridge returns an SMSBridge that texts the messages posted through
+// server to the subscribers in registry using sender. It must be created
+// before the server starts handling requests.
+//
+// If sender is a Dispatcher's SMS, texts are queued and retried by the
+// dispatcher, and numbers are only marked as opted out when they text STOP
+// to the bridge, not when the carrier refuses them.
+func NewSMSBridge(server *Server, registry SMSRegistry, sender SMSSender) *SMSBridge {
+	b := &SMSBridge{
+		Server:     server,
+		Registry:   registry,
+		Sender:     sender,
+		outbox:     make(chan Message, smsOutboxSize),
+		codeLimits: make(map[string]*rateLimiter),
+	}
+	server.Observe(b.observe)
+	go b.run()
+	return b
+}
+
+// observe queues the messages posted to rooms to be texted. Direct messages
+// stay off the phone.
+func (b *SMSBridge) observe(event Event) {
+	if event.Type != EventMessage || event.Message.Direct() {
+		return
+	}
+	select {
+	case b.outbox <- *event.Message:
+	default:
+		log.Printf("SMS outbox full, not texting message %s", event.Message.ID)
+	}
+}
+
+func (b *SMSBridge) run() {
+	for msg := range b.outbox {
+		b.text(msg)
+	}
+}
+
+// text sends msg to the subscribers to its room. Numbers the carrier
+// reports as opted out are marked so, as if they had texted STOP.
+func (b *SMSBridge) text(msg Message) {
+	subscribers, err := b.Registry.Subscribers(msg.Room)
+	if err != nil {
+		log.Printf("Failed to look up SMS subscribers to %s: %v", msg.Room, err)
+		return
+	}
+
+	body := smsBody(msg)
+	for _, subscriber := range subscribers {
+		if subscriber.OptedOut || !subscriber.Verified || subscriber.Username == msg.Username {
+			continue
+		}
+		err := b.Sender.SendSMS(subscriber.Phone, body)
+		if errors.Is(err, ErrSMSOptedOut) {
+			subscriber.OptedOut = true
+			if err := b.Registry.Put(subscriber); err != nil {
+				log.Printf("Failed to opt %s out of SMS: %v", subscriber.Phone, err)
+			}
+		} else if err != nil {
+			log.Printf("Failed to text message %s to %s: %v", msg.ID, subscriber.Phone, err)
+		}
+	}
+}
+
+// smsBody returns the text msg is texted as, at most MaxSMSLength
+// characters long.
+func smsBody(msg Message) string {
+	body := msg.Username + ": " + msg.Content
+	if utf8.RuneCountInString(body) <= MaxSMSLength {
+		return body
+	}
+	return string([]rune(body)[:MaxSMSLength-1]) + "…"
+}
+
+// HandleSMS receives the texts Twilio forwards to the bridge's number, as
+// form posts with From and Body fields, and answers with TwiML. Requests
+// without a valid X-Twilio-Signature are rejected with 403 Forbidden, as
+// are all requests if AuthToken is empty and AllowUnsigned is not set. A
+// text from a verified number is posted to its room; STOP and START, and
+// their synonyms, opt the number out of and back into receiving messages.
+// Twilio confirms these itself, so they get an empty answer. Texts from
+// other numbers are answered with a note that the number is not registered
+// or not yet verified.
+func (b *SMSBridge) HandleSMS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+	switch {
+	case b.AuthToken == "" && !b.AllowUnsigned:
+		log.Printf("Rejected SMS webhook from %s: no Twilio auth token configured", remoteAddr(r))
+		WriteError(w, http.StatusForbidden, CodeForbidden, "SMS webhook not configured")
+		return
+	case b.AuthToken != "":
+		webhookURL := b.webhookURL(r)
+		if reason := checkTwilioSignature(b.AuthToken, webhookURL, r.PostForm, r.Header.Get(TwilioSignatureHeader)); reason != "" {
+			log.Printf("Rejected SMS webhook to %s from %s: %s", webhookURL, remoteAddr(r), reason)
+			WriteError(w, http.StatusForbidden, CodeForbidden, "Invalid Twilio signature")
+			return
+		}
+	}
+
+	from, body := r.PostForm.Get("From"), strings.TrimSpace(r.PostForm.Get("Body"))
+	if from == "" {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Missing sender")
+		return
+	}
+	subscriber, err := b.Registry.Subscriber(from)
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("Ignoring SMS from unregistered number %s", from)
+		writeTwiML(w, "This number is not registered with the chat.")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up SMS subscriber %s: %v", from, err)
+		WriteStoreError(w, err, "Failed to look up sender")
+		return
+	}
+
+	optOut, isKeyword := smsKeywords[strings.ToUpper(body)]
+	switch {
+	case isKeyword:
+		subscriber.OptedOut = optOut
+		if err := b.Registry.Put(subscriber); err != nil {
+			log.Printf("Failed to update SMS subscriber %s: %v", from, err)
+			WriteStoreError(w, err, "Failed to update subscription")
+			return
+		}
+		writeTwiML(w, "")
+	case body == "":
+		writeTwiML(w, "")
+	case !subscriber.Verified:
+		writeTwiML(w, "This number is not verified yet. Enter the code texted to it in the chat first.")
+	default:
+		if _, err := b.Server.Post(Message{Username: subscriber.Username, Room: subscriber.Room, Content: body}); err != nil {
+			log.Printf("Failed to post SMS from %s: %v", from, err)
+			writeTwiML(w, "Your message could not be posted. Please try again later.")
+			return
+		}
+		writeTwiML(w, "")
+	}
+}
+
+// webhookURL returns the URL Twilio sent r to, and signed: PublicURL, or
+// the scheme and host r was sent to, followed by r's path and query.
+func (b *SMSBridge) webhookURL(r *http.Request) string {
+	base := strings.TrimSuffix(b.PublicURL, "/")
+	if base == "" {
+		base = "http://" + r.Host
+		if isHTTPS(r) {
+			base = "https://" + r.Host
+		}
+	}
+	return base + r.URL.RequestURI()
+}
+
+// TwilioSignatureHeader carries Twilio's signature of a webhook request.
+const TwilioSignatureHeader = "X-Twilio-Signature"
+
+// twilioSignature returns Twilio's signature of a webhook request to
+// webhookURL with the form parameters params: the base64 HMAC-SHA1, keyed
+// by the auth token, of the URL followed by every parameter's name and
+// value, sorted by name.
+func twilioSignature(authToken, webhookURL string, params url.Values) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mac := hmac.New(sha1.New, []byte(authToken))
+	io.WriteString(mac, webhookURL)
+	for _, name := range names {
+		values := append([]string(nil), params[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			io.WriteString(mac, name+value)
+		}
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkTwilioSignature returns why signature is not Twilio's signature of a
+// request to webhookURL with params, or "" if it is. Twilio signs some URLs
+// with the port and some without, so a URL with a port is also checked
+// without it and a URL without one with its scheme's default port.
+func checkTwilioSignature(authToken, webhookURL string, params url.Values, signature string) string {
+	if signature == "" {
+		return "no " + TwilioSignatureHeader + " header"
+	}
+	candidates := []string{webhookURL}
+	if u, err := url.Parse(webhookURL); err == nil {
+		if u.Port() != "" {
+			u.Host = u.Hostname()
+		} else if u.Scheme == "https" {
+			u.Host += ":443"
+		} else {
+			u.Host += ":80"
+		}
+		candidates = append(candidates, u.String())
+	}
+	for _, candidate := range candidates {
+		if hmac.Equal([]byte(twilioSignature(authToken, candidate, params)), []byte(signature)) {
+			return ""
+		}
+	}
+	return "signature does not match"
+}
+
+// remoteAddr returns the address r came from, as the X-Forwarded-For
+// header set by a proxy such as an ngrok edge tells it if present.
+func remoteAddr(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return forwarded
+	}
+	return r.RemoteAddr
+}
+
+// writeTwiML answers a Twilio webhook, texting message back to the sender
+// unless it is empty.
+func writeTwiML(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "text/xml")
+	response := struct {
+		XMLName xml.Name `xml:"Response"`
+		Message string   `xml:"Message,omitempty"`
+	}{Message: message}
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(response); err != nil {
+		log.Println("Error writing TwiML:", err)
+	}
+}
+
+// maxSMSCodeAttempts is how many wrong confirmation codes may be given for
+// a number before its code is discarded and a new one must be texted.
+const maxSMSCodeAttempts = 5
+
+// smsCodeTTL is how long a texted confirmation code is valid. Until it
+// expires, the number cannot be claimed by another user.
+const smsCodeTTL = 10 * time.Minute
+
+// smsCodeRate limits how many confirmation codes HandleSubscription texts
+// for each user and to each number, so that nobody can have the bridge
+// text numbers at will. Each replica counts separately.
+var smsCodeRate = RateLimit{Count: 5, Per: time.Hour}
+
+// allowCode reports whether a confirmation code may be texted to phone for
+// username at now, taking it from both of their limits if so.
+func (b *SMSBridge) allowCode(username, phone string, now time.Time) bool {
+	b.codeMutex.Lock()
+	defer b.codeMutex.Unlock()
+
+	limiter := func(key string) *rateLimiter {
+		l, ok := b.codeLimits[key]
+		if !ok {
+			l = newRateLimiter(smsCodeRate)
+			b.codeLimits[key] = l
+		}
+		return l
+	}
+	return limiter("user "+username).allow(now) && limiter("phone "+phone).allow(now)
+}
+
+// HandleSubscription registers a phone number with the bridge for the
+// authenticated user; other requests are refused with 401 Unauthorized.
+// A PUT of the JSON body {"phone": "+14155550100", "room": "general"}
+// texts a confirmation code to the number and answers with the resulting
+// SMSSubscriber, which is not verified and receives nothing until the code
+// is sent back in another PUT, {"phone": "...", "code": "123456"}. A number
+// that is already verified only moves to the room. The room defaults to
+// DefaultRoom. A number stays opted out if it was, until it texts START.
+// DELETE removes the number in the body {"phone": "..."}. Numbers belong to
+// the user who verified them, and only they may change them; a number not
+// verified yet may be claimed by anyone who can receive its code, once the
+// code texted for someone else has expired. Each user, and each number, is
+// texted a limited number of codes, beyond which the request is refused
+// with 429 Too Many Requests.
+func (b *SMSBridge) HandleSubscription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodPut, http.MethodDelete)
+		return
+	}
+	username, ok := User(r)
+	if !ok {
+		WriteError(w, http.StatusUnauthorized, CodeUnauthorized, "Login required")
+		return
+	}
+
+	var body SMSSubscriber
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+	phone, err := normalizePhone(body.Phone)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidPhone, "Phone numbers must be in international form, e.g. +14155550100")
+		return
+	}
+	if body.Room == "" {
+		body.Room = DefaultRoom
+	}
+	if !validRoom(body.Room) {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRoom, "Invalid room")
+		return
+	}
+
+	existing, err := b.Registry.Subscriber(phone)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("Failed to look up SMS subscriber %s: %v", phone, err)
+		WriteStoreError(w, err, "Failed to look up phone number")
+		return
+	}
+	registered := err == nil
+	now := time.Now()
+	if registered && existing.Username != username && (existing.Verified || existing.pending(now) || r.Method == http.MethodDelete) {
+		WriteError(w, http.StatusConflict, CodePhoneTaken, "Phone number registered to another user")
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if !registered {
+			WriteError(w, http.StatusNotFound, CodeNotFound, "Phone number not registered")
+			return
+		}
+		if err := b.Registry.Remove(phone); err != nil {
+			log.Printf("Failed to remove SMS subscriber %s: %v", phone, err)
+			WriteStoreError(w, err, "Failed to remove phone number")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	subscriber := SMSSubscriber{Phone: phone, Username: username, Room: body.Room, OptedOut: existing.OptedOut}
+	switch {
+	case registered && existing.Username == username && existing.Verified:
+		subscriber.Verified = true
+	case body.Code != "":
+		if !registered || existing.Username != username || !existing.pending(now) {
+			WriteError(w, http.StatusBadRequest, CodeInvalidCode, "No confirmation code was texted to this number; register it again")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(body.Code), []byte(existing.Code)) != 1 {
+			existing.Attempts++
+			if existing.Attempts >= maxSMSCodeAttempts {
+				existing.Code, existing.Attempts = "", 0
+			}
+			if err := b.Registry.Put(existing); err != nil {
+				log.Printf("Failed to update SMS subscriber %s: %v", phone, err)
+			}
+			WriteError(w, http.StatusBadRequest, CodeInvalidCode, "Wrong confirmation code")
+			return
+		}
+		subscriber.Verified = true
+	default:
+		if !b.allowCode(username, phone, now) {
+			w.Header().Set("Retry-After", strconv.Itoa(int((smsCodeRate.Per / time.Duration(smsCodeRate.Count)).Seconds())))
+			WriteError(w, http.StatusTooManyRequests, CodeRateLimited, "Too many confirmation codes requested; try again later")
+			return
+		}
+		code, err := rand.Int(rand.Reader, big.NewInt(1000000))
+		if err != nil {
+			WriteError(w, http.StatusInternalServerError, CodeInternal, "Failed to make a confirmation code")
+			return
+		}
+		sentAt := now.UTC()
+		subscriber.Code, subscriber.CodeSentAt = fmt.Sprintf("%06d", code), &sentAt
+	}
+
+	if err := b.Registry.Put(subscriber); err != nil {
+		log.Printf("Failed to register SMS subscriber %s: %v", phone, err)
+		WriteStoreError(w, err, "Failed to register phone number")
+		return
+	}
+	if subscriber.Code != "" {
+		if err := b.Sender.SendSMS(phone, "Your chat confirmation code is "+subscriber.Code+"."); err != nil {
+			log.Printf("Failed to text a confirmation code to %s: %v", phone, err)
+			WriteError(w, http.StatusBadGateway, CodeUnavailable, "Failed to text the confirmation code")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, subscriber.withoutCode())
+}
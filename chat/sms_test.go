@@ -0,0 +1,449 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTwilio plays Twilio's part in the SMS bridge: it accepts messages on
+// the Messages API and forwards texts to the bridge's webhook.
+type fakeTwilio struct {
+	*httptest.Server
+	sent chan url.Values
+
+	mutex        sync.Mutex
+	unsubscribed map[string]bool // Numbers that texted STOP to the carrier
+}
+
+const (
+	testAccountSID = "AC0123456789abcdef0123456789abcdef"
+	testAuthToken  = "token"
+	testSMSNumber  = "+15005550006"
+)
+
+func startFakeTwilio(t *testing.T) *fakeTwilio {
+	f := &fakeTwilio{sent: make(chan url.Values, 10), unsubscribed: make(map[string]bool)}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sid, token, _ := r.BasicAuth()
+		if r.Method != http.MethodPost || r.URL.Path != "/2010-04-01/Accounts/"+testAccountSID+"/Messages.json" || sid != testAccountSID || token != testAuthToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(TwilioError{Status: http.StatusUnauthorized, Code: 20003, Message: "Authenticate"})
+			return
+		}
+		r.ParseForm()
+		f.mutex.Lock()
+		unsubscribed := f.unsubscribed[r.PostForm.Get("To")]
+		f.mutex.Unlock()
+		if unsubscribed {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(TwilioError{Status: http.StatusBadRequest, Code: twilioCodeUnsubscribed, Message: "Attempt to send to unsubscribed recipient"})
+			return
+		}
+		f.sent <- r.PostForm
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"sid": "SM0123", "status": "queued"}`))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// next returns the next message sent through the fake.
+func (f *fakeTwilio) next(t *testing.T) (to, body string) {
+	t.Helper()
+	select {
+	case sent := <-f.sent:
+		if sent.Get("From") != testSMSNumber {
+			t.Errorf("text sent from %q, want %q", sent.Get("From"), testSMSNumber)
+		}
+		return sent.Get("To"), sent.Get("Body")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a text")
+		return "", ""
+	}
+}
+
+// text forwards a text from the phone number from to webhook the way
+// Twilio does, signed, and returns the TwiML answer.
+func (f *fakeTwilio) text(t *testing.T, webhook, from, body string) string {
+	t.Helper()
+	form := url.Values{"From": {from}, "To": {testSMSNumber}, "Body": {body}, "AccountSid": {testAccountSID}}
+	req, _ := http.NewRequest(http.MethodPost, webhook, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(TwilioSignatureHeader, twilioSignature(testAuthToken, webhook, form))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/xml" {
+		t.Errorf("webhook answered %d %s: %s", resp.StatusCode, resp.Header.Get("Content-Type"), answer)
+	}
+	return string(answer)
+}
+
+func TestSMSBridge(t *testing.T) {
+	twilio := startFakeTwilio(t)
+	s := NewServer(NewMemoryStore())
+	registry := NewMemorySMSRegistry()
+	bridge := NewSMSBridge(s, registry, SMSConfig{From: testSMSNumber, AccountSID: testAccountSID, AuthToken: testAuthToken, APIURL: twilio.URL}.TwilioSMS())
+	bridge.AuthToken = testAuthToken
+	s.Auth = NewAuthenticator(testKey, StaticUsers{})
+	go s.Run()
+	mux := http.NewServeMux()
+	s.Register(mux)
+	mux.HandleFunc("/sms", bridge.HandleSMS)
+	mux.Handle(SMSSubscriptionPath, s.Authenticate(http.HandlerFunc(bridge.HandleSubscription)))
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	// subscribe sends a request to HandleSubscription as username, or
+	// without logging in if username is empty.
+	subscribe := func(method, username, body string) (int, SMSSubscriber) {
+		req, _ := http.NewRequest(method, ts.URL+SMSSubscriptionPath, strings.NewReader(body))
+		if username != "" {
+			token, _ := s.Auth.Issue(username)
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var subscriber SMSSubscriber
+		json.NewDecoder(resp.Body).Decode(&subscriber)
+		return resp.StatusCode, subscriber
+	}
+	// code returns the confirmation code texted to phone.
+	code := func(phone string) string {
+		t.Helper()
+		to, body := twilio.next(t)
+		code := strings.TrimSuffix(strings.TrimPrefix(body, "Your chat confirmation code is "), ".")
+		if to != phone || len(code) != 6 {
+			t.Fatalf("texted %q to %s, want a confirmation code to %s", body, to, phone)
+		}
+		return code
+	}
+
+	const ann, bob = "+14155550100", "+14155550101"
+	if status, _ := subscribe(http.MethodPut, "", `{"username":"ann","phone":"`+ann+`"}`); status != http.StatusUnauthorized {
+		t.Errorf("subscribing without logging in: status %d, want 401", status)
+	}
+	if status, subscriber := subscribe(http.MethodPut, "ann", `{"username":"mallory","phone":"+1 (415) 555-0100"}`); status != http.StatusOK || subscriber != (SMSSubscriber{Phone: ann, Username: "ann", Room: DefaultRoom}) {
+		t.Fatalf("subscribing ann: status %d, %+v", status, subscriber)
+	}
+	annCode := code(ann)
+
+	// Until it is verified the number gets nothing, and its texts are not
+	// posted.
+	s.Post(Message{Username: "carol", Content: "too early"})
+	if answer := twilio.text(t, ts.URL+"/sms", ann, "hi"); !strings.Contains(answer, "<Message>This number is not verified") {
+		t.Errorf("text from an unverified number answered %s", answer)
+	}
+	if status, _ := subscribe(http.MethodPut, "mallory", `{"phone":"`+ann+`","code":"`+annCode+`"}`); status != http.StatusConflict {
+		t.Errorf("mallory confirming ann's code: status %d, want 409", status)
+	}
+	wrong := "000000"
+	if annCode == wrong {
+		wrong = "000001"
+	}
+	if status, subscriber := subscribe(http.MethodPut, "ann", `{"phone":"`+ann+`","code":"`+wrong+`"}`); status != http.StatusBadRequest || subscriber.Verified {
+		t.Errorf("wrong code: status %d, %+v", status, subscriber)
+	}
+	if status, subscriber := subscribe(http.MethodPut, "ann", `{"phone":"`+ann+`","code":"`+annCode+`"}`); status != http.StatusOK || subscriber != (SMSSubscriber{Phone: ann, Username: "ann", Room: DefaultRoom, Verified: true}) {
+		t.Fatalf("confirming ann: status %d, %+v", status, subscriber)
+	}
+
+	subscribe(http.MethodPut, "bob", `{"phone":"`+bob+`"}`)
+	subscribe(http.MethodPut, "bob", `{"phone":"`+bob+`","code":"`+code(bob)+`"}`)
+	if status, _ := subscribe(http.MethodPut, "mallory", `{"phone":"`+ann+`"}`); status != http.StatusConflict {
+		t.Errorf("taking ann's number: status %d, want 409", status)
+	}
+	if status, _ := subscribe(http.MethodPut, "carol", `{"phone":"555-0100"}`); status != http.StatusBadRequest {
+		t.Errorf("subscribing a local number: status %d, want 400", status)
+	}
+
+	// Room messages are texted to both numbers, in order.
+	s.Post(Message{Username: "carol", Content: "hello phones"})
+	for _, want := range []string{ann, bob} {
+		if to, body := twilio.next(t); to != want || body != "carol: hello phones" {
+			t.Errorf("texted %q to %s, want carol's message to %s", body, to, want)
+		}
+	}
+
+	// A text from ann is posted as her and texted only to bob.
+	if answer := twilio.text(t, ts.URL+"/sms", ann, " from my phone "); strings.Contains(answer, "<Message>") {
+		t.Errorf("posting a text answered %s", answer)
+	}
+	if to, body := twilio.next(t); to != bob || body != "ann: from my phone" {
+		t.Errorf("texted %q to %s, want ann's text to bob", body, to)
+	}
+	if messages, _ := s.Store.List(ListQuery{Room: DefaultRoom}); len(messages) != 3 || messages[2].Username != "ann" || messages[2].Content != "from my phone" {
+		t.Errorf("history = %+v, want ann's text last", messages)
+	}
+
+	// After STOP bob gets nothing until START. Ann's texts come first, so
+	// each one is followed by bob's if he is texted at all.
+	twilio.text(t, ts.URL+"/sms", bob, "stop")
+	s.Post(Message{Username: "carol", Content: "one"})
+	s.Post(Message{Username: "bob", Content: "two"})
+	for _, want := range []string{"carol: one", "bob: two"} {
+		if to, body := twilio.next(t); to != ann || body != want {
+			t.Errorf("texted %q to %s, want %q to ann only", body, to, want)
+		}
+	}
+	twilio.text(t, ts.URL+"/sms", bob, "START")
+	s.Post(Message{Username: "ann", Content: "welcome back"})
+	if to, body := twilio.next(t); to != bob || body != "ann: welcome back" {
+		t.Errorf("texted %q to %s, want ann's message to bob", body, to)
+	}
+
+	// A number the carrier has opted out is marked so.
+	twilio.mutex.Lock()
+	twilio.unsubscribed[ann] = true
+	twilio.mutex.Unlock()
+	s.Post(Message{Username: "carol", Content: "anyone?"})
+	if to, _ := twilio.next(t); to != bob {
+		t.Errorf("texted %s, want only bob", to)
+	}
+	if subscriber, _ := registry.Subscriber(ann); !subscriber.OptedOut {
+		t.Errorf("ann after the carrier refused = %+v, want opted out", subscriber)
+	}
+	// Registering again keeps the number opted out.
+	if _, subscriber := subscribe(http.MethodPut, "ann", `{"phone":"`+ann+`","room":"other"}`); !subscriber.OptedOut || !subscriber.Verified || subscriber.Room != "other" {
+		t.Errorf("re-registering ann = %+v", subscriber)
+	}
+
+	if answer := twilio.text(t, ts.URL+"/sms", "+14155550199", "hi"); !strings.Contains(answer, "<Message>This number is not registered") {
+		t.Errorf("text from an unknown number answered %s", answer)
+	}
+
+	if status, _ := subscribe(http.MethodDelete, "mallory", `{"phone":"`+bob+`"}`); status != http.StatusConflict {
+		t.Errorf("removing bob's number as mallory: status %d, want 409", status)
+	}
+	if status, _ := subscribe(http.MethodDelete, "bob", `{"phone":"`+bob+`"}`); status != http.StatusNoContent {
+		t.Errorf("removing bob's number: status %d, want 204", status)
+	}
+	if _, err := registry.Subscriber(bob); err != ErrNotFound {
+		t.Errorf("bob's number after removal: %v, want ErrNotFound", err)
+	}
+
+	// Too many wrong codes use the code up. A number not verified yet can
+	// be claimed by another user, who is texted a new code.
+	const carol = "+14155550102"
+	subscribe(http.MethodPut, "carol", `{"phone":"`+carol+`"}`)
+	carolCode := code(carol)
+	for i := 0; i < maxSMSCodeAttempts; i++ {
+		subscribe(http.MethodPut, "carol", `{"phone":"`+carol+`","code":"wrong"}`)
+	}
+	if status, _ := subscribe(http.MethodPut, "carol", `{"phone":"`+carol+`","code":"`+carolCode+`"}`); status != http.StatusBadRequest {
+		t.Errorf("confirming after too many wrong codes: status %d, want 400", status)
+	}
+	if status, subscriber := subscribe(http.MethodPut, "dave", `{"phone":"`+carol+`"}`); status != http.StatusOK || subscriber.Username != "dave" || subscriber.Verified {
+		t.Errorf("claiming an unverified number: status %d, %+v", status, subscriber)
+	}
+	code(carol)
+}
+
+// countingSMS counts the texts sent to each number.
+type countingSMS struct {
+	mutex sync.Mutex
+	sent  map[string]int
+}
+
+func (c *countingSMS) SendSMS(to, body string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sent[to]++
+	return nil
+}
+
+func TestSMSSubscriptionCodes(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	s.Auth = NewAuthenticator(testKey, StaticUsers{})
+	registry := NewMemorySMSRegistry()
+	sender := &countingSMS{sent: make(map[string]int)}
+	bridge := NewSMSBridge(s, registry, sender)
+	handler := s.Authenticate(http.HandlerFunc(bridge.HandleSubscription))
+
+	subscribe := func(username, phone string) int {
+		req := httptest.NewRequest(http.MethodPut, SMSSubscriptionPath, strings.NewReader(`{"phone":"`+phone+`"}`))
+		token, _ := s.Auth.Issue(username)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	// expire makes the code texted to phone older than smsCodeTTL.
+	expire := func(phone string) {
+		subscriber, err := registry.Subscriber(phone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sentAt := subscriber.CodeSentAt.Add(-smsCodeTTL)
+		subscriber.CodeSentAt = &sentAt
+		registry.Put(subscriber)
+	}
+
+	// Nobody can take over a number waiting for its code, until the code
+	// expires.
+	const ann = "+14155550100"
+	if status := subscribe("ann", ann); status != http.StatusOK {
+		t.Fatalf("subscribing ann: status %d", status)
+	}
+	if status := subscribe("mallory", ann); status != http.StatusConflict {
+		t.Errorf("claiming ann's pending number: status %d, want 409", status)
+	}
+	if subscriber, _ := registry.Subscriber(ann); subscriber.Username != "ann" {
+		t.Errorf("ann's number after mallory's claim = %+v", subscriber)
+	}
+	expire(ann)
+	if status := subscribe("mallory", ann); status != http.StatusOK {
+		t.Errorf("claiming a number whose code expired: status %d, want 200", status)
+	}
+
+	// Each user is texted a limited number of codes, whatever the number.
+	for i := 0; i < smsCodeRate.Count; i++ {
+		if status := subscribe("carol", fmt.Sprintf("+1415555020%d", i)); status != http.StatusOK {
+			t.Fatalf("code %d for carol: status %d", i, status)
+		}
+	}
+	if status := subscribe("carol", "+14155550299"); status != http.StatusTooManyRequests {
+		t.Errorf("one code too many for carol: status %d, want 429", status)
+	}
+
+	// And so is each number, whoever asks.
+	const dave = "+14155550300"
+	for i := 0; i < smsCodeRate.Count; i++ {
+		if status := subscribe(fmt.Sprintf("user%d", i), dave); status != http.StatusOK {
+			t.Fatalf("code %d to %s: status %d", i, dave, status)
+		}
+		expire(dave)
+	}
+	if status := subscribe("dave", dave); status != http.StatusTooManyRequests {
+		t.Errorf("one code too many to %s: status %d, want 429", dave, status)
+	}
+	if sender.sent[dave] != smsCodeRate.Count || sender.sent["+14155550299"] != 0 {
+		t.Errorf("texts sent = %v", sender.sent)
+	}
+}
+
+func TestFileSMSRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sms.json")
+	registry, err := OpenSMSRegistry(SMSConfig{RegistryPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribers := []SMSSubscriber{
+		{Phone: "+14155550101", Username: "bob", Room: DefaultRoom, OptedOut: true, Verified: true},
+		{Phone: "+14155550100", Username: "ann", Room: DefaultRoom, Code: "123456", Attempts: 1},
+		{Phone: "+14155550102", Username: "carol", Room: "other"},
+	}
+	for _, subscriber := range subscribers {
+		if err := registry.Put(subscriber); err != nil {
+			t.Fatal(err)
+		}
+	}
+	registry.Remove("+14155550102")
+
+	reopened, err := NewFileSMSRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := reopened.Subscribers(DefaultRoom)
+	if want := []SMSSubscriber{subscribers[1], subscribers[0]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subscribers after reload = %+v, want %+v", got, want)
+	}
+	if got, _ := reopened.Subscribers("other"); len(got) != 0 {
+		t.Errorf("removed subscriber is back: %+v", got)
+	}
+}
+
+// recordedSMS is a text as Twilio posted it through an ngrok edge to
+// https://chat.ngrok.app/sms, signed with recordedAuthToken.
+const (
+	recordedAuthToken = "c0ffee0ddba11c0ffee0ddba11c0ffee"
+	recordedSignature = "A37aWHvmiOzPDFSTSLb+7sLbs2M="
+	recordedSMS       = "AccountSid=AC0123456789abcdef0123456789abcdef&ApiVersion=2010-04-01&Body=Hello+from+my+phone&From=%2B14155550100&FromCity=SAN+FRANCISCO&FromCountry=US&FromState=CA&FromZip=94105&MessageSid=SM2f4b1c0e8a9d7c6b5a4f3e2d1c0b9a87&NumMedia=0&NumSegments=1&SmsMessageSid=SM2f4b1c0e8a9d7c6b5a4f3e2d1c0b9a87&SmsSid=SM2f4b1c0e8a9d7c6b5a4f3e2d1c0b9a87&SmsStatus=received&To=%2B18669904069&ToCity=&ToCountry=US&ToState=NY&ToZip="
+)
+
+func TestSMSSignature(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	go s.Run()
+	registry := NewMemorySMSRegistry()
+	registry.Put(SMSSubscriber{Phone: "+14155550100", Username: "ann", Room: DefaultRoom, Verified: true})
+	bridge := NewSMSBridge(s, registry, SMSConfig{}.TwilioSMS())
+	bridge.AuthToken = recordedAuthToken
+
+	send := func(target, body string, header http.Header) int {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		bridge.HandleSMS(w, req)
+		return w.Code
+	}
+	viaNgrok := http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-For": {"203.0.113.7"}, TwilioSignatureHeader: {recordedSignature}}
+
+	if status := send("http://chat.ngrok.app/sms", recordedSMS, viaNgrok); status != http.StatusOK {
+		t.Errorf("recorded text: status %d, want 200", status)
+	}
+	if messages, _ := s.Store.List(ListQuery{Room: DefaultRoom}); len(messages) != 1 || messages[0].Content != "Hello from my phone" {
+		t.Errorf("history = %+v, want the recorded text", messages)
+	}
+
+	rejected := map[string]struct {
+		target, body string
+		header       http.Header
+	}{
+		"without signature":     {"http://chat.ngrok.app/sms", recordedSMS, http.Header{"X-Forwarded-Proto": {"https"}}},
+		"with a changed body":   {"http://chat.ngrok.app/sms", strings.Replace(recordedSMS, "Hello", "Pwned", 1), viaNgrok},
+		"to another host":       {"http://evil.example/sms", recordedSMS, viaNgrok},
+		"not through the edge":  {"http://chat.ngrok.app/sms", recordedSMS, http.Header{TwilioSignatureHeader: {recordedSignature}}},
+		"with another query":    {"http://chat.ngrok.app/sms?room=other", recordedSMS, viaNgrok},
+		"signed with other key": {"http://chat.ngrok.app/sms", recordedSMS, http.Header{"X-Forwarded-Proto": {"https"}, TwilioSignatureHeader: {twilioSignature("wrong", "https://chat.ngrok.app/sms", url.Values{})}}},
+	}
+	for name, request := range rejected {
+		if status := send(request.target, request.body, request.header); status != http.StatusForbidden {
+			t.Errorf("text %s: status %d, want 403", name, status)
+		}
+	}
+
+	// Without an auth token nothing is accepted, unless unsigned texts are
+	// allowed explicitly.
+	bridge.AuthToken = ""
+	if status := send("http://chat.ngrok.app/sms", recordedSMS, viaNgrok); status != http.StatusForbidden {
+		t.Errorf("text without an auth token configured: status %d, want 403", status)
+	}
+	bridge.AllowUnsigned = true
+	if status := send("http://chat.ngrok.app/sms", recordedSMS, nil); status != http.StatusOK {
+		t.Errorf("unsigned text with AllowUnsigned: status %d, want 200", status)
+	}
+	bridge.AuthToken, bridge.AllowUnsigned = recordedAuthToken, false
+
+	// Behind a proxy that rewrites the host, the public URL is configured.
+	bridge.PublicURL = "https://chat.ngrok.app"
+	if status := send("http://localhost:8080/sms", recordedSMS, http.Header{TwilioSignatureHeader: {recordedSignature}}); status != http.StatusOK {
+		t.Errorf("recorded text with PublicURL: status %d, want 200", status)
+	}
+
+	// Twilio's own example, also signed without the port it was sent to.
+	params := url.Values{"Digits": {"1234"}, "CallSid": {"CA1234567890ABCDE"}, "To": {"+18005551212"}, "Caller": {"+14158675309"}, "From": {"+14158675309"}, "ReasonConferenceEnded": {"test"}, "Reason": {"Participant"}}
+	for _, webhookURL := range []string{"https://mycompany.com/myapp.php?foo=1&bar=2", "https://mycompany.com:1234/myapp.php?foo=1&bar=2"} {
+		if reason := checkTwilioSignature("12345", webhookURL, params, "vOEb5UThFn24KEfnOFLQY2AE5FY="); reason != "" {
+			t.Errorf("Twilio's example to %s rejected: %s", webhookURL, reason)
+		}
+	}
+}
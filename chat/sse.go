@@ -0,0 +1,165 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// sseHeartbeat is how often HandleEvents writes a comment to an idle
+// stream, so that proxies do not time it out.
+const sseHeartbeat = 15 * time.Second
+
+// sseRetry is the reconnection delay, in milliseconds, suggested to
+// EventSource clients.
+const sseRetry = 1000
+
+// HandleEvents streams the messages posted to the room named by the room
+// query parameter, DefaultRoom if unset, as Server-Sent Events. Each message
+// is a "message" event whose ID is the message ID and whose data is the
+// message as JSON. A message edited or deleted is sent again, as it now is,
+// in an "update" event without an ID. Users starting to type, coming online
+// or going offline and reading messages are "typing", "presence" and "read"
+// events, also without an ID, whose data is the Event as JSON. The client
+// is online while the stream is open, as with HandleWebSocket. Direct
+// messages to the client are sent as they arrive, but not resumed, as with
+// HandleReceive.
+//
+// A client that reconnects with a Last-Event-ID header, as EventSource does,
+// or with a since query parameter, first receives every message newer than
+// that ID, so it misses nothing while disconnected. A client that falls
+// behind is disconnected and catches up the same way when it reconnects.
+func (s *Server) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	room, ok := roomParam(r)
+	if !ok {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRoom, "Invalid room")
+		return
+	}
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteError(w, http.StatusInternalServerError, CodeInternal, "Streaming is not supported")
+		return
+	}
+
+	clientID, events, backlog, err := s.resume(room, directUser(r), since)
+	if err != nil {
+		log.Printf("Failed to get messages since %s: %v", since, err)
+		WriteStoreError(w, err, "Failed to get messages")
+		return
+	}
+	defer s.Hub.Unsubscribe(clientID)
+
+	defer s.join(r, room)()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Keep nginx from buffering the stream
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry)
+
+	// Messages read from the store may also arrive from the hub; skip them
+	// the second time.
+	sent := make(map[string]bool)
+	for len(backlog) > 0 {
+		for _, message := range backlog {
+			if err := writeEvent(w, message); err != nil {
+				return
+			}
+			sent[message.ID] = true
+		}
+		if len(backlog) < MaxPageSize {
+			break
+		}
+
+		last := backlog[len(backlog)-1].ID
+		backlog, err = s.Store.List(ListQuery{Room: room, After: last, Limit: MaxPageSize})
+		if err != nil {
+			// The client reconnects and resumes from the last message.
+			log.Printf("Failed to get messages since %s: %v", last, err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return // Evicted for falling behind
+			}
+			switch event.Type {
+			case EventMessage:
+				if sent[event.Message.ID] {
+					delete(sent, event.Message.ID)
+					continue
+				}
+				if err := writeEvent(w, *event.Message); err != nil {
+					return
+				}
+			case EventUpdate:
+				if err := writeUpdateEvent(w, *event.Message); err != nil {
+					return
+				}
+			case EventTyping, EventPresence, EventRead:
+				if err := writeRoomEvent(w, event); err != nil {
+					return
+				}
+			default:
+				continue
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes msg to an event stream as a "message" event.
+func writeEvent(w http.ResponseWriter, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: message\ndata: %s\n\n", msg.ID, data)
+	return err
+}
+
+// writeRoomEvent writes event to an event stream under its own type, without
+// an ID.
+func writeRoomEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
+
+// writeUpdateEvent writes msg to an event stream as an "update" event. It
+// has no ID, so that the client's Last-Event-ID stays at the newest message.
+func writeUpdateEvent(w http.ResponseWriter, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: update\ndata: %s\n\n", data)
+	return err
+}
@@ -0,0 +1,283 @@
+package chat
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrNotFound is returned by a MessageStore when a message does not exist.
+var ErrNotFound = errors.New("message not found")
+
+// MessageStore persists chat messages, partitioned by room.
+type MessageStore interface {
+	// Append stores a new message in msg.Room.
+	Append(msg Message) error
+	// List returns the page of messages selected by q, oldest first.
+	List(q ListQuery) ([]Message, error)
+	// Get returns the message with the given ID in room, or ErrNotFound.
+	Get(room, id string) (Message, error)
+	// Update sets the content, EditedAt and Deleted of the stored message
+	// that has msg's ID in msg.Room to msg's, leaving its other fields,
+	// such as its reactions, as they are. It returns ErrNotFound if there
+	// is no such message.
+	Update(msg Message) error
+	// AddReaction records username's reaction with emoji to the message
+	// with the given ID in room and returns the message as it now is, or
+	// returns ErrNotFound if there is no such message or it is deleted.
+	AddReaction(room, id, emoji, username string) (Message, error)
+	// RemoveReaction forgets username's reaction with emoji to the
+	// message, like AddReaction.
+	RemoveReaction(room, id, emoji, username string) (Message, error)
+	// Delete removes the message with the given ID from room, or returns
+	// ErrNotFound.
+	Delete(room, id string) error
+}
+
+// ListQuery selects a page of messages from one room. At most one of Before
+// and After may be set. Without After, List returns the newest Limit
+// messages (older than Before, if set); with After it returns the oldest
+// Limit messages newer than After. Either way the page is ordered oldest
+// first.
+type ListQuery struct {
+	Room   string // Room to read
+	Before string // Only messages older than the message with this ID
+	After  string // Only messages newer than the message with this ID
+	Limit  int    // Maximum number of messages, or zero for no limit
+	Thread string // Only the message with this ID and the replies to it
+}
+
+// MemoryStore keeps messages in process memory. Messages are lost on restart.
+type MemoryStore struct {
+	mutex sync.Mutex
+	rooms rooms
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{rooms: make(rooms)}
+}
+
+func (s *MemoryStore) Append(msg Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.rooms.append(msg)
+	return nil
+}
+
+func (s *MemoryStore) List(q ListQuery) ([]Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return pageOf(s.rooms[q.Room], q), nil
+}
+
+func (s *MemoryStore) Get(room, id string) (Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.rooms.get(room, id)
+}
+
+func (s *MemoryStore) Update(msg Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.rooms.update(msg)
+	return err
+}
+
+func (s *MemoryStore) AddReaction(room, id, emoji, username string) (Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	msg, _, err := s.rooms.react(room, id, func(r Reactions) { r.add(emoji, username) })
+	return msg, err
+}
+
+func (s *MemoryStore) RemoveReaction(room, id, emoji, username string) (Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	msg, _, err := s.rooms.react(room, id, func(r Reactions) { r.remove(emoji, username) })
+	return msg, err
+}
+
+func (s *MemoryStore) Delete(room, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.rooms.remove(room, id)
+	return err
+}
+
+// rooms holds messages partitioned by room, each room in append order.
+type rooms map[string][]Message
+
+func (r rooms) append(msg Message) {
+	r[msg.Room] = append(r[msg.Room], msg)
+}
+
+func (r rooms) get(room, id string) (Message, error) {
+	i := indexOf(r[room], id)
+	if i < 0 {
+		return Message{}, ErrNotFound
+	}
+	return r[room][i], nil
+}
+
+// update applies Update to the message with msg's ID, returning the message
+// as it was.
+func (r rooms) update(msg Message) (Message, error) {
+	stored, err := r.get(msg.Room, msg.ID)
+	if err != nil {
+		return Message{}, err
+	}
+	stored.Content, stored.EditedAt, stored.Deleted = msg.Content, msg.EditedAt, msg.Deleted
+	return r.replace(stored)
+}
+
+// react applies change to a copy of the reactions of a message that is not
+// deleted, returning the message as it now is and as it was.
+func (r rooms) react(room, id string, change func(Reactions)) (msg, previous Message, err error) {
+	previous, err = r.get(room, id)
+	if err != nil {
+		return Message{}, Message{}, err
+	}
+	if previous.Deleted {
+		return Message{}, Message{}, ErrNotFound
+	}
+
+	// Copies of the message handed out earlier share its reactions, so
+	// they are changed in a copy.
+	msg = previous
+	msg.Reactions = previous.Reactions.clone()
+	if msg.Reactions == nil {
+		msg.Reactions = make(Reactions)
+	}
+	change(msg.Reactions)
+	if len(msg.Reactions) == 0 {
+		msg.Reactions = nil
+	}
+	r.replace(msg)
+	return msg, previous, nil
+}
+
+// replace swaps the message with msg's ID for msg, returning the message it
+// replaced.
+func (r rooms) replace(msg Message) (Message, error) {
+	messages := r[msg.Room]
+	i := indexOf(messages, msg.ID)
+	if i < 0 {
+		return Message{}, ErrNotFound
+	}
+	previous := messages[i]
+	messages[i] = msg
+	return previous, nil
+}
+
+// remove deletes a message, returning the room's previous slice so that the
+// caller can restore it. The previous slice is left unmodified.
+func (r rooms) remove(room, id string) ([]Message, error) {
+	previous := r[room]
+	i := indexOf(previous, id)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+
+	messages := make([]Message, 0, len(previous)-1)
+	messages = append(messages, previous[:i]...)
+	messages = append(messages, previous[i+1:]...)
+	r[room] = messages
+	return previous, nil
+}
+
+// all returns every message, grouped by room in room name order.
+func (r rooms) all() []Message {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := []Message{}
+	for _, name := range names {
+		messages = append(messages, r[name]...)
+	}
+	return messages
+}
+
+// indexOf returns the position of the message with the given ID, or -1.
+func indexOf(messages []Message, id string) int {
+	for i, message := range messages {
+		if message.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// pageOf returns a copy of the page of messages selected by q. messages must
+// be in the order they were appended, which is also ID order.
+func pageOf(messages []Message, q ListQuery) []Message {
+	if q.Thread != "" {
+		messages = inThread(messages, q.Thread)
+	}
+
+	start, end := 0, len(messages)
+	if q.After != "" {
+		start = cursorIndex(messages, q.After, true)
+	}
+	if q.Before != "" {
+		end = cursorIndex(messages, q.Before, false)
+	}
+	if start > end {
+		start = end
+	}
+
+	page := messages[start:end]
+	if q.Limit > 0 && len(page) > q.Limit {
+		if q.After != "" {
+			page = page[:q.Limit]
+		} else {
+			page = page[len(page)-q.Limit:]
+		}
+	}
+
+	result := make([]Message, len(page))
+	copy(result, page)
+	return result
+}
+
+// inThread returns the message with ID thread and the replies to it.
+func inThread(messages []Message, thread string) []Message {
+	var selected []Message
+	for _, message := range messages {
+		if message.ID == thread || message.ReplyTo == thread {
+			selected = append(selected, message)
+		}
+	}
+	return selected
+}
+
+// cursorIndex returns the index at which a page bounded by the message with
+// ID id starts (after) or ends (before). Positions are looked up by ID first
+// so that IDs which do not sort as strings, like the integers written by
+// earlier versions, still page correctly; if the cursor message is gone the
+// IDs are compared instead.
+func cursorIndex(messages []Message, id string, after bool) int {
+	if i := indexOf(messages, id); i >= 0 {
+		if after {
+			return i + 1
+		}
+		return i
+	}
+
+	for i, message := range messages {
+		if message.ID > id {
+			return i
+		}
+	}
+	return len(messages)
+}
@@ -0,0 +1,453 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+func TestFileStore(t *testing.T) {
+	in := func(room, id, content string) Message {
+		created, _ := idTime(id)
+		return Message{ID: id, Room: room, Username: "ann", Content: content, CreatedAt: created}
+	}
+	one := in(DefaultRoom, "01HV0000000000000000000001", "one")
+	two := in("other", "01HV0000000000000000000002", "two")
+	three := in(DefaultRoom, "01HV0000000000000000000003", "three")
+
+	for _, test := range []struct {
+		name   string
+		file   string // Contents of the file before it is opened, unless it is missing
+		append []Message
+		room   string
+		want   []Message
+	}{
+		{name: "missing file", room: DefaultRoom, want: []Message{}},
+		{name: "empty file", file: "", room: DefaultRoom, want: []Message{}},
+		{name: "append", append: []Message{one, two, three}, room: DefaultRoom, want: []Message{one, three}},
+		{name: "other room", append: []Message{one, two, three}, room: "other", want: []Message{two}},
+		{name: "unknown room", append: []Message{one}, room: "nowhere", want: []Message{}},
+		{
+			name: "messages from before rooms",
+			file: `[{"id": "01HV0000000000000000000001", "username": "ann", "content": "one"}]`,
+			room: DefaultRoom,
+			want: []Message{one},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "messages.json")
+			if test.name != "missing file" {
+				os.WriteFile(path, []byte(test.file), 0644)
+			}
+			store, err := NewFileStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range test.append {
+				if err := store.Append(msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got, _ := store.List(ListQuery{Room: test.room}); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("List = %+v, want %+v", got, test.want)
+			}
+
+			reopened, err := NewFileStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := reopened.List(ListQuery{Room: test.room}); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("List after reopening = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "messages.json")
+	os.WriteFile(path, []byte("not json"), 0644)
+	if _, err := NewFileStore(path); err == nil {
+		t.Error("opening a corrupt file succeeded")
+	}
+	// A failed write leaves nothing behind in memory.
+	dir := t.TempDir()
+	store, _ := NewFileStore(filepath.Join(dir, "missing", "messages.json"))
+	if err := store.Append(one); err == nil {
+		t.Error("appending to a file in a missing directory succeeded")
+	}
+	if got, _ := store.List(ListQuery{Room: DefaultRoom}); len(got) != 0 {
+		t.Errorf("List after a failed append = %+v", got)
+	}
+}
+
+// TestFileStoreLegacyIDs opens a file written by a version that numbered
+// messages, restarting from 1 when its history was cleared, and posts to
+// it: the history stays in the order it was written and the new message
+// comes last.
+func TestFileStoreLegacyIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat_messages.json")
+	os.WriteFile(path, []byte(`[
+		{"id": 1, "username": "ann", "content": "a"},
+		{"id": 2, "username": "ann", "content": "b"},
+		{"id": 10, "username": "ann", "content": "c"},
+		{"id": 1, "username": "bob", "content": "d"},
+		{"id": 2, "username": "bob", "content": "e"}
+	]`), 0644)
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(store)
+	go s.Run()
+	posted, err := s.Post(Message{Username: "carol", Content: "f"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := func(messages []Message) string {
+		var all []string
+		for _, msg := range messages {
+			all = append(all, msg.Content)
+		}
+		return strings.Join(all, "")
+	}
+	for _, test := range []struct {
+		q    ListQuery
+		want string
+	}{
+		{ListQuery{Room: DefaultRoom}, "abcdef"},
+		{ListQuery{Room: DefaultRoom, Limit: 3}, "def"},
+		{ListQuery{Room: DefaultRoom, Before: posted.ID, Limit: 2}, "de"},
+		{ListQuery{Room: DefaultRoom, After: "10"}, "def"},
+	} {
+		if got, err := store.List(test.q); err != nil || contents(got) != test.want {
+			t.Errorf("List(%+v) = %q, %v; want %q", test.q, contents(got), err, test.want)
+		}
+	}
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := reopened.List(ListQuery{Room: DefaultRoom}); contents(got) != "abcdef" || got[5].ID != posted.ID {
+		t.Errorf("history after reopening = %+v", got)
+	}
+}
+
+// fakeDynamoDB is a DynamoDB client that keeps items in memory, keyed by
+// the attributes named in keys, and records every request it is sent.
+// Queries return every item of the partition they name, in key order,
+// newest first unless ScanIndexForward is set; the store is trusted to have
+// asked for the right ones within it, which tests check by looking at the
+// recorded inputs. Queries of an index, whose key condition must bound its
+// sort key with "<=", return only the items up to the bound, in the sort
+// key's order. It may be used by several goroutines at once.
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	mutex sync.Mutex
+	keys  []string
+	items map[string]map[string]*dynamodb.AttributeValue
+	err   error                                 // Returned by every request, if set
+	scan  []map[string]*dynamodb.AttributeValue // Items a Scan returns, whatever its table
+
+	scans   []*dynamodb.ScanInput
+	puts    []*dynamodb.PutItemInput
+	gets    []*dynamodb.GetItemInput
+	queries []*dynamodb.QueryInput
+	updates []*dynamodb.UpdateItemInput
+	deletes []*dynamodb.DeleteItemInput
+}
+
+func newFakeDynamoDB(keys ...string) *fakeDynamoDB {
+	return &fakeDynamoDB{keys: keys, items: make(map[string]map[string]*dynamodb.AttributeValue)}
+}
+
+func (f *fakeDynamoDB) key(item map[string]*dynamodb.AttributeValue) string {
+	var key []string
+	for _, name := range f.keys {
+		key = append(key, aws.StringValue(item[name].S))
+	}
+	return strings.Join(key, "\x00")
+}
+
+// equalityCondition matches a condition or key condition "#name = :value".
+var equalityCondition = regexp.MustCompile(`^(#\w+) = (:\w+)`)
+
+// indexCondition matches the key condition of a query of an index.
+var indexCondition = regexp.MustCompile(`^#\w+ = :\w+ AND (#\w+) <= (:\w+)$`)
+
+func (f *fakeDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.puts = append(f.puts, input)
+	if f.err != nil {
+		return nil, f.err
+	}
+	condition := aws.StringValue(input.ConditionExpression)
+	old := f.items[f.key(input.Item)]
+	if condition == "attribute_not_exists(#id)" && old != nil {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "exists", nil)
+	}
+	if match := equalityCondition.FindStringSubmatch(condition); match != nil {
+		name := aws.StringValue(input.ExpressionAttributeNames[match[1]])
+		want := aws.StringValue(input.ExpressionAttributeValues[match[2]].S)
+		if old == nil || old[name] == nil || aws.StringValue(old[name].S) != want {
+			return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "changed", nil)
+		}
+	}
+	f.items[f.key(input.Item)] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.gets = append(f.gets, input)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &dynamodb.GetItemOutput{Item: f.items[f.key(input.Key)]}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.deletes = append(f.deletes, input)
+	if f.err != nil {
+		return nil, f.err
+	}
+	key := f.key(input.Key)
+	old := f.items[key]
+	delete(f.items, key)
+	return &dynamodb.DeleteItemOutput{Attributes: old}, nil
+}
+
+func (f *fakeDynamoDB) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.updates = append(f.updates, input)
+	if f.err != nil {
+		return nil, f.err
+	}
+	item := f.items[f.key(input.Key)]
+	if item == nil {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "missing", nil)
+	}
+	return &dynamodb.UpdateItemOutput{Attributes: item}, nil
+}
+
+// QueryPages and ScanPages call fn without holding the lock, so that it may
+// send requests of its own.
+func (f *fakeDynamoDB) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	f.mutex.Lock()
+	f.queries = append(f.queries, input)
+	if f.err != nil {
+		f.mutex.Unlock()
+		return f.err
+	}
+	partition := ""
+	if match := equalityCondition.FindStringSubmatch(aws.StringValue(input.KeyConditionExpression)); match != nil && aws.StringValue(input.ExpressionAttributeNames[match[1]]) == f.keys[0] {
+		partition = aws.StringValue(input.ExpressionAttributeValues[match[2]].S)
+	}
+	sortKey, bound := "", ""
+	if input.IndexName != nil {
+		match := indexCondition.FindStringSubmatch(aws.StringValue(input.KeyConditionExpression))
+		if match == nil {
+			f.mutex.Unlock()
+			return fmt.Errorf("unsupported index key condition %q", aws.StringValue(input.KeyConditionExpression))
+		}
+		sortKey, bound = aws.StringValue(input.ExpressionAttributeNames[match[1]]), aws.StringValue(input.ExpressionAttributeValues[match[2]].S)
+	}
+	var keys []string
+	order := make(map[string]string)
+	for key, item := range f.items {
+		if partition != "" && aws.StringValue(item[f.keys[0]].S) != partition {
+			continue
+		}
+		order[key] = key
+		if sortKey != "" {
+			if item[sortKey] == nil || aws.StringValue(item[sortKey].S) > bound {
+				continue
+			}
+			order[key] = aws.StringValue(item[sortKey].S) + "\x00" + key
+		}
+		keys = append(keys, key)
+	}
+	forward := aws.BoolValue(input.ScanIndexForward)
+	sort.Slice(keys, func(i, j int) bool { return order[keys[i]] < order[keys[j]] == forward })
+	page := &dynamodb.QueryOutput{}
+	for _, key := range keys {
+		page.Items = append(page.Items, f.items[key])
+	}
+	f.mutex.Unlock()
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeDynamoDB) ScanPages(input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	f.mutex.Lock()
+	f.scans = append(f.scans, input)
+	err, scan := f.err, f.scan
+	f.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	fn(&dynamodb.ScanOutput{Items: scan}, true)
+	return nil
+}
+
+func TestDynamoStore(t *testing.T) {
+	svc := newFakeDynamoDB("Room", "ID")
+	store := NewDynamoStore(svc, "Messages")
+
+	edited := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	first := Message{ID: "01HV0000000000000000000001", Room: "ops", Username: "ann", Content: "hello", ReplyTo: "01HV0000000000000000000000", EditedAt: &edited, Reactions: Reactions{"👍": {"bob"}}}
+	first.CreatedAt, _ = idTime(first.ID)
+	second := Message{ID: "01HV0000000000000000000002", Room: "ops", Username: "bob", Content: "hi"}
+	second.CreatedAt, _ = idTime(second.ID)
+	for _, msg := range []Message{first, second} {
+		if err := store.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Key attributes keep their capitalized names; the rest use the JSON
+	// field names, and reactions are a map of string sets.
+	item := svc.puts[0].Item
+	if aws.StringValue(svc.puts[0].TableName) != "Messages" || aws.StringValue(item["Room"].S) != "ops" || aws.StringValue(item["ID"].S) != first.ID {
+		t.Errorf("put %v into %s", item, aws.StringValue(svc.puts[0].TableName))
+	}
+	if aws.StringValue(item["content"].S) != "hello" || aws.StringValue(item["reply_to"].S) != first.ReplyTo || aws.StringValue(item["edited_at"].S) != "2024-01-02T15:04:05Z" {
+		t.Errorf("item attributes = %v", item)
+	}
+	if set := item["reactions"].M["👍"]; set == nil || !reflect.DeepEqual(aws.StringValueSlice(set.SS), []string{"bob"}) {
+		t.Errorf("reactions attribute = %v", item["reactions"])
+	}
+	if _, ok := svc.puts[1].Item["reactions"].M["👍"]; ok || svc.puts[1].Item["reactions"].M == nil {
+		t.Errorf("reactions of a message without any = %v, want an empty map", svc.puts[1].Item["reactions"])
+	}
+
+	got, err := store.Get("ops", first.ID)
+	if err != nil || !reflect.DeepEqual(got, first) {
+		t.Errorf("Get = %+v, %v; want %+v", got, err, first)
+	}
+	if key := svc.gets[0].Key; len(key) != 2 || aws.StringValue(key["Room"].S) != "ops" || aws.StringValue(key["ID"].S) != first.ID {
+		t.Errorf("got by key %v", key)
+	}
+	if _, err := store.Get("ops", "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a missing message: %v, want ErrNotFound", err)
+	}
+
+	for _, test := range []struct {
+		q         ListQuery
+		condition string
+		forward   bool
+	}{
+		{ListQuery{Room: "ops", Limit: 2}, "#room = :room", false},
+		{ListQuery{Room: "ops", Before: second.ID}, "#room = :room AND #id < :cursor", false},
+		{ListQuery{Room: "ops", After: first.ID, Limit: 5}, "#room = :room AND #id > :cursor", true},
+		{ListQuery{Room: "ops", Thread: first.ID}, "#room = :room AND #id >= :thread", false},
+	} {
+		messages, err := store.List(test.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Pages come back oldest first whichever way they were read.
+		if len(messages) != 2 || messages[0].ID != first.ID || messages[1].ID != second.ID {
+			t.Errorf("List(%+v) = %+v", test.q, messages)
+		}
+		input := svc.queries[len(svc.queries)-1]
+		if aws.StringValue(input.KeyConditionExpression) != test.condition || aws.BoolValue(input.ScanIndexForward) != test.forward {
+			t.Errorf("List(%+v) queried %q forward %v, want %q forward %v", test.q, aws.StringValue(input.KeyConditionExpression), aws.BoolValue(input.ScanIndexForward), test.condition, test.forward)
+		}
+		if aws.StringValue(input.ExpressionAttributeValues[":room"].S) != "ops" || aws.StringValue(input.ExpressionAttributeNames["#id"]) != "ID" {
+			t.Errorf("List(%+v) query values %v names %v", test.q, input.ExpressionAttributeValues, input.ExpressionAttributeNames)
+		}
+		if cursor := test.q.Before + test.q.After; cursor != "" && aws.StringValue(input.ExpressionAttributeValues[":cursor"].S) != cursor {
+			t.Errorf("List(%+v) cursor = %v", test.q, input.ExpressionAttributeValues[":cursor"])
+		}
+		if test.q.Limit > 0 && aws.Int64Value(input.Limit) != int64(test.q.Limit) {
+			t.Errorf("List(%+v) limit = %d", test.q, aws.Int64Value(input.Limit))
+		}
+	}
+
+	// Items written before created_at existed get the time in their ID.
+	delete(svc.items[svc.key(item)], "created_at")
+	if got, _ := store.Get("ops", first.ID); !got.CreatedAt.Equal(first.CreatedAt) {
+		t.Errorf("CreatedAt of an old item = %v, want %v", got.CreatedAt, first.CreatedAt)
+	}
+
+	if err := store.Delete("ops", first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("ops", first.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleting twice: %v, want ErrNotFound", err)
+	}
+
+	svc.err = awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+	if err := store.Append(second); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("throttled Append: %v, want ErrUnavailable", err)
+	}
+	svc.err = awserr.New("ValidationException", "bad", nil)
+	if _, err := store.List(ListQuery{Room: "ops"}); err == nil || errors.Is(err, ErrUnavailable) {
+		t.Errorf("List with a permanent error: %v", err)
+	}
+}
+
+func TestCopyLegacyMessages(t *testing.T) {
+	svc := newFakeDynamoDB("Room", "ID")
+	store := NewDynamoStore(svc, DefaultDynamoTable)
+	legacy := func(id, content string) map[string]*dynamodb.AttributeValue {
+		return map[string]*dynamodb.AttributeValue{
+			"ID":       {N: aws.String(id)},
+			"id":       {N: aws.String(id)},
+			"username": {S: aws.String("ann")},
+			"content":  {S: aws.String(content)},
+		}
+	}
+
+	svc.scan = []map[string]*dynamodb.AttributeValue{legacy("2", "two"), legacy("10", "ten")}
+	if copied, err := store.CopyLegacyMessages("Messages"); copied != 2 || err != nil {
+		t.Fatalf("CopyLegacyMessages = %d, %v", copied, err)
+	}
+	if table := aws.StringValue(svc.scans[0].TableName); table != "Messages" {
+		t.Errorf("scanned %s, want Messages", table)
+	}
+	// Copying again, after another message was posted, only copies that one.
+	svc.scan = []map[string]*dynamodb.AttributeValue{legacy("2", "two"), legacy("10", "ten"), legacy("11", "eleven")}
+	if copied, err := store.CopyLegacyMessages("Messages"); copied != 1 || err != nil {
+		t.Fatalf("CopyLegacyMessages again = %d, %v", copied, err)
+	}
+
+	store.Append(Message{ID: NewIDGenerator().New(), Room: DefaultRoom, Username: "bob", Content: "new"})
+	messages, err := store.List(ListQuery{Room: DefaultRoom})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, msg := range messages {
+		contents = append(contents, msg.Content)
+	}
+	if want := []string{"two", "ten", "eleven", "new"}; !reflect.DeepEqual(contents, want) {
+		t.Errorf("messages after copying = %v, want %v", contents, want)
+	}
+	if messages[0].ID != "00000000000000000002" || messages[0].Room != DefaultRoom || messages[0].Username != "ann" {
+		t.Errorf("copied message = %+v", messages[0])
+	}
+
+	svc.scan = []map[string]*dynamodb.AttributeValue{{"ID": {S: aws.String("01HV0000000000000000000001")}}}
+	if _, err := store.CopyLegacyMessages("ChatRoomMessages"); err == nil {
+		t.Error("copying a table that is not a legacy one succeeded")
+	}
+}
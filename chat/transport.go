@@ -0,0 +1,113 @@
+package chat
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// Transports a Server can offer clients.
+const (
+	TransportWebSocket = "websocket"
+	TransportSSE       = "sse"
+	TransportLongPoll  = "longpoll"
+)
+
+// DefaultTransports are the transports offered by a new Server, most
+// preferred first.
+var DefaultTransports = []string{TransportWebSocket, TransportSSE, TransportLongPoll}
+
+// Transport tells a client where to receive and send messages over one
+// transport.
+type Transport struct {
+	Name    string `json:"name"`    // One of the Transport constants
+	Receive string `json:"receive"` // Path to receive messages from
+	Send    string `json:"send"`    // Path to post messages to, or empty if sent over the receiving connection
+}
+
+// transports maps each transport to its paths under Register.
+var transports = map[string]Transport{
+	TransportWebSocket: {Name: TransportWebSocket, Receive: "/ws"},
+	TransportSSE:       {Name: TransportSSE, Receive: "/events", Send: "/send"},
+	TransportLongPoll:  {Name: TransportLongPoll, Receive: "/receive", Send: "/send"},
+}
+
+// clientScript is a browser client that negotiates a transport with
+// HandleNegotiate, falling back to the next one when a transport cannot
+// connect, for example because a proxy breaks WebSockets.
+//
+//go:embed client.js
+var clientScript []byte
+
+// Register adds the server's handlers to mux:
+//
+//	/ws             WebSocket
+//	/events         Server-Sent Events
+//	/receive        long-poll
+//	/send           post a message
+//	/messages/{id}  edit (PATCH) or delete (DELETE) a message
+//	/past_messages  history
+//	/typing         tell the room the user is typing
+//	/presence       who is online
+//	/read           mark messages read
+//	/unread         unread counts
+//	/login          start a session, or list the login methods
+//	/login/oidc     sign in with an OpenID Connect provider
+//	/logout         end a session
+//	/me             the session's user
+//	/negotiate      transports offered to clients
+//	/stats          hub counters
+//	/chat.js        browser client
+//
+// All of them share the server's hub, so a message posted over any transport
+// reaches the clients on every other. Pages from origins other than
+// AllowedOrigins cannot use them, and if the server has an Authenticator,
+// the ones that read or post messages require a session.
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.Handle("/ws", s.Authenticate(http.HandlerFunc(s.HandleWebSocket)))
+	mux.Handle("/events", s.CORS(s.Authenticate(http.HandlerFunc(s.HandleEvents))))
+	mux.Handle("/receive", s.CORS(s.Authenticate(http.HandlerFunc(s.HandleReceive))))
+	mux.Handle("/send", s.CORS(s.Authenticate(http.HandlerFunc(s.HandleSend))))
+	mux.Handle(MessagesPath, s.CORS(s.Authenticate(http.HandlerFunc(s.HandleMessage))))
+	mux.Handle("/past_messages", s.CORS(s.Authenticate(http.HandlerFunc(s.HandlePastMessages))))
+	mux.Handle("/typing", s.CORS(s.Authenticate(http.HandlerFunc(s.HandleTyping))))
+	mux.Handle("/presence", s.CORS(s.Authenticate(http.HandlerFunc(s.HandlePresence))))
+	mux.Handle("/read", s.CORS(s.Authenticate(http.HandlerFunc(s.HandleRead))))
+	mux.Handle("/unread", s.CORS(s.Authenticate(http.HandlerFunc(s.HandleUnread))))
+	mux.Handle("/login", s.CORS(http.HandlerFunc(s.HandleLogin)))
+	mux.HandleFunc(OIDCLoginPath, s.HandleOIDCLogin)
+	mux.HandleFunc(OIDCCallbackPath, s.HandleOIDCCallback)
+	mux.Handle("/logout", s.CORS(http.HandlerFunc(s.HandleLogout)))
+	mux.Handle("/me", s.CORS(s.Authenticate(http.HandlerFunc(s.HandleMe))))
+	mux.Handle("/negotiate", s.CORS(http.HandlerFunc(s.HandleNegotiate)))
+	mux.HandleFunc("/stats", s.HandleStats)
+	mux.HandleFunc("/chat.js", HandleClientScript)
+}
+
+// HandleNegotiate answers with the transports the server offers, most
+// preferred first, as a JSON object:
+//
+//	{"transports": [{"name": "websocket", "receive": "/ws", "send": ""}, ...]}
+//
+// Clients try them in order and use the first that connects.
+func (s *Server) HandleNegotiate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	offered := []Transport{}
+	for _, name := range s.Transports {
+		if transport, ok := transports[name]; ok {
+			offered = append(offered, transport)
+		}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Transports []Transport `json:"transports"`
+	}{offered})
+}
+
+// HandleClientScript serves the browser client.
+func HandleClientScript(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Write(clientScript)
+}
@@ -0,0 +1,146 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func startServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	s := NewServer(NewMemoryStore())
+	go s.Run()
+	mux := http.NewServeMux()
+	s.Register(mux)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// eventStream reads "message" events from a Server-Sent Events response.
+type eventStream struct {
+	t       *testing.T
+	scanner *bufio.Scanner
+}
+
+func openEvents(t *testing.T, url, lastEventID string) *eventStream {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q, want text/event-stream", ct)
+	}
+	return &eventStream{t: t, scanner: bufio.NewScanner(resp.Body)}
+}
+
+func (e *eventStream) next() (id string, msg Message) {
+	e.t.Helper()
+	for e.scanner.Scan() {
+		line := e.scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg); err != nil {
+				e.t.Fatal(err)
+			}
+		case line == "" && id != "":
+			return id, msg
+		}
+	}
+	e.t.Fatalf("event stream ended: %v", e.scanner.Err())
+	return "", Message{}
+}
+
+func TestEventsResumeFromLastEventID(t *testing.T) {
+	s, ts := startServer(t)
+
+	first, _ := s.Post(Message{Content: "first"})
+	second, _ := s.Post(Message{Content: "second"})
+
+	events := openEvents(t, ts.URL+"/events", first.ID)
+	if id, msg := events.next(); id != second.ID || msg.Content != "second" {
+		t.Errorf("resumed with %s %q, want %s \"second\"", id, msg.Content, second.ID)
+	}
+
+	third, _ := s.Post(Message{Content: "third"})
+	if id, _ := events.next(); id != third.ID {
+		t.Errorf("live event %s, want %s", id, third.ID)
+	}
+}
+
+// TestTransportsShareHub posts a message over a WebSocket and receives it
+// over all three transports.
+func TestTransportsShareHub(t *testing.T) {
+	s, ts := startServer(t)
+	start, _ := s.Post(Message{Content: "start"})
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	events := openEvents(t, ts.URL+"/events", "")
+
+	polled := make(chan []Message, 1)
+	go func() {
+		resp, err := http.Get(ts.URL + "/receive?since=" + start.ID)
+		if err != nil {
+			t.Error(err)
+			polled <- nil
+			return
+		}
+		defer resp.Body.Close()
+		var messages []Message
+		json.NewDecoder(resp.Body).Decode(&messages)
+		polled <- messages
+	}()
+
+	if err := conn.WriteJSON(Frame{Type: FrameMessage, Message: &Message{Username: "ws", Content: "hello"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if frame := readFrame(t, conn, FrameMessage); frame.Message.Content != "hello" {
+		t.Errorf("WebSocket got %+v", frame.Message)
+	}
+	if _, msg := events.next(); msg.Content != "hello" {
+		t.Errorf("event stream got %+v", msg)
+	}
+	if messages := <-polled; len(messages) != 1 || messages[0].Content != "hello" {
+		t.Errorf("long-poll got %+v", messages)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	s, ts := startServer(t)
+	s.Transports = []string{TransportSSE, TransportLongPoll}
+
+	resp, err := http.Get(ts.URL + "/negotiate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body struct{ Transports []Transport }
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Transports) != 2 || body.Transports[0].Name != TransportSSE || body.Transports[0].Receive != "/events" {
+		t.Errorf("offered %+v, want sse then longpoll", body.Transports)
+	}
+}
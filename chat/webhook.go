@@ -0,0 +1,1414 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// Events outgoing webhooks are sent for.
+const (
+	WebhookMessageCreated = "message.created"
+	WebhookMessageEdited  = "message.edited"
+	WebhookMessageDeleted = "message.deleted"
+	WebhookUserJoined     = "user.joined"
+	WebhookUserLeft       = "user.left"
+)
+
+var webhookEvents = []string{WebhookMessageCreated, WebhookMessageEdited, WebhookMessageDeleted, WebhookUserJoined, WebhookUserLeft}
+
+// Headers sent with every webhook request.
+const (
+	WebhookEventHeader     = "X-Chat-Event"     // One of the Webhook event constants
+	WebhookDeliveryHeader  = "X-Chat-Delivery"  // ID of the WebhookDelivery, the same for every attempt
+	WebhookTimestampHeader = "X-Chat-Timestamp" // Unix time the attempt was signed at
+	WebhookSignatureHeader = "X-Chat-Signature" // WebhookSignature of the timestamp and body
+)
+
+// Delivery statuses.
+const (
+	DeliveryPending   = "pending"   // Waiting for its next attempt
+	DeliveryDelivered = "delivered" // The endpoint accepted it
+	DeliveryFailed    = "failed"    // Given up on; it may be replayed
+)
+
+// WebhooksPath is the prefix under which Webhooks.Register serves the
+// admin endpoints.
+const WebhooksPath = "/admin/webhooks"
+
+// MaxWebhookDeliveries is how many delivered and failed deliveries a
+// MemoryWebhookStore or FileWebhookStore keeps. The oldest are forgotten
+// first.
+const MaxWebhookDeliveries = 1000
+
+// DynamoDeliveryTTL is how long a DynamoWebhookStore keeps delivered and
+// failed deliveries.
+const DynamoDeliveryTTL = 7 * 24 * time.Hour
+
+// DefaultWebhookTable is the name dynamodb.yaml gives the table of a
+// DynamoWebhookStore.
+const DefaultWebhookTable = "ChatRoomWebhooks"
+
+// Defaults for the retry policy of the Webhooks' Dispatcher.
+const (
+	DefaultWebhookAttempts   = 8
+	DefaultWebhookBackoff    = 5 * time.Second
+	DefaultWebhookMaxBackoff = time.Hour
+)
+
+// webhookLease is how long Webhooks that claimed a delivery have to attempt
+// it before Webhooks sharing their store may claim it in turn, as they do
+// when the process making the attempt died.
+const webhookLease = time.Minute
+
+// webhookEventBuffer is how many events may wait to be turned into
+// deliveries. While it is full, publishing an event waits up to
+// webhookEventWait for room, holding up whoever published it, and the
+// event is dropped if none is made.
+const (
+	webhookEventBuffer = 256
+	webhookEventWait   = time.Second
+)
+
+// webhookDueIndex is the DynamoDB index of pending deliveries by
+// NextAttempt.
+const webhookDueIndex = "Due"
+
+// dynamoTimeLayout formats the NextAttempt attribute of a DynamoWebhookStore
+// with a fixed width, so that it sorts as the time it holds.
+const dynamoTimeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// Webhook is an endpoint that is sent chat events as signed JSON posts.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Room      string    `json:"room,omitempty"`   // Only events in this room; every room if empty
+	Events    []string  `json:"events,omitempty"` // Only these events; all of them if empty
+	Secret    string    `json:"secret,omitempty"` // Key the payloads are signed with; only shown when the webhook is created
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// wants reports whether h is sent events of type name in room.
+func (h Webhook) wants(name, room string) bool {
+	if h.Room != "" && h.Room != room {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, event := range h.Events {
+		if event == name {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the JSON body of a webhook request.
+type WebhookPayload struct {
+	ID       string    `json:"id"`    // ID of the event, the same for every webhook sent it
+	Event    string    `json:"event"` // One of the Webhook event constants
+	Room     string    `json:"room"`
+	Time     time.Time `json:"time"`
+	Message  *Message  `json:"message,omitempty"`  // Message created, edited or deleted
+	Username string    `json:"username,omitempty"` // User who joined or left
+}
+
+// WebhookDelivery is the sending of one event to one webhook, with every
+// attempt made so far.
+type WebhookDelivery struct {
+	ID          string           `json:"id"`
+	WebhookID   string           `json:"webhook_id"`
+	Event       string           `json:"event"`
+	Payload     json.RawMessage  `json:"payload"` // WebhookPayload, sent as is on every attempt
+	Status      string           `json:"status"`  // One of the Delivery constants
+	Tries       int              `json:"tries"`   // Attempts since it was created or last replayed
+	NextAttempt time.Time        `json:"next_attempt,omitempty"`
+	Attempts    []WebhookAttempt `json:"attempts"`
+	CreatedAt   time.Time        `json:"created_at"`
+}
+
+// WebhookAttempt records one attempt to deliver a webhook.
+type WebhookAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"` // The endpoint's answer, if any
+	Error      string    `json:"error,omitempty"`       // Why the attempt failed
+}
+
+// WebhookSignature returns the signature sent in the X-Chat-Signature
+// header: "sha256=" followed by the hex HMAC-SHA256, keyed by the webhook's
+// secret, of the X-Chat-Timestamp header, a dot and the body. Endpoints
+// should compute it themselves, compare it in constant time and reject old
+// timestamps, so that recorded requests cannot be replayed.
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookStore persists webhooks, their deliveries and incoming webhooks.
+type WebhookStore interface {
+	// Webhooks returns every webhook, sorted by ID.
+	Webhooks() ([]Webhook, error)
+	// PutWebhook adds hook, replacing any with the same ID.
+	PutWebhook(hook Webhook) error
+	// Webhook returns the webhook with ID id, or ErrNotFound.
+	Webhook(id string) (Webhook, error)
+	// RemoveWebhook removes the webhook with ID id, or returns ErrNotFound.
+	RemoveWebhook(id string) error
+	// Delivery returns the delivery with ID id, or ErrNotFound.
+	Delivery(id string) (WebhookDelivery, error)
+	// Deliveries returns up to limit deliveries, all if limit is not
+	// positive, newest first. Unless empty, status and webhookID only
+	// return deliveries with that status or for that webhook.
+	Deliveries(status, webhookID string, limit int) ([]WebhookDelivery, error)
+	// DueDeliveries returns up to limit pending deliveries whose
+	// NextAttempt is not after now, earliest first.
+	DueDeliveries(now time.Time, limit int) ([]WebhookDelivery, error)
+	// PutDelivery adds d, replacing any delivery with the same ID, and
+	// forgets old finished deliveries.
+	PutDelivery(d WebhookDelivery) error
+	// ClaimDelivery moves the NextAttempt of the pending delivery d to
+	// until, so that whoever else shares the store leaves it alone until
+	// then. It reports false, changing nothing, if the stored delivery is
+	// no longer pending or due at d.NextAttempt, because it was claimed or
+	// finished first.
+	ClaimDelivery(d WebhookDelivery, until time.Time) (bool, error)
+
+	// IncomingWebhooks returns every incoming webhook, sorted by ID.
+	IncomingWebhooks() ([]IncomingWebhook, error)
+	// PutIncomingWebhook adds hook, replacing any with the same ID.
+	PutIncomingWebhook(hook IncomingWebhook) error
+	// RemoveIncomingWebhook removes the incoming webhook with ID id, or
+	// returns ErrNotFound.
+	RemoveIncomingWebhook(id string) error
+}
+
+// MemoryWebhookStore keeps webhooks and deliveries in process memory. They
+// are lost on restart.
+type MemoryWebhookStore struct {
+	mutex sync.Mutex
+	state webhookState
+}
+
+// NewMemoryWebhookStore returns an empty MemoryWebhookStore.
+func NewMemoryWebhookStore() *MemoryWebhookStore {
+	return &MemoryWebhookStore{state: newWebhookState()}
+}
+
+func (s *MemoryWebhookStore) Webhooks() ([]Webhook, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.webhooks(), nil
+}
+
+func (s *MemoryWebhookStore) PutWebhook(hook Webhook) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state.Webhooks[hook.ID] = hook
+	return nil
+}
+
+func (s *MemoryWebhookStore) Webhook(id string) (Webhook, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.webhook(id)
+}
+
+func (s *MemoryWebhookStore) RemoveWebhook(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.state.Webhooks[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.state.Webhooks, id)
+	return nil
+}
+
+func (s *MemoryWebhookStore) Delivery(id string) (WebhookDelivery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.delivery(id)
+}
+
+func (s *MemoryWebhookStore) Deliveries(status, webhookID string, limit int) ([]WebhookDelivery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.deliveries(status, webhookID, limit), nil
+}
+
+func (s *MemoryWebhookStore) DueDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.dueDeliveries(now, limit), nil
+}
+
+func (s *MemoryWebhookStore) PutDelivery(d WebhookDelivery) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state.putDelivery(d)
+	return nil
+}
+
+func (s *MemoryWebhookStore) ClaimDelivery(d WebhookDelivery, until time.Time) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.claim(d, until), nil
+}
+
+func (s *MemoryWebhookStore) IncomingWebhooks() ([]IncomingWebhook, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.incomingWebhooks(), nil
+}
+
+func (s *MemoryWebhookStore) PutIncomingWebhook(hook IncomingWebhook) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state.Incoming[hook.ID] = hook
+	return nil
+}
+
+func (s *MemoryWebhookStore) RemoveIncomingWebhook(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.state.Incoming[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.state.Incoming, id)
+	return nil
+}
+
+// FileWebhookStore keeps webhooks and deliveries in memory and mirrors them
+// to a JSON file, which is rewritten after every change.
+type FileWebhookStore struct {
+	mutex sync.Mutex
+	path  string
+	state webhookState
+}
+
+// NewFileWebhookStore returns a FileWebhookStore backed by the file at
+// path, loading anything it already contains. A missing or empty file
+// holds nothing.
+func NewFileWebhookStore(path string) (*FileWebhookStore, error) {
+	s := &FileWebhookStore{path: path, state: newWebhookState()}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) || err == nil && len(data) == 0 {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, err
+	}
+	if s.state.Webhooks == nil {
+		s.state.Webhooks = make(map[string]Webhook)
+	}
+	if s.state.DeliveryByID == nil {
+		s.state.DeliveryByID = make(map[string]WebhookDelivery)
+	}
+	if s.state.Incoming == nil {
+		s.state.Incoming = make(map[string]IncomingWebhook)
+	}
+	return s, nil
+}
+
+func (s *FileWebhookStore) Webhooks() ([]Webhook, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.webhooks(), nil
+}
+
+func (s *FileWebhookStore) PutWebhook(hook Webhook) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.change(func() { s.state.Webhooks[hook.ID] = hook })
+}
+
+func (s *FileWebhookStore) Webhook(id string) (Webhook, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.webhook(id)
+}
+
+func (s *FileWebhookStore) RemoveWebhook(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.state.Webhooks[id]; !ok {
+		return ErrNotFound
+	}
+	return s.change(func() { delete(s.state.Webhooks, id) })
+}
+
+func (s *FileWebhookStore) Delivery(id string) (WebhookDelivery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.delivery(id)
+}
+
+func (s *FileWebhookStore) Deliveries(status, webhookID string, limit int) ([]WebhookDelivery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.deliveries(status, webhookID, limit), nil
+}
+
+func (s *FileWebhookStore) DueDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.dueDeliveries(now, limit), nil
+}
+
+func (s *FileWebhookStore) PutDelivery(d WebhookDelivery) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.change(func() { s.state.putDelivery(d) })
+}
+
+func (s *FileWebhookStore) ClaimDelivery(d WebhookDelivery, until time.Time) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	claimed := false
+	err := s.change(func() { claimed = s.state.claim(d, until) })
+	return claimed && err == nil, err
+}
+
+func (s *FileWebhookStore) IncomingWebhooks() ([]IncomingWebhook, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.incomingWebhooks(), nil
+}
+
+func (s *FileWebhookStore) PutIncomingWebhook(hook IncomingWebhook) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.change(func() { s.state.Incoming[hook.ID] = hook })
+}
+
+func (s *FileWebhookStore) RemoveIncomingWebhook(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.state.Incoming[id]; !ok {
+		return ErrNotFound
+	}
+	return s.change(func() { delete(s.state.Incoming, id) })
+}
+
+// change applies apply to the state and writes it to the file, undoing it
+// if the file cannot be written. The caller must hold the mutex.
+func (s *FileWebhookStore) change(apply func()) error {
+	previous := s.state.clone()
+	apply()
+	data, err := json.Marshal(s.state)
+	if err == nil {
+		err = writeFile(s.path, data)
+	}
+	if err != nil {
+		// Keep memory and the file in step.
+		s.state = previous
+	}
+	return err
+}
+
+// DynamoWebhookStore keeps webhooks, deliveries and incoming webhooks in a
+// DynamoDB table, so that every replica of the server sees the same ones.
+// Items are keyed by the string attributes "Kind" (partition key), which
+// tells what they hold, and "ID" (sort key), and hold the JSON of the
+// webhook or delivery in "Data". Pending deliveries are a partition of
+// their own, and carry the time of their next attempt in "NextAttempt",
+// the sort key of the global secondary index "Due", so that polling for
+// those that are due reads only them. Rather than being trimmed to
+// MaxWebhookDeliveries, finished deliveries carry an "ExpiresAt" time,
+// DynamoDeliveryTTL after they were last written, for the table's time to
+// live to remove them.
+//
+// dynamodb.yaml in this package defines the table.
+type DynamoWebhookStore struct {
+	svc   dynamodbiface.DynamoDBAPI
+	table string
+}
+
+// Kinds of item in a DynamoWebhookStore.
+const (
+	kindWebhook          = "webhook"
+	kindIncoming         = "incoming"
+	kindPendingDelivery  = "delivery.pending"
+	kindFinishedDelivery = "delivery.finished"
+)
+
+// NewDynamoWebhookStore returns a DynamoWebhookStore that uses svc to
+// access table.
+func NewDynamoWebhookStore(svc dynamodbiface.DynamoDBAPI, table string) *DynamoWebhookStore {
+	return &DynamoWebhookStore{svc: svc, table: table}
+}
+
+func (s *DynamoWebhookStore) Webhooks() ([]Webhook, error) {
+	hooks := []Webhook{}
+	err := s.query(kindWebhook, false, func(data []byte) (bool, error) {
+		var hook Webhook
+		err := json.Unmarshal(data, &hook)
+		hooks = append(hooks, hook)
+		return true, err
+	})
+	return hooks, err
+}
+
+func (s *DynamoWebhookStore) PutWebhook(hook Webhook) error {
+	return s.put(kindWebhook, hook.ID, hook, nil, "")
+}
+
+func (s *DynamoWebhookStore) Webhook(id string) (Webhook, error) {
+	var hook Webhook
+	err := s.get(kindWebhook, id, &hook)
+	return hook, err
+}
+
+func (s *DynamoWebhookStore) RemoveWebhook(id string) error {
+	return s.remove(kindWebhook, id)
+}
+
+func (s *DynamoWebhookStore) Delivery(id string) (WebhookDelivery, error) {
+	for _, kind := range []string{kindPendingDelivery, kindFinishedDelivery} {
+		var d WebhookDelivery
+		if err := s.get(kind, id, &d); !errors.Is(err, ErrNotFound) {
+			return d, err
+		}
+	}
+	return WebhookDelivery{}, ErrNotFound
+}
+
+func (s *DynamoWebhookStore) Deliveries(status, webhookID string, limit int) ([]WebhookDelivery, error) {
+	var kinds []string
+	if status == "" || status == DeliveryPending {
+		kinds = append(kinds, kindPendingDelivery)
+	}
+	if status != DeliveryPending {
+		kinds = append(kinds, kindFinishedDelivery)
+	}
+
+	var found []WebhookDelivery
+	for _, kind := range kinds {
+		n := 0
+		err := s.query(kind, true, func(data []byte) (bool, error) {
+			var d WebhookDelivery
+			if err := json.Unmarshal(data, &d); err != nil {
+				return false, err
+			}
+			if (status == "" || d.Status == status) && (webhookID == "" || d.WebhookID == webhookID) {
+				found = append(found, d)
+				n++
+			}
+			return limit <= 0 || n < limit, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// IDs sort in creation order.
+	sort.Slice(found, func(i, j int) bool { return found[i].ID > found[j].ID })
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+	return found, nil
+}
+
+// DueDeliveries queries the Due index for the pending deliveries whose
+// NextAttempt is not after now.
+func (s *DynamoWebhookStore) DueDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+	due := []WebhookDelivery{}
+	err := s.queryItems(&dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		IndexName:              aws.String(webhookDueIndex),
+		KeyConditionExpression: aws.String("#kind = :kind AND #next <= :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#kind": aws.String("Kind"),
+			"#next": aws.String("NextAttempt"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":kind": {S: aws.String(kindPendingDelivery)},
+			":now":  {S: aws.String(dynamoTime(now))},
+		},
+		ScanIndexForward: aws.Bool(true),
+		Limit:            aws.Int64(int64(limit)),
+	}, func(data []byte) (bool, error) {
+		var d WebhookDelivery
+		err := json.Unmarshal(data, &d)
+		due = append(due, d)
+		return len(due) < limit, err
+	})
+	return due, err
+}
+
+// PutDelivery writes d to the partition of its status, then removes it
+// from the other one, which it may have just left.
+func (s *DynamoWebhookStore) PutDelivery(d WebhookDelivery) error {
+	kind, other := kindPendingDelivery, kindFinishedDelivery
+	attributes := map[string]*dynamodb.AttributeValue{}
+	if d.Status == DeliveryPending {
+		attributes["NextAttempt"] = &dynamodb.AttributeValue{S: aws.String(dynamoTime(d.NextAttempt))}
+	} else {
+		kind, other = other, kind
+		expires := time.Now().Add(DynamoDeliveryTTL).Unix()
+		attributes["ExpiresAt"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expires, 10))}
+	}
+	if err := s.put(kind, d.ID, d, attributes, ""); err != nil {
+		return err
+	}
+
+	_, err := s.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       webhookItemKey(other, d.ID),
+	})
+	return classify(err)
+}
+
+// ClaimDelivery rewrites the pending delivery on condition that its
+// NextAttempt attribute is still d's.
+func (s *DynamoWebhookStore) ClaimDelivery(d WebhookDelivery, until time.Time) (bool, error) {
+	due := dynamoTime(d.NextAttempt)
+	d.NextAttempt = until
+	attributes := map[string]*dynamodb.AttributeValue{
+		"NextAttempt": {S: aws.String(dynamoTime(until))},
+	}
+	err := s.put(kindPendingDelivery, d.ID, d, attributes, due)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *DynamoWebhookStore) IncomingWebhooks() ([]IncomingWebhook, error) {
+	hooks := []IncomingWebhook{}
+	err := s.query(kindIncoming, false, func(data []byte) (bool, error) {
+		var hook IncomingWebhook
+		err := json.Unmarshal(data, &hook)
+		hooks = append(hooks, hook)
+		return true, err
+	})
+	return hooks, err
+}
+
+func (s *DynamoWebhookStore) PutIncomingWebhook(hook IncomingWebhook) error {
+	return s.put(kindIncoming, hook.ID, hook, nil, "")
+}
+
+func (s *DynamoWebhookStore) RemoveIncomingWebhook(id string) error {
+	return s.remove(kindIncoming, id)
+}
+
+// query calls fn with the data of every item of kind, in ID order or,
+// if newestFirst is set, in reverse, until fn returns false or an error.
+func (s *DynamoWebhookStore) query(kind string, newestFirst bool, fn func(data []byte) (bool, error)) error {
+	return s.queryItems(&dynamodb.QueryInput{
+		TableName:                 aws.String(s.table),
+		KeyConditionExpression:    aws.String("#kind = :kind"),
+		ExpressionAttributeNames:  map[string]*string{"#kind": aws.String("Kind")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":kind": {S: aws.String(kind)}},
+		ScanIndexForward:          aws.Bool(!newestFirst),
+	}, fn)
+}
+
+// queryItems calls fn with the data of every item input finds, until fn
+// returns false or an error.
+func (s *DynamoWebhookStore) queryItems(input *dynamodb.QueryInput, fn func(data []byte) (bool, error)) error {
+	var fnErr error
+	err := s.svc.QueryPages(input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if item["Data"] == nil {
+				continue
+			}
+			more, err := fn([]byte(aws.StringValue(item["Data"].S)))
+			if err != nil || !more {
+				fnErr = err
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return classify(err)
+	}
+	return fnErr
+}
+
+// put writes v as the item of kind with ID id, with attributes added. If
+// due is set, the item is only written if its NextAttempt attribute is
+// due; otherwise it fails with DynamoDB's conditional check failure.
+func (s *DynamoWebhookStore) put(kind, id string, v interface{}, attributes map[string]*dynamodb.AttributeValue, due string) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	item := webhookItemKey(kind, id)
+	item["Data"] = &dynamodb.AttributeValue{S: aws.String(string(data))}
+	for name, value := range attributes {
+		item[name] = value
+	}
+
+	input := &dynamodb.PutItemInput{TableName: aws.String(s.table), Item: item}
+	if due != "" {
+		input.ConditionExpression = aws.String("#next = :due")
+		input.ExpressionAttributeNames = map[string]*string{"#next": aws.String("NextAttempt")}
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":due": {S: aws.String(due)}}
+	}
+	_, err = s.svc.PutItem(input)
+	return classify(err)
+}
+
+// get decodes the data of the item of kind with ID id into v, or returns
+// ErrNotFound.
+func (s *DynamoWebhookStore) get(kind, id string, v interface{}) error {
+	out, err := s.svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key:       webhookItemKey(kind, id),
+	})
+	if err != nil {
+		return classify(err)
+	}
+	if out.Item == nil || out.Item["Data"] == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal([]byte(aws.StringValue(out.Item["Data"].S)), v)
+}
+
+// remove deletes the item of kind with ID id, or returns ErrNotFound.
+func (s *DynamoWebhookStore) remove(kind, id string) error {
+	out, err := s.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:    aws.String(s.table),
+		Key:          webhookItemKey(kind, id),
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+	if err != nil {
+		return classify(err)
+	}
+	if len(out.Attributes) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func webhookItemKey(kind, id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"Kind": {S: aws.String(kind)},
+		"ID":   {S: aws.String(id)},
+	}
+}
+
+func dynamoTime(t time.Time) string {
+	return t.UTC().Format(dynamoTimeLayout)
+}
+
+// webhookState is what a WebhookStore holds. It is shared by
+// MemoryWebhookStore and FileWebhookStore, which guard it with their own
+// mutex.
+type webhookState struct {
+	Webhooks     map[string]Webhook         `json:"webhooks"`
+	DeliveryByID map[string]WebhookDelivery `json:"deliveries"`
+	Incoming     map[string]IncomingWebhook `json:"incoming"`
+}
+
+func newWebhookState() webhookState {
+	return webhookState{
+		Webhooks:     make(map[string]Webhook),
+		DeliveryByID: make(map[string]WebhookDelivery),
+		Incoming:     make(map[string]IncomingWebhook),
+	}
+}
+
+// clone returns a copy of s whose maps can be changed without affecting s.
+func (s webhookState) clone() webhookState {
+	c := newWebhookState()
+	for id, hook := range s.Webhooks {
+		c.Webhooks[id] = hook
+	}
+	for id, d := range s.DeliveryByID {
+		c.DeliveryByID[id] = d
+	}
+	for id, hook := range s.Incoming {
+		c.Incoming[id] = hook
+	}
+	return c
+}
+
+func (s webhookState) webhooks() []Webhook {
+	hooks := make([]Webhook, 0, len(s.Webhooks))
+	for _, hook := range s.Webhooks {
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	return hooks
+}
+
+func (s webhookState) incomingWebhooks() []IncomingWebhook {
+	hooks := make([]IncomingWebhook, 0, len(s.Incoming))
+	for _, hook := range s.Incoming {
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	return hooks
+}
+
+func (s webhookState) webhook(id string) (Webhook, error) {
+	hook, ok := s.Webhooks[id]
+	if !ok {
+		return Webhook{}, ErrNotFound
+	}
+	return hook, nil
+}
+
+func (s webhookState) delivery(id string) (WebhookDelivery, error) {
+	d, ok := s.DeliveryByID[id]
+	if !ok {
+		return WebhookDelivery{}, ErrNotFound
+	}
+	return d, nil
+}
+
+func (s webhookState) deliveries(status, webhookID string, limit int) []WebhookDelivery {
+	var found []WebhookDelivery
+	for _, d := range s.DeliveryByID {
+		if (status == "" || d.Status == status) && (webhookID == "" || d.WebhookID == webhookID) {
+			found = append(found, d)
+		}
+	}
+	// IDs sort in creation order.
+	sort.Slice(found, func(i, j int) bool { return found[i].ID > found[j].ID })
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
+
+func (s webhookState) dueDeliveries(now time.Time, limit int) []WebhookDelivery {
+	var due []WebhookDelivery
+	for _, d := range s.DeliveryByID {
+		if d.Status == DeliveryPending && !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttempt.Equal(due[j].NextAttempt) {
+			return due[i].NextAttempt.Before(due[j].NextAttempt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due
+}
+
+func (s webhookState) claim(d WebhookDelivery, until time.Time) bool {
+	stored, ok := s.DeliveryByID[d.ID]
+	if !ok || stored.Status != DeliveryPending || !stored.NextAttempt.Equal(d.NextAttempt) {
+		return false
+	}
+	stored.NextAttempt = until
+	s.DeliveryByID[d.ID] = stored
+	return true
+}
+
+func (s webhookState) putDelivery(d WebhookDelivery) {
+	s.DeliveryByID[d.ID] = d
+
+	var finished []string
+	for id, d := range s.DeliveryByID {
+		if d.Status != DeliveryPending {
+			finished = append(finished, id)
+		}
+	}
+	if len(finished) <= MaxWebhookDeliveries {
+		return
+	}
+	sort.Strings(finished)
+	for _, id := range finished[:len(finished)-MaxWebhookDeliveries] {
+		delete(s.DeliveryByID, id)
+	}
+}
+
+// Webhooks sends the events that happen on a Server to the webhooks in a
+// WebhookStore: messages being created, edited and deleted, and users
+// joining and leaving rooms. Events in direct conversations are never sent.
+// Each delivery is recorded with its attempts and sent by Dispatcher, which
+// retries it with exponential backoff until the endpoint answers with a 2xx
+// status, and gives up on it after its MaxAttempts or if the endpoint
+// answers with a 4xx status other than 408 and 429, as it does for a
+// WebhookNotifier. Failed deliveries can be replayed through the admin
+// endpoints.
+//
+// Webhooks also serves the store's incoming webhooks, through which scripts
+// post messages; see HandleIncoming.
+//
+// The replicas of a server share webhooks by running Webhooks on the same
+// store, such as a DynamoWebhookStore. Each event is recorded by the
+// replica it happened on, and each attempt made by whichever replica
+// claims the delivery first.
+//
+// Fields, including Dispatcher's, must be set before Run starts.
+type Webhooks struct {
+	Server *Server
+	Store  WebhookStore
+	Client *http.Client // Sends the requests; one with a 10 second timeout if nil
+
+	// Dispatcher sends the deliveries. Its queue is the store's pending
+	// deliveries, and its retry policy theirs.
+	Dispatcher *Dispatcher
+
+	// AdminToken, if set, is a bearer token that may use the admin
+	// endpoints. Moderators signed in to the server may use them too.
+	AdminToken string
+
+	ids    *IDGenerator
+	events chan Event
+	queue  *webhookQueue
+}
+
+// NewWebhooks returns Webhooks that send the events server publishes to
+// the webhooks in store, with the default retry policy. It must be created
+// before the server starts handling requests, and Run must be started for
+// anything to be sent.
+func NewWebhooks(server *Server, store WebhookStore) *Webhooks {
+	h := &Webhooks{
+		Server: server,
+		Store:  store,
+		ids:    NewIDGenerator(),
+		events: make(chan Event, webhookEventBuffer),
+		queue:  &webhookQueue{store: store, held: make(map[string]WebhookDelivery)},
+	}
+	h.Dispatcher = NewDispatcher(h.queue)
+	h.Dispatcher.MaxAttempts = DefaultWebhookAttempts
+	h.Dispatcher.Backoff = DefaultWebhookBackoff
+	h.Dispatcher.MaxBackoff = DefaultWebhookMaxBackoff
+	h.Dispatcher.Register(ChannelWebhook, deliveryNotifier{h}, RateLimit{})
+	server.Observe(h.observe)
+	return h
+}
+
+// webhookEvent returns the webhook event that event is, or "" if it is
+// none.
+func webhookEvent(event Event) string {
+	if len(event.To) > 0 {
+		return ""
+	}
+	switch {
+	case event.Type == EventMessage:
+		return WebhookMessageCreated
+	case event.Type == EventUpdate && event.Change == ChangeEdited:
+		return WebhookMessageEdited
+	case event.Type == EventUpdate && event.Change == ChangeDeleted:
+		return WebhookMessageDeleted
+	case event.Type == EventPresence && event.Presence != nil && event.Presence.Online:
+		return WebhookUserJoined
+	case event.Type == EventPresence && event.Presence != nil:
+		return WebhookUserLeft
+	}
+	return ""
+}
+
+func (h *Webhooks) observe(event Event) {
+	if webhookEvent(event) == "" {
+		return
+	}
+	select {
+	case h.events <- event:
+		return
+	default:
+	}
+
+	// Recording is falling behind, as when the store is slow; hold up the
+	// publisher for a while rather than lose the event at once.
+	timer := time.NewTimer(webhookEventWait)
+	defer timer.Stop()
+	select {
+	case h.events <- event:
+	case <-timer.C:
+		log.Printf("Webhook event buffer full for %v, dropping %s event in %s", webhookEventWait, event.Type, event.Room)
+	}
+}
+
+// Run records a delivery for every event and webhook that wants it and
+// runs the Dispatcher, which sends the deliveries as they fall due,
+// including those left pending by an earlier process. It never returns.
+func (h *Webhooks) Run() {
+	go h.Dispatcher.Run()
+	for event := range h.events {
+		h.record(event)
+	}
+}
+
+// record queues a delivery of event to every webhook that wants it.
+func (h *Webhooks) record(event Event) {
+	name := webhookEvent(event)
+	hooks, err := h.Store.Webhooks()
+	if err != nil {
+		log.Printf("Failed to read webhooks: %v", err)
+		return
+	}
+
+	var payload []byte
+	now := time.Now().UTC()
+	for _, hook := range hooks {
+		if !hook.wants(name, event.Room) {
+			continue
+		}
+		if payload == nil {
+			payload, err = json.Marshal(WebhookPayload{
+				ID:       h.ids.New(),
+				Event:    name,
+				Room:     event.Room,
+				Time:     now,
+				Message:  event.Message,
+				Username: event.Username,
+			})
+			if err != nil {
+				log.Printf("Failed to encode %s webhook: %v", name, err)
+				return
+			}
+		}
+		d := WebhookDelivery{
+			ID:          h.ids.New(),
+			WebhookID:   hook.ID,
+			Event:       name,
+			Payload:     payload,
+			Status:      DeliveryPending,
+			NextAttempt: now,
+			Attempts:    []WebhookAttempt{},
+			CreatedAt:   now,
+		}
+		if err := h.Store.PutDelivery(d); err != nil {
+			log.Printf("Failed to record %s webhook delivery to %s: %v", name, hook.URL, err)
+		}
+	}
+	if payload != nil {
+		h.Dispatcher.poke()
+	}
+}
+
+// attempt sends d to its webhook once.
+func (h *Webhooks) attempt(d WebhookDelivery) (WebhookAttempt, error) {
+	attempt := WebhookAttempt{At: time.Now().UTC()}
+	hook, err := h.Store.Webhook(d.WebhookID)
+	if errors.Is(err, ErrNotFound) {
+		err = undeliverable(errors.New("webhook removed"))
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, undeliverable(err)
+	}
+	timestamp := strconv.FormatInt(attempt.At.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chat-webhooks")
+	req.Header.Set(WebhookEventHeader, d.Event)
+	req.Header.Set(WebhookDeliveryHeader, d.ID)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, WebhookSignature(hook.Secret, timestamp, d.Payload))
+
+	resp, err := webhookClient(h.Client).Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, err
+	}
+	resp.Body.Close()
+	attempt.StatusCode = resp.StatusCode
+	if err := webhookStatusError(resp); err != nil {
+		attempt.Error = err.Error()
+		return attempt, err
+	}
+	return attempt, nil
+}
+
+// deliveryNotifier attempts, for the Webhooks' Dispatcher, the deliveries
+// its queue holds, recording each attempt on the delivery.
+type deliveryNotifier struct{ h *Webhooks }
+
+func (s deliveryNotifier) Notify(n Notification) error {
+	d, ok := s.h.queue.claimed(n.ID)
+	if !ok {
+		return undeliverable(fmt.Errorf("webhook delivery %s not claimed", n.ID))
+	}
+	attempt, err := s.h.attempt(d)
+	s.h.queue.record(n.ID, attempt)
+	return err
+}
+
+// webhookQueue is the NotificationQueue of the Webhooks' Dispatcher: the
+// pending deliveries in a WebhookStore, as notifications with the same IDs
+// on ChannelWebhook. Due claims the deliveries it returns for webhookLease,
+// so that Webhooks sharing the store leave them alone, and holds them until
+// the Dispatcher puts them back to be attempted again or removes them, when
+// they are recorded as delivered or failed according to their last attempt.
+type webhookQueue struct {
+	store WebhookStore
+
+	mutex sync.Mutex
+	held  map[string]WebhookDelivery // Claimed deliveries, by ID
+}
+
+// Put reschedules a held delivery that failed.
+func (q *webhookQueue) Put(n Notification) error {
+	d, ok := q.release(n.ID)
+	if !ok {
+		return fmt.Errorf("chat: webhook delivery %s not claimed", n.ID)
+	}
+	d.Tries, d.NextAttempt = n.Attempts, n.NextAttempt.UTC()
+	return q.store.PutDelivery(d)
+}
+
+// Due returns the held deliveries, which are being attempted and stay due
+// as in the other queues, followed by the due deliveries it claims.
+func (q *webhookQueue) Due(channel string, now time.Time, limit int) ([]Notification, error) {
+	if channel != ChannelWebhook {
+		return nil, nil
+	}
+	var due []Notification
+	q.mutex.Lock()
+	for _, d := range q.held {
+		due = append(due, d.notification())
+	}
+	q.mutex.Unlock()
+	if len(due) >= limit {
+		return due, nil
+	}
+
+	// Only the Dispatcher's goroutine adds to held, so it cannot change
+	// under the claims.
+	deliveries, err := q.store.DueDeliveries(now, limit-len(due))
+	if err != nil {
+		return due, err
+	}
+	until := now.Add(webhookLease).UTC()
+	for _, d := range deliveries {
+		n := d.notification()
+		if claimed, err := q.store.ClaimDelivery(d, until); err != nil || !claimed {
+			if err != nil {
+				log.Printf("Failed to claim webhook delivery %s: %v", d.ID, err)
+			}
+			continue
+		}
+		d.NextAttempt = until
+
+		q.mutex.Lock()
+		q.held[d.ID] = d
+		q.mutex.Unlock()
+		due = append(due, n)
+	}
+	return due, nil
+}
+
+// Remove records a held delivery as delivered, or as failed if its last
+// attempt failed and the Dispatcher gave up on it.
+func (q *webhookQueue) Remove(id string) error {
+	d, ok := q.release(id)
+	if !ok {
+		return nil
+	}
+	d.Tries++
+	d.Status, d.NextAttempt = DeliveryDelivered, time.Time{}
+	if len(d.Attempts) > 0 && d.Attempts[len(d.Attempts)-1].Error != "" {
+		d.Status = DeliveryFailed
+	}
+	return q.store.PutDelivery(d)
+}
+
+// claimed returns the held delivery with ID id.
+func (q *webhookQueue) claimed(id string) (WebhookDelivery, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	d, ok := q.held[id]
+	return d, ok
+}
+
+// record adds attempt to the held delivery with ID id.
+func (q *webhookQueue) record(id string, attempt WebhookAttempt) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if d, ok := q.held[id]; ok {
+		d.Attempts = append(d.Attempts, attempt)
+		q.held[id] = d
+	}
+}
+
+// release stops holding the delivery with ID id and returns it.
+func (q *webhookQueue) release(id string) (WebhookDelivery, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	d, ok := q.held[id]
+	delete(q.held, id)
+	return d, ok
+}
+
+// notification returns d as a notification on ChannelWebhook, with the
+// failed attempts since it was created or last replayed.
+func (d WebhookDelivery) notification() Notification {
+	return Notification{ID: d.ID, Channel: ChannelWebhook, To: d.WebhookID, Attempts: d.Tries, NextAttempt: d.NextAttempt}
+}
+
+// Register serves the admin endpoints under WebhooksPath and incoming
+// webhooks under IncomingWebhooksPath on mux.
+func (h *Webhooks) Register(mux *http.ServeMux) {
+	mux.HandleFunc(WebhooksPath, h.HandleWebhooks)
+	mux.HandleFunc(WebhooksPath+"/", h.HandleWebhooks)
+	mux.HandleFunc(IncomingWebhooksPath, h.HandleIncoming)
+}
+
+// HandleWebhooks serves the admin endpoints, which only moderators and
+// holders of the AdminToken may use:
+//
+//	GET    /admin/webhooks                         list the webhooks
+//	POST   /admin/webhooks                         add the webhook in the body
+//	DELETE /admin/webhooks/{id}                    remove a webhook
+//	GET    /admin/webhooks/deliveries              list deliveries, newest first
+//	POST   /admin/webhooks/deliveries/{id}/replay  send a failed delivery again
+//	GET    /admin/webhooks/incoming                list the incoming webhooks
+//	POST   /admin/webhooks/incoming                add the one in the body
+//	DELETE /admin/webhooks/incoming/{id}           remove an incoming webhook
+//
+// Bodies are JSON. A new webhook needs a url, and may name a room and a
+// list of events; it is answered with its secret, generated unless given,
+// which is never shown again. Deliveries may be filtered with the status and
+// webhook query parameters and limited with limit, DefaultPageSize by
+// default. A new incoming webhook needs a room and may give the username its
+// messages are posted as; it is answered with its path, which holds its
+// token and is never shown again.
+func (h *Webhooks) HandleWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		WriteError(w, http.StatusForbidden, CodeForbidden, "Only administrators may manage webhooks")
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, WebhooksPath), "/")
+	switch parts := strings.Split(path, "/"); {
+	case path == "":
+		switch r.Method {
+		case http.MethodGet:
+			h.listWebhooks(w)
+		case http.MethodPost:
+			h.addWebhook(w, r)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+	case path == "deliveries":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		h.listDeliveries(w, r)
+	case path == "incoming":
+		switch r.Method {
+		case http.MethodGet:
+			h.listIncoming(w)
+		case http.MethodPost:
+			h.addIncoming(w, r)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+	case len(parts) == 2 && parts[0] == "incoming":
+		if r.Method != http.MethodDelete {
+			methodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		h.removeIncoming(w, parts[1])
+	case len(parts) == 3 && parts[0] == "deliveries" && parts[2] == "replay":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		h.replay(w, parts[1])
+	case len(parts) == 1:
+		if r.Method != http.MethodDelete {
+			methodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		h.removeWebhook(w, parts[0])
+	default:
+		WriteError(w, http.StatusNotFound, CodeNotFound, "Not found")
+	}
+}
+
+// authorized reports whether r may use the admin endpoints.
+func (h *Webhooks) authorized(r *http.Request) bool {
+	token := tokenFromRequest(r)
+	if h.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.AdminToken)) == 1 {
+		return true
+	}
+	auth := h.Server.Auth
+	if auth == nil {
+		return false
+	}
+	username, ok := auth.identify(r)
+	return ok && auth.IsModerator(username)
+}
+
+func (h *Webhooks) listWebhooks(w http.ResponseWriter) {
+	hooks, err := h.Store.Webhooks()
+	if err != nil {
+		log.Printf("Failed to read webhooks: %v", err)
+		WriteStoreError(w, err, "Failed to read webhooks")
+		return
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+func (h *Webhooks) addWebhook(w http.ResponseWriter, r *http.Request) {
+	var hook Webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+	if u, err := url.Parse(hook.URL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Webhook URL must be an absolute http or https URL")
+		return
+	}
+	if hook.Room != "" && !validRoom(hook.Room) {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRoom, "Invalid room")
+		return
+	}
+	for _, event := range hook.Events {
+		if !validWebhookEvent(event) {
+			WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Unknown event "+strconv.Quote(event)+"; events are "+strings.Join(webhookEvents, ", "))
+			return
+		}
+	}
+
+	hook.ID = h.ids.New()
+	hook.CreatedAt = time.Now().UTC()
+	if hook.Secret == "" {
+		hook.Secret = randomToken()
+	}
+	if err := h.Store.PutWebhook(hook); err != nil {
+		log.Printf("Failed to add webhook: %v", err)
+		WriteStoreError(w, err, "Failed to add webhook")
+		return
+	}
+	w.Header().Set("Location", WebhooksPath+"/"+hook.ID)
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+func validWebhookEvent(name string) bool {
+	for _, event := range webhookEvents {
+		if event == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Webhooks) removeWebhook(w http.ResponseWriter, id string) {
+	if err := h.Store.RemoveWebhook(id); errors.Is(err, ErrNotFound) {
+		WriteError(w, http.StatusNotFound, CodeNotFound, "Webhook not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to remove webhook %s: %v", id, err)
+		WriteStoreError(w, err, "Failed to remove webhook")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Webhooks) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := DefaultPageSize
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > MaxWebhookDeliveries {
+			WriteError(w, http.StatusBadRequest, CodeInvalidQuery, "Invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	deliveries, err := h.Store.Deliveries(query.Get("status"), query.Get("webhook"), limit)
+	if err != nil {
+		log.Printf("Failed to read webhook deliveries: %v", err)
+		WriteStoreError(w, err, "Failed to read deliveries")
+		return
+	}
+	if deliveries == nil {
+		deliveries = []WebhookDelivery{}
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// replay makes the failed delivery with ID id pending again, with a fresh
+// set of attempts, and answers with it.
+func (h *Webhooks) replay(w http.ResponseWriter, id string) {
+	d, err := h.Store.Delivery(id)
+	if errors.Is(err, ErrNotFound) {
+		WriteError(w, http.StatusNotFound, CodeNotFound, "Delivery not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to read webhook delivery %s: %v", id, err)
+		WriteStoreError(w, err, "Failed to read delivery")
+		return
+	}
+	if d.Status != DeliveryFailed {
+		WriteError(w, http.StatusConflict, CodeInvalidBody, "Only failed deliveries can be replayed")
+		return
+	}
+
+	d.Status, d.Tries, d.NextAttempt = DeliveryPending, 0, time.Now().UTC()
+	if err := h.Store.PutDelivery(d); err != nil {
+		log.Printf("Failed to replay webhook delivery %s: %v", id, err)
+		WriteStoreError(w, err, "Failed to replay delivery")
+		return
+	}
+	h.Dispatcher.poke()
+	writeJSON(w, http.StatusAccepted, d)
+}
@@ -0,0 +1,503 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const testAdminToken = "admin-token"
+
+// webhookRequest is a request received by a webhookReceiver.
+type webhookRequest struct {
+	Path    string
+	Header  http.Header
+	Payload WebhookPayload
+	Body    []byte
+}
+
+// webhookReceiver is an endpoint webhooks can be registered at. It answers
+// a request to a path with the next of the statuses set for the path, and
+// with 200 OK once they are used up.
+type webhookReceiver struct {
+	*httptest.Server
+	received chan webhookRequest
+
+	mutex    sync.Mutex
+	statuses map[string][]int
+}
+
+func startWebhookReceiver(t *testing.T) *webhookReceiver {
+	receiver := &webhookReceiver{received: make(chan webhookRequest, 20), statuses: make(map[string][]int)}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request := webhookRequest{Path: r.URL.Path, Header: r.Header, Body: body}
+		json.Unmarshal(body, &request.Payload)
+		receiver.received <- request
+
+		receiver.mutex.Lock()
+		defer receiver.mutex.Unlock()
+		if statuses := receiver.statuses[r.URL.Path]; len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			receiver.statuses[r.URL.Path] = statuses[1:]
+		}
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func (receiver *webhookReceiver) answer(path string, statuses ...int) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.statuses[path] = statuses
+}
+
+// next returns the next n requests, sorted by path and event.
+func (receiver *webhookReceiver) next(t *testing.T, n int) []webhookRequest {
+	t.Helper()
+	var requests []webhookRequest
+	for len(requests) < n {
+		select {
+		case request := <-receiver.received:
+			requests = append(requests, request)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d webhook requests, want %d", len(requests), n)
+		}
+	}
+	sort.SliceStable(requests, func(i, j int) bool {
+		if requests[i].Path != requests[j].Path {
+			return requests[i].Path < requests[j].Path
+		}
+		return requests[i].Payload.Event < requests[j].Payload.Event
+	})
+	return requests
+}
+
+// none fails the test if a request arrives soon.
+func (receiver *webhookReceiver) none(t *testing.T) {
+	t.Helper()
+	select {
+	case request := <-receiver.received:
+		t.Errorf("unexpected %s webhook to %s: %s", request.Payload.Event, request.Path, request.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// startWebhooks returns a server with running Webhooks that retry quickly
+// and give up after three attempts, and a test server for its handlers.
+func startWebhooks(t *testing.T, store WebhookStore) (*Server, *Webhooks, *httptest.Server) {
+	t.Helper()
+	s := NewServer(NewMemoryStore())
+	s.Auth = NewAuthenticator(testKey, StaticUsers{"ann": "secret", "bob": "secret"})
+	s.Auth.Moderators = []string{"ann"}
+	s.PresenceTimeout = 60 * time.Millisecond
+	webhooks := NewWebhooks(s, store)
+	webhooks.AdminToken = testAdminToken
+	webhooks.Dispatcher.MaxAttempts = 3
+	webhooks.Dispatcher.Backoff = 20 * time.Millisecond
+	webhooks.Dispatcher.PollInterval = 5 * time.Millisecond
+	go s.Run()
+	go webhooks.Run()
+
+	mux := http.NewServeMux()
+	s.Register(mux)
+	webhooks.Register(mux)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return s, webhooks, ts
+}
+
+// admin makes a request to the admin endpoints with token and decodes the
+// JSON answer into v, if it is not nil.
+func admin(t *testing.T, ts *httptest.Server, token, method, path, body string, v interface{}) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp.StatusCode
+}
+
+func TestWebhooks(t *testing.T) {
+	s, _, ts := startWebhooks(t, NewMemoryWebhookStore())
+	receiver := startWebhookReceiver(t)
+
+	var all, other Webhook
+	if status := admin(t, ts, testAdminToken, http.MethodPost, WebhooksPath, fmt.Sprintf(`{"url": %q, "room": "general"}`, receiver.URL+"/all"), &all); status != http.StatusCreated || all.Secret == "" {
+		t.Fatalf("adding a webhook: %d %+v", status, all)
+	}
+	admin(t, ts, testAdminToken, http.MethodPost, WebhooksPath, fmt.Sprintf(`{"url": %q, "room": "other", "events": ["message.created"], "secret": "shh"}`, receiver.URL+"/other"), &other)
+
+	posted, _ := s.Post(Message{Username: "ann", Content: "hello"})
+	s.Edit(DefaultRoom, posted.ID, "ann", "hello!")
+	s.React(DefaultRoom, posted.ID, "bob", "👍")
+	s.Delete(DefaultRoom, posted.ID, "ann")
+	s.Post(Message{Username: "ann", To: []string{"bob"}, Content: "psst"})
+	s.Post(Message{Username: "bob", Room: "other", Content: "elsewhere"})
+	s.Post(Message{Username: "bob", Room: "third", Content: "unwatched"})
+
+	requests := receiver.next(t, 4)
+	for i, want := range []struct{ path, event, content string }{
+		{"/all", WebhookMessageCreated, "hello"},
+		{"/all", WebhookMessageDeleted, ""},
+		{"/all", WebhookMessageEdited, "hello!"},
+		{"/other", WebhookMessageCreated, "elsewhere"},
+	} {
+		got := requests[i]
+		if got.Path != want.path || got.Payload.Event != want.event || got.Payload.Message == nil || got.Payload.Message.Content != want.content {
+			t.Errorf("request %d = %s %s %+v, want %s %s %q", i, got.Path, got.Payload.Event, got.Payload.Message, want.path, want.event, want.content)
+		}
+		if got.Header.Get(WebhookEventHeader) != want.event || got.Header.Get(WebhookDeliveryHeader) == "" {
+			t.Errorf("request %d headers = %v", i, got.Header)
+		}
+		secret := all.Secret
+		if want.path == "/other" {
+			secret = "shh"
+		}
+		if signature := WebhookSignature(secret, got.Header.Get(WebhookTimestampHeader), got.Body); got.Header.Get(WebhookSignatureHeader) != signature {
+			t.Errorf("request %d signed %s, want %s", i, got.Header.Get(WebhookSignatureHeader), signature)
+		}
+	}
+	receiver.none(t)
+
+	leave := s.join(httptest.NewRequest(http.MethodGet, "/ws?username=carol", nil), DefaultRoom)
+	s.join(httptest.NewRequest(http.MethodGet, "/ws?username=dave", nil), DefaultRoom)
+	leave()
+	requests = receiver.next(t, 3)
+	if requests[0].Payload.Event != WebhookUserJoined || requests[1].Payload.Event != WebhookUserJoined || requests[2].Payload.Event != WebhookUserLeft || requests[2].Payload.Username != "carol" {
+		t.Errorf("presence webhooks = %+v", requests)
+	}
+	// Users staying connected are not announced again.
+	time.Sleep(3 * s.PresenceTimeout)
+	receiver.none(t)
+
+	var listed []Webhook
+	admin(t, ts, testAdminToken, http.MethodGet, WebhooksPath, "", &listed)
+	if len(listed) != 2 || listed[0].Secret != "" || listed[1].URL != receiver.URL+"/other" {
+		t.Errorf("listed webhooks = %+v", listed)
+	}
+	if status := admin(t, ts, testAdminToken, http.MethodDelete, WebhooksPath+"/"+other.ID, "", nil); status != http.StatusNoContent {
+		t.Errorf("removing a webhook: %d", status)
+	}
+	s.Post(Message{Username: "bob", Room: "other", Content: "gone"})
+	receiver.none(t)
+
+	for _, body := range []string{`{"url": "ftp://example.com"}`, `{"url": "http://example.com", "events": ["message.read"]}`, `{"url": "http://example.com", "room": "no spaces"}`} {
+		if status := admin(t, ts, testAdminToken, http.MethodPost, WebhooksPath, body, nil); status != http.StatusBadRequest {
+			t.Errorf("adding %s: %d, want 400", body, status)
+		}
+	}
+}
+
+func TestWebhookRetriesAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	store, err := NewFileWebhookStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, ts := startWebhooks(t, store)
+	receiver := startWebhookReceiver(t)
+	receiver.answer("/flaky", http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	receiver.answer("/gone", http.StatusGone)
+	receiver.answer("/down", http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+
+	_, token := login(t, ts, "ann", "secret")
+	_, bobToken := login(t, ts, "bob", "secret")
+	for _, endpoint := range []string{"/flaky", "/gone", "/down"} {
+		// Moderators may manage webhooks too.
+		if status := admin(t, ts, token, http.MethodPost, WebhooksPath, fmt.Sprintf(`{"url": %q}`, receiver.URL+endpoint), nil); status != http.StatusCreated {
+			t.Fatalf("adding a webhook as a moderator: %d", status)
+		}
+	}
+	if status := admin(t, ts, bobToken, http.MethodGet, WebhooksPath, "", nil); status != http.StatusForbidden {
+		t.Errorf("listing webhooks as bob: %d, want 403", status)
+	}
+
+	s.Post(Message{Username: "ann", Content: "anyone there?"})
+	// Three attempts to /flaky and /down, one to /gone.
+	requests := receiver.next(t, 7)
+	if requests[0].Path != "/down" || requests[3].Path != "/flaky" || requests[6].Path != "/gone" {
+		t.Errorf("requests went to %v", requests)
+	}
+	if requests[3].Header.Get(WebhookDeliveryHeader) != requests[5].Header.Get(WebhookDeliveryHeader) || string(requests[3].Body) != string(requests[5].Body) {
+		t.Error("retries differ from the first attempt")
+	}
+	receiver.none(t)
+
+	var failed []WebhookDelivery
+	for deadline := time.Now().Add(5 * time.Second); len(failed) < 2 && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		admin(t, ts, testAdminToken, http.MethodGet, WebhooksPath+"/deliveries?status=failed", "", &failed)
+	}
+	if len(failed) != 2 {
+		t.Fatalf("failed deliveries = %+v", failed)
+	}
+	byTries := map[int]WebhookDelivery{}
+	for _, d := range failed {
+		byTries[len(d.Attempts)] = d
+	}
+	gone, down := byTries[1], byTries[3]
+	if gone.Attempts[0].StatusCode != http.StatusGone || down.Attempts[2].StatusCode != http.StatusInternalServerError || down.Attempts[2].Error == "" {
+		t.Errorf("attempts = %+v and %+v", gone.Attempts, down.Attempts)
+	}
+	var delivered []WebhookDelivery
+	admin(t, ts, testAdminToken, http.MethodGet, WebhooksPath+"/deliveries?status=delivered", "", &delivered)
+	if len(delivered) != 1 || len(delivered[0].Attempts) != 3 || delivered[0].Attempts[2].StatusCode != http.StatusOK {
+		t.Errorf("delivered = %+v", delivered)
+	}
+
+	// The endpoint is back up.
+	if status := admin(t, ts, testAdminToken, http.MethodPost, WebhooksPath+"/deliveries/"+down.ID+"/replay", "", nil); status != http.StatusAccepted {
+		t.Fatalf("replaying: %d", status)
+	}
+	if request := receiver.next(t, 1)[0]; request.Path != "/down" || request.Header.Get(WebhookDeliveryHeader) != down.ID {
+		t.Errorf("replayed to %s as %s", request.Path, request.Header.Get(WebhookDeliveryHeader))
+	}
+	if status := admin(t, ts, testAdminToken, http.MethodPost, WebhooksPath+"/deliveries/"+delivered[0].ID+"/replay", "", nil); status != http.StatusConflict {
+		t.Errorf("replaying a delivered delivery: %d, want 409", status)
+	}
+	if status := admin(t, ts, testAdminToken, http.MethodPost, WebhooksPath+"/deliveries/nope/replay", "", nil); status != http.StatusNotFound {
+		t.Errorf("replaying a missing delivery: %d, want 404", status)
+	}
+
+	// Deliveries are still there after a restart.
+	var replayed WebhookDelivery
+	for deadline := time.Now().Add(5 * time.Second); replayed.Status != DeliveryDelivered && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		replayed, _ = store.Delivery(down.ID)
+	}
+	reopened, err := NewFileWebhookStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := reopened.Delivery(down.ID); err != nil || d.Status != DeliveryDelivered || len(d.Attempts) != 4 || d.Tries != 1 {
+		t.Errorf("replayed delivery after reload = %+v, %v", d, err)
+	}
+	if hooks, _ := reopened.Webhooks(); len(hooks) != 3 || hooks[0].Secret == "" {
+		t.Errorf("webhooks after reload = %+v", hooks)
+	}
+}
+
+func TestDynamoWebhookStore(t *testing.T) {
+	svc := newFakeDynamoDB("Kind", "ID")
+	store := NewDynamoWebhookStore(svc, "Webhooks")
+
+	created := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	hook := Webhook{ID: "01HV0000000000000000000001", URL: "http://example.com", Secret: "shh", CreatedAt: created}
+	incoming := IncomingWebhook{ID: "01HV0000000000000000000002", Room: DefaultRoom, Username: "ci", Token: "token", CreatedAt: created}
+	if err := store.PutWebhook(hook); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutIncomingWebhook(incoming); err != nil {
+		t.Fatal(err)
+	}
+	if item := svc.puts[0].Item; aws.StringValue(svc.puts[0].TableName) != "Webhooks" || aws.StringValue(item["Kind"].S) != "webhook" || aws.StringValue(item["ID"].S) != hook.ID {
+		t.Errorf("put %v into %s", item, aws.StringValue(svc.puts[0].TableName))
+	}
+	// Each kind of item is a partition of its own.
+	if hooks, err := store.Webhooks(); err != nil || !reflect.DeepEqual(hooks, []Webhook{hook}) {
+		t.Errorf("Webhooks = %+v, %v", hooks, err)
+	}
+	if hooks, err := store.IncomingWebhooks(); err != nil || !reflect.DeepEqual(hooks, []IncomingWebhook{incoming}) {
+		t.Errorf("IncomingWebhooks = %+v, %v", hooks, err)
+	}
+
+	due := created.Add(time.Minute)
+	d := WebhookDelivery{ID: "01HV0000000000000000000003", WebhookID: hook.ID, Event: WebhookMessageCreated, Payload: json.RawMessage(`{}`), Status: DeliveryPending, NextAttempt: due, CreatedAt: created}
+	if err := store.PutDelivery(d); err != nil {
+		t.Fatal(err)
+	}
+	if item := svc.puts[2].Item; aws.StringValue(item["Kind"].S) != "delivery.pending" || aws.StringValue(item["NextAttempt"].S) != "2024-01-02T15:05:05.000000000Z" || item["ExpiresAt"] != nil {
+		t.Errorf("pending delivery item = %v", item)
+	}
+
+	// Pending deliveries are found through the index of their next
+	// attempts.
+	if got, err := store.DueDeliveries(created, 10); err != nil || len(got) != 0 {
+		t.Errorf("DueDeliveries before any is due = %+v, %v", got, err)
+	}
+	if got, err := store.DueDeliveries(due, 10); err != nil || len(got) != 1 || got[0].ID != d.ID {
+		t.Errorf("DueDeliveries = %+v, %v", got, err)
+	}
+	if query := svc.queries[len(svc.queries)-1]; aws.StringValue(query.IndexName) != "Due" || aws.StringValue(query.KeyConditionExpression) != "#kind = :kind AND #next <= :now" || aws.StringValue(query.ExpressionAttributeValues[":now"].S) != "2024-01-02T15:05:05.000000000Z" {
+		t.Errorf("DueDeliveries queried %v", query)
+	}
+	if got, err := store.Webhook(hook.ID); err != nil || !reflect.DeepEqual(got, hook) {
+		t.Errorf("Webhook = %+v, %v", got, err)
+	}
+
+	// Only one of the replicas that saw the delivery fall due claims it.
+	stale := d
+	stale.NextAttempt = created
+	until := due.Add(webhookLease)
+	if claimed, err := store.ClaimDelivery(stale, until); claimed || err != nil {
+		t.Errorf("ClaimDelivery of a stale delivery = %v, %v", claimed, err)
+	}
+	if claimed, err := store.ClaimDelivery(d, until); !claimed || err != nil {
+		t.Errorf("ClaimDelivery = %v, %v", claimed, err)
+	}
+	if claimed, err := store.ClaimDelivery(d, until); claimed || err != nil {
+		t.Errorf("ClaimDelivery of a claimed delivery = %v, %v", claimed, err)
+	}
+	if got, err := store.Delivery(d.ID); err != nil || !got.NextAttempt.Equal(until) {
+		t.Errorf("claimed delivery = %+v, %v", got, err)
+	}
+
+	// Finished deliveries move to a partition of their own and expire.
+	d.Status, d.NextAttempt = DeliveryDelivered, time.Time{}
+	if err := store.PutDelivery(d); err != nil {
+		t.Fatal(err)
+	}
+	if item := svc.puts[len(svc.puts)-1].Item; aws.StringValue(item["Kind"].S) != "delivery.finished" || item["ExpiresAt"] == nil || item["NextAttempt"] != nil {
+		t.Errorf("finished delivery item = %v", item)
+	}
+	if pending, err := store.Deliveries(DeliveryPending, "", 0); err != nil || len(pending) != 0 {
+		t.Errorf("pending deliveries = %+v, %v", pending, err)
+	}
+	if got, err := store.Delivery(d.ID); err != nil || !reflect.DeepEqual(got, d) {
+		t.Errorf("Delivery = %+v, %v; want %+v", got, err, d)
+	}
+	if claimed, err := store.ClaimDelivery(d, until); claimed || err != nil {
+		t.Errorf("ClaimDelivery of a delivered delivery = %v, %v", claimed, err)
+	}
+
+	newer := WebhookDelivery{ID: "01HV0000000000000000000004", WebhookID: "other", Payload: json.RawMessage(`{}`), Status: DeliveryPending, NextAttempt: due}
+	store.PutDelivery(newer)
+	if all, err := store.Deliveries("", "", 0); err != nil || len(all) != 2 || all[0].ID != newer.ID || all[1].ID != d.ID {
+		t.Errorf("all deliveries = %+v, %v", all, err)
+	}
+	if latest, _ := store.Deliveries("", "", 1); len(latest) != 1 || latest[0].ID != newer.ID {
+		t.Errorf("latest delivery = %+v", latest)
+	}
+	if delivered, _ := store.Deliveries(DeliveryDelivered, hook.ID, 0); len(delivered) != 1 || delivered[0].ID != d.ID {
+		t.Errorf("delivered deliveries of %s = %+v", hook.ID, delivered)
+	}
+
+	if err := store.RemoveWebhook(hook.ID); err != nil {
+		t.Errorf("RemoveWebhook: %v", err)
+	}
+	if err := store.RemoveWebhook(hook.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RemoveWebhook of a removed webhook: %v, want ErrNotFound", err)
+	}
+	if _, err := store.Delivery("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delivery of a missing delivery: %v, want ErrNotFound", err)
+	}
+}
+
+// startWebhookReplicas starts two servers sharing a bus and running
+// Webhooks on store, as replicas behind a load balancer would, and returns
+// test servers for their handlers.
+func startWebhookReplicas(t *testing.T, store WebhookStore) (a, b *Server, tsA, tsB *httptest.Server) {
+	t.Helper()
+	bus := NewMemoryBus()
+	start := func() (*Server, *httptest.Server) {
+		s := NewServer(NewMemoryStore())
+		if err := s.AttachBus(bus); err != nil {
+			t.Fatal(err)
+		}
+		webhooks := NewWebhooks(s, store)
+		webhooks.AdminToken = testAdminToken
+		webhooks.Dispatcher.PollInterval = 5 * time.Millisecond
+		go s.Run()
+		go webhooks.Run()
+
+		mux := http.NewServeMux()
+		s.Register(mux)
+		webhooks.Register(mux)
+		ts := httptest.NewServer(mux)
+		t.Cleanup(ts.Close)
+		return s, ts
+	}
+	a, tsA = start()
+	b, tsB = start()
+	return a, b, tsA, tsB
+}
+
+func TestWebhooksAcrossReplicas(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	s.AttachBus(NewMemoryBus())
+	if _, err := OpenWebhooks(WebhookConfig{}, s); !errors.Is(err, ErrUnsharedWebhooks) {
+		t.Errorf("OpenWebhooks on a replica without a table: %v, want ErrUnsharedWebhooks", err)
+	}
+
+	svc := newFakeDynamoDB("Kind", "ID")
+	store := NewDynamoWebhookStore(svc, DefaultWebhookTable)
+	a, b, tsA, tsB := startWebhookReplicas(t, store)
+	receiver := startWebhookReceiver(t)
+
+	// A webhook added through one replica is sent events from both, once
+	// each, although both see them through the bus.
+	if status := admin(t, tsA, testAdminToken, http.MethodPost, WebhooksPath, fmt.Sprintf(`{"url": %q}`, receiver.URL+"/all"), nil); status != http.StatusCreated {
+		t.Fatalf("adding a webhook: %d", status)
+	}
+	a.Post(Message{Username: "ann", Content: "from a"})
+	b.Post(Message{Username: "bob", Content: "from b"})
+	var contents []string
+	for _, request := range receiver.next(t, 2) {
+		contents = append(contents, request.Payload.Message.Content)
+	}
+	sort.Strings(contents)
+	if !reflect.DeepEqual(contents, []string{"from a", "from b"}) {
+		t.Errorf("sent %v", contents)
+	}
+	receiver.none(t)
+
+	var delivered []WebhookDelivery
+	for deadline := time.Now().Add(5 * time.Second); len(delivered) < 2 && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		admin(t, tsB, testAdminToken, http.MethodGet, WebhooksPath+"/deliveries?status=delivered", "", &delivered)
+	}
+	if len(delivered) != 2 || len(delivered[0].Attempts) != 1 || len(delivered[1].Attempts) != 1 {
+		t.Errorf("delivered = %+v", delivered)
+	}
+
+	// Polling for due deliveries reads only those, through the index.
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+	for _, query := range svc.queries {
+		if aws.StringValue(query.ExpressionAttributeValues[":kind"].S) == kindPendingDelivery && query.IndexName == nil {
+			t.Errorf("pending deliveries queried without the index: %v", query)
+		}
+	}
+}
+
+func TestWebhookEventBackpressure(t *testing.T) {
+	webhooks := NewWebhooks(NewServer(NewMemoryStore()), NewMemoryWebhookStore())
+	event := Event{Type: EventMessage, Room: DefaultRoom, Message: &Message{Content: "hi"}}
+	for i := 0; i < webhookEventBuffer; i++ {
+		webhooks.observe(event)
+	}
+
+	// With the buffer full, observing waits for room rather than dropping
+	// the event.
+	observed := make(chan struct{})
+	go func() {
+		webhooks.observe(Event{Type: EventMessage, Room: DefaultRoom, Message: &Message{Content: "last"}})
+		close(observed)
+	}()
+	select {
+	case <-observed:
+		t.Fatal("observing returned with the buffer full")
+	case <-time.After(webhookEventWait / 10):
+	}
+	<-webhooks.events
+	<-observed
+	if len(webhooks.events) != webhookEventBuffer {
+		t.Errorf("%d events buffered, want %d", len(webhooks.events), webhookEventBuffer)
+	}
+}
@@ -0,0 +1,342 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Timeouts and limits of a WebSocket connection.
+const (
+	writeWait      = 10 * time.Second  // How long a single write may take
+	pongWait       = 60 * time.Second  // How long the client may stay silent
+	pingPeriod     = pongWait * 9 / 10 // How often the server pings
+	maxFrameSize   = 64 * 1024         // Largest frame accepted from the client
+	replyQueueSize = 16                // Acks, errors and pongs waiting to be written
+)
+
+// Frame types of the WebSocket protocol.
+const (
+	FrameMessage  = EventMessage  // Post a message; a message was posted
+	FrameEdit     = "edit"        // Edit a message
+	FrameDelete   = "delete"      // Delete a message
+	FrameReact    = "react"       // React to a message
+	FrameUnreact  = "unreact"     // Take back a reaction to a message
+	FrameRead     = EventRead     // Messages were read up to this one; a user read them
+	FrameUpdate   = EventUpdate   // A message was edited or deleted
+	FrameTyping   = EventTyping   // The user is typing; a user is typing
+	FramePresence = EventPresence // A user joined or left
+	FrameAck      = "ack"         // A message frame was stored
+	FrameError    = "error"       // A frame was rejected
+	FramePing     = "ping"        // Application-level ping, for clients that cannot send control frames
+	FramePong     = "pong"        // Answer to a ping frame
+)
+
+// Frame is the envelope of every JSON value sent over a WebSocket in either
+// direction. Clients send:
+//
+//	{"type": "message", "id": "r1",
+//	 "message": {"username": "ann", "content": "hi"}}
+//	{"type": "edit", "id": "r2",
+//	 "message": {"id": "01H...", "content": "hello"}}
+//	{"type": "delete", "id": "r3", "message": {"id": "01H..."}}
+//	{"type": "react", "id": "r4",
+//	 "message": {"id": "01H..."}, "emoji": "👍"}
+//	{"type": "unreact", "id": "r5",
+//	 "message": {"id": "01H..."}, "emoji": "👍"}
+//	{"type": "read", "id": "r8", "message": {"id": "01H..."}}
+//	{"type": "typing", "username": "ann"}
+//	{"type": "ping", "id": "p1"}
+//
+// A message, edit, delete, react or unreact frame is answered with an ack
+// carrying the same id and the message as stored, once the store has
+// accepted it, or with an error carrying the same id. A message that
+// replies to another names it in its reply_to field. Only a message's
+// author or a moderator may edit or delete it. A ping is answered with a
+// pong. A read frame, which records that the user has read the room, or
+// the direct conversation named by the message's to field, up to the
+// message, is answered with an ack without a message. The server also sends
+// message, update, typing, presence and read frames for what happens in the
+// room; a presence frame tells whether a user is now online:
+//
+//	{"type": "presence", "username": "ann",
+//	 "presence": {"username": "ann", "online": false, "last_seen": "..."}}
+//
+// A client is online while its connection is open if it is authenticated or
+// names itself in the username query parameter.
+//
+// A message frame whose message lists usernames in its to field sends a
+// direct message to them; the direct messages of the client's
+// authenticated user arrive as message frames whatever room it joined.
+// Clients that are not authenticated can neither send nor receive them. Frames that change a direct
+// message name its conversation the same way:
+//
+//	{"type": "message", "id": "r6",
+//	 "message": {"to": ["bob"], "content": "psst"}}
+//	{"type": "edit", "id": "r7",
+//	 "message": {"id": "01H...", "to": ["bob"], "content": "psst!"}}
+//
+// Independently of ping frames, the server sends WebSocket pings and closes
+// connections that have been silent, answering neither frames nor pings, for
+// longer than a minute.
+type Frame struct {
+	Type     string         `json:"type"`               // One of the Frame constants
+	ID       string         `json:"id,omitempty"`       // Client request ID, echoed in the ack, error or pong
+	Message  *Message       `json:"message,omitempty"`  // For message and ack frames
+	Username string         `json:"username,omitempty"` // For typing and presence frames
+	Emoji    string         `json:"emoji,omitempty"`    // For react and unreact frames
+	Presence *Presence      `json:"presence,omitempty"` // For presence frames
+	Error    *ErrorResponse `json:"error,omitempty"`    // For error frames
+}
+
+// eventFrame returns the frame that tells a client about event.
+func eventFrame(event Event) Frame {
+	return Frame{Type: event.Type, Message: event.Message, Username: event.Username, Presence: event.Presence}
+}
+
+// errorFrame returns an error frame answering the request with ID id.
+func errorFrame(id, code, message string) Frame {
+	return Frame{Type: FrameError, ID: id, Error: &ErrorResponse{Code: code, Message: message}}
+}
+
+// HandleWebSocket upgrades the connection to a WebSocket joined to the room
+// named by the room query parameter, DefaultRoom if unset, and speaks the
+// protocol described by Frame over it. If the request is authenticated, the
+// messages and typing frames it sends carry the authenticated username
+// whatever the client says. If the since query parameter names a
+// message ID, the messages newer than it are sent first, as with
+// HandleReceive.
+func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	room, ok := roomParam(r)
+	if !ok {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRoom, "Invalid room")
+		return
+	}
+
+	since := r.URL.Query().Get("since")
+
+	clientID, events, backlog, err := s.resume(room, directUser(r), since)
+	if err != nil {
+		log.Printf("Failed to get messages since %s: %v", since, err)
+		WriteStoreError(w, err, "Failed to get messages")
+		return
+	}
+	defer s.Hub.Unsubscribe(clientID)
+
+	upgrader := s.Upgrader
+	if upgrader.Error == nil {
+		upgrader.Error = upgradeError
+	}
+	if upgrader.CheckOrigin == nil {
+		// Browsers send cookies and HTTP credentials with WebSocket
+		// handshakes from any page, so a page on a hostile site must not
+		// be able to open one.
+		upgrader.CheckOrigin = s.originAllowed
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already answered the request.
+		return
+	}
+	defer conn.Close()
+	defer s.join(r, room)()
+
+	conn.SetReadLimit(maxFrameSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	// Only one goroutine may write to the connection. The writer goroutine
+	// drains this client's queue and the replies to its frames, so a slow
+	// or stuck connection only ever holds up itself.
+	replies := make(chan Frame, replyQueueSize)
+	done := make(chan struct{})
+	go writeFrames(conn, events, backlog, replies, done)
+
+	reply := func(frame Frame) {
+		select {
+		case replies <- frame:
+		case <-done:
+		}
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println("WebSocket read error:", err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		var frame Frame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			reply(errorFrame("", CodeInvalidFrame, "Invalid frame"))
+			continue
+		}
+
+		switch frame.Type {
+		case FrameMessage:
+			if frame.Message == nil {
+				reply(errorFrame(frame.ID, CodeInvalidFrame, "Message frame without a message"))
+				continue
+			}
+			message := *frame.Message
+			message.Room = room
+			stampUser(r, &message)
+			message, err := s.Post(message)
+			if err != nil {
+				if errors.Is(err, ErrInvalidReply) {
+					reply(errorFrame(frame.ID, CodeInvalidReply, "Message to reply to not found"))
+					continue
+				}
+				if errors.Is(err, ErrInvalidConversation) {
+					reply(errorFrame(frame.ID, CodeInvalidConversation, conversationErrorMessage))
+					continue
+				}
+				log.Println("Failed to save message:", err)
+				code := CodeInternal
+				if errors.Is(err, ErrUnavailable) {
+					code = CodeUnavailable
+				}
+				reply(errorFrame(frame.ID, code, "Failed to save message"))
+				continue
+			}
+			reply(Frame{Type: FrameAck, ID: frame.ID, Message: &message})
+		case FrameEdit, FrameDelete, FrameReact, FrameUnreact:
+			if frame.Message == nil || frame.Message.ID == "" {
+				reply(errorFrame(frame.ID, CodeInvalidFrame, "Frame without a message ID"))
+				continue
+			}
+			request := *frame.Message
+			stampUser(r, &request)
+			target := room
+			if request.Direct() {
+				target, _, err = conversation(request.Username, request.To)
+			}
+			var message Message
+			if err == nil {
+				switch frame.Type {
+				case FrameEdit:
+					message, err = s.Edit(target, request.ID, request.Username, request.Content)
+				case FrameDelete:
+					message, err = s.Delete(target, request.ID, request.Username)
+				case FrameReact:
+					message, err = s.React(target, request.ID, request.Username, frame.Emoji)
+				case FrameUnreact:
+					message, err = s.Unreact(target, request.ID, request.Username, frame.Emoji)
+				}
+			}
+			if err != nil {
+				status, code, text := changeError(err)
+				if status >= http.StatusInternalServerError {
+					log.Printf("Failed to change message %s: %v", request.ID, err)
+				}
+				reply(errorFrame(frame.ID, code, text))
+				continue
+			}
+			reply(Frame{Type: FrameAck, ID: frame.ID, Message: &message})
+		case FrameRead:
+			if frame.Message == nil || frame.Message.ID == "" {
+				reply(errorFrame(frame.ID, CodeInvalidFrame, "Frame without a message ID"))
+				continue
+			}
+			request := *frame.Message
+			stampUser(r, &request)
+			target := room
+			if request.Direct() {
+				target, _, err = conversation(request.Username, request.To)
+			}
+			if err == nil {
+				err = s.MarkRead(target, request.Username, request.ID)
+			}
+			if err != nil {
+				status, code, text := readError(err)
+				if status >= http.StatusInternalServerError {
+					log.Printf("Failed to mark %s read: %v", request.ID, err)
+				}
+				reply(errorFrame(frame.ID, code, text))
+				continue
+			}
+			reply(Frame{Type: FrameAck, ID: frame.ID})
+		case FrameTyping:
+			username := frame.Username
+			if user, ok := User(r); ok {
+				username = user
+			}
+			if username != "" {
+				s.Typing(room, username)
+			}
+		case FramePing:
+			reply(Frame{Type: FramePong, ID: frame.ID})
+		default:
+			reply(errorFrame(frame.ID, CodeInvalidFrame, "Unknown frame type"))
+		}
+	}
+}
+
+// writeFrames writes the backlog, then the client's events and the replies
+// to its frames, pinging it while idle. It closes done when it stops.
+func writeFrames(conn *websocket.Conn, events <-chan Event, backlog []Message, replies <-chan Frame, done chan<- struct{}) {
+	defer close(done)
+	defer conn.Close()
+
+	write := func(frame Frame) bool {
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := conn.WriteJSON(frame); err != nil {
+			log.Println("WebSocket write error:", err)
+			return false
+		}
+		return true
+	}
+
+	// Messages read from the store may also arrive from the hub; skip them
+	// the second time.
+	sent := make(map[string]bool)
+	for _, message := range backlog {
+		message := message
+		if !write(Frame{Type: FrameMessage, Message: &message}) {
+			return
+		}
+		sent[message.ID] = true
+	}
+
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// Either the handler is returning, or the hub evicted
+				// this client for falling behind. Tell the client in the
+				// latter case; in the former the write fails harmlessly.
+				closeWebSocket(conn, websocket.CloseTryAgainLater, "Client fell behind")
+				return
+			}
+			if event.Type == EventMessage && sent[event.Message.ID] {
+				delete(sent, event.Message.ID)
+				continue
+			}
+			if !write(eventFrame(event)) {
+				return
+			}
+		case frame := <-replies:
+			if !write(frame) {
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
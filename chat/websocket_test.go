@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialWebSocket(t *testing.T, s *Server, query string) *websocket.Conn {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWebSocket))
+	t.Cleanup(ts.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readFrame reads frames until one of the given type arrives.
+func readFrame(t *testing.T, conn *websocket.Conn, frameType string) Frame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var frame Frame
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("waiting for %s frame: %v", frameType, err)
+		}
+		if frame.Type == frameType {
+			return frame
+		}
+	}
+}
+
+func TestWebSocketAck(t *testing.T) {
+	store := NewMemoryStore()
+	s := NewServer(store)
+	go s.Run()
+	conn := dialWebSocket(t, s, "?room=ops")
+
+	conn.WriteJSON(Frame{Type: FrameMessage, ID: "r1", Message: &Message{Username: "ann", Content: "hi"}})
+
+	ack := readFrame(t, conn, FrameAck)
+	if ack.ID != "r1" || ack.Message == nil || ack.Message.ID == "" || ack.Message.Room != "ops" {
+		t.Fatalf("ack = %+v, want request r1 with the stored message", ack)
+	}
+	if _, err := store.Get("ops", ack.Message.ID); err != nil {
+		t.Errorf("acked message not stored: %v", err)
+	}
+}
+
+func TestWebSocketErrorFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		store MessageStore
+		frame string
+		id    string
+		code  string
+	}{
+		{"invalid JSON", NewMemoryStore(), "not json", "", CodeInvalidFrame},
+		{"unknown type", NewMemoryStore(), `{"type":"shout","id":"r1"}`, "r1", CodeInvalidFrame},
+		{"no message", NewMemoryStore(), `{"type":"message","id":"r2"}`, "r2", CodeInvalidFrame},
+		{"store unavailable", failingStore{ErrUnavailable}, `{"type":"message","id":"r3","message":{}}`, "r3", CodeUnavailable},
+		{"store broken", failingStore{errors.New("disk full")}, `{"type":"message","id":"r4","message":{}}`, "r4", CodeInternal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(tt.store)
+			go s.Run()
+			conn := dialWebSocket(t, s, "")
+
+			conn.WriteMessage(websocket.TextMessage, []byte(tt.frame))
+			frame := readFrame(t, conn, FrameError)
+			if frame.ID != tt.id || frame.Error == nil || frame.Error.Code != tt.code {
+				t.Errorf("error frame = %+v, want id %q and code %s", frame, tt.id, tt.code)
+			}
+
+			// The connection survives the error.
+			conn.WriteJSON(Frame{Type: FramePing, ID: "p1"})
+			if pong := readFrame(t, conn, FramePong); pong.ID != "p1" {
+				t.Errorf("pong = %+v, want id p1", pong)
+			}
+		})
+	}
+}
+
+func TestWebSocketTyping(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	go s.Run()
+	ann := dialWebSocket(t, s, "")
+	bob := dialWebSocket(t, s, "")
+
+	// Wait for bob to be subscribed before ann starts typing.
+	bob.WriteJSON(Frame{Type: FramePing})
+	readFrame(t, bob, FramePong)
+
+	ann.WriteJSON(Frame{Type: FrameTyping, Username: "ann"})
+	if frame := readFrame(t, bob, FrameTyping); frame.Username != "ann" {
+		t.Errorf("typing frame = %+v, want ann", frame)
+	}
+}
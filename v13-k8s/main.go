@@ -1,143 +1,66 @@
 package main
 
 import (
-	"encoding/json"
-	"io/ioutil"
+	"errors"
 	"log"
 	"net/http"
-	"os"
-	"sync"
-	"time"
-)
-
-type Message struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-	Content  string `json:"content"`
-}
 
-var (
-	clients       = make(map[int]chan Message) // Connected clients
-	broadcast     = make(chan Message)         // Broadcast channel
-	mutex         sync.Mutex                   // Mutex to synchronize access to clients map
-	messages      []Message                    // In-memory storage for chat messages
-	nextClientID  = 1                          // Next client ID
-	nextMessageID = 1                          // Next message ID
+	"github.com/shubcodes/sdk-k8s_demo/chat"
 )
 
 const storageFile = "chat_messages.json"
 
 func main() {
-	http.HandleFunc("/send", handleSendMessage)
-	http.HandleFunc("/receive", handleReceiveMessage)
-	http.HandleFunc("/past_messages", handlePastMessages)
-	http.Handle("/", http.FileServer(http.Dir("./static"))) // Static file server
-
-	loadChatMessagesFromFile()
-
-	go broadcastMessages()
-
-	log.Println("Server started. Listening on port 8080...")
-	err := http.ListenAndServe(":8080", nil)
+	storeConfig := chat.StoreConfig{Backend: chat.StoreFile, Path: storageFile}.FromEnv()
+	store, err := chat.OpenStore(storeConfig)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Fatal("OpenStore: ", err)
 	}
-}
-
-func handleSendMessage(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	decoder := json.NewDecoder(r.Body)
-	var message Message
-	err := decoder.Decode(&message)
+	server := chat.NewServer(store)
+	server.Cursors, err = chat.OpenCursors(storeConfig)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-
-	message.ID = nextMessageID
-	nextMessageID++
-
-	broadcast <- message
-
-	saveChatMessagesToFile()
-}
-
-func handleReceiveMessage(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
-		return
+		log.Fatal("OpenCursors: ", err)
 	}
-
-	mutex.Lock()
-	clientID := nextClientID
-	clients[clientID] = make(chan Message, 1)
-	nextClientID++
-	mutex.Unlock()
-
-	select {
-	case message := <-clients[clientID]:
-		json.NewEncoder(w).Encode(message)
-	case <-time.After(30 * time.Second):
-		w.WriteHeader(http.StatusNoContent)
+	if err := chat.ConfigureHub(server.Hub, chat.HubConfig{}.FromEnv()); err != nil {
+		log.Fatal("ConfigureHub: ", err)
 	}
-
-	mutex.Lock()
-	delete(clients, clientID)
-	mutex.Unlock()
-}
-
-func handlePastMessages(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
-		return
+	if err := chat.ConfigureCORS(server, chat.CORSConfig{}.FromEnv()); err != nil {
+		log.Fatal("ConfigureCORS: ", err)
 	}
-
-	json.NewEncoder(w).Encode(messages)
-}
-
-func broadcastMessages() {
-	for message := range broadcast {
-		messages = append(messages, message)
-
-		mutex.Lock()
-		for _, client := range clients {
-			client <- message
-		}
-		mutex.Unlock()
+	server.Auth, err = chat.OpenAuth(chat.AuthConfig{}.FromEnv())
+	if err != nil {
+		log.Fatal("OpenAuth: ", err)
 	}
-}
 
-func saveChatMessagesToFile() {
-	data, err := json.Marshal(messages)
+	bus, err := chat.OpenBus(chat.BusConfig{}.FromEnv())
 	if err != nil {
-		log.Println("Error marshaling chat messages:", err)
-		return
+		log.Fatal("OpenBus: ", err)
+	}
+	if err := server.AttachBus(bus); err != nil {
+		log.Fatal("AttachBus: ", err)
 	}
 
-	err = ioutil.WriteFile(storageFile, data, 0644)
-	if err != nil {
-		log.Println("Error writing chat messages to file:", err)
+	// The replicas have no table to share webhooks through, so they are
+	// left out unless CHAT_WEBHOOKS_TABLE names one.
+	webhooks, err := chat.OpenWebhooks(chat.WebhookConfig{}.FromEnv(), server)
+	switch {
+	case errors.Is(err, chat.ErrUnsharedWebhooks):
+		log.Println("Webhooks disabled:", err)
+	case err != nil:
+		log.Fatal("OpenWebhooks: ", err)
+	default:
+		go webhooks.Run()
+		webhooks.Register(http.DefaultServeMux) // Webhook administration
 	}
-}
 
-func loadChatMessagesFromFile() {
-	data, err := ioutil.ReadFile(storageFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// File does not exist yet, no need to load messages
-			return
-		}
+	server.Register(http.DefaultServeMux)                   // WebSocket, SSE and long-poll
+	http.Handle("/", http.FileServer(http.Dir("./static"))) // Static file server
 
-		log.Println("Error reading chat messages from file:", err)
-		return
-	}
+	go server.Run()
 
-	err = json.Unmarshal(data, &messages)
+	log.Println("Server started. Listening on port 8080...")
+	err = http.ListenAndServe(":8080", nil)
 	if err != nil {
-		log.Println("Error unmarshaling chat messages:", err)
+		log.Fatal("ListenAndServe: ", err)
 	}
 }
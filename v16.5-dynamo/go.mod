@@ -3,20 +3,27 @@ module github.com/shubcodes/v5
 go 1.20
 
 require (
-	github.com/aws/aws-sdk-go v1.44.301
+	github.com/shubcodes/sdk-k8s_demo/chat v0.0.0
 	golang.ngrok.com/ngrok v1.0.0
 )
 
 require (
+	github.com/aws/aws-sdk-go v1.44.301 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/go-stack/stack v1.8.1 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/inconshreveable/log15 v3.0.0-testing.3+incompatible // indirect
 	github.com/inconshreveable/log15/v3 v3.0.0-testing.5 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/jpillora/backoff v1.0.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.16 // indirect
+	github.com/redis/go-redis/v9 v9.0.5 // indirect
 	golang.org/x/net v0.2.0 // indirect
 	golang.org/x/sys v0.2.0 // indirect
 	golang.org/x/term v0.2.0 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
 )
+
+replace github.com/shubcodes/sdk-k8s_demo/chat => ../chat
@@ -2,6 +2,15 @@ module github.com/k8s_v3
 
 go 1.20
 
-require github.com/aws/aws-sdk-go v1.44.301
+require github.com/shubcodes/sdk-k8s_demo/chat v0.0.0
 
-require github.com/jmespath/go-jmespath v0.4.0 // indirect
+require (
+	github.com/aws/aws-sdk-go v1.44.301 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/redis/go-redis/v9 v9.0.5 // indirect
+)
+
+replace github.com/shubcodes/sdk-k8s_demo/chat => ../chat
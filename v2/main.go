@@ -2,52 +2,49 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"log"
 	"net/http"
-	"sync"
+	"os"
+	"strings"
 
-	"github.com/gorilla/websocket"
+	"github.com/shubcodes/sdk-k8s_demo/chat"
 	"golang.ngrok.com/ngrok"
 	"golang.ngrok.com/ngrok/config"
 )
 
-// Message represents a chat message
-type Message struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-	Content  string `json:"content"`
-}
+func main() {
+	store, err := chat.OpenStore(chat.StoreConfig{Backend: chat.StoreMemory}.FromEnv())
+	if err != nil {
+		log.Fatal("OpenStore: ", err)
+	}
+	server := chat.NewServer(store)
 
-var (
-	clients   = make(map[*websocket.Conn]bool) // Connected clients
-	broadcast = make(chan Message)             // Broadcast channel
-	upgrader  = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	} // Upgrader for WebSocket connections
-	mutex             sync.Mutex // Mutex to synchronize access to clients map
-	messages          []Message  // In-memory storage for chat messages
-	lastSentMessageID int        // Last sent message ID
-)
+	// With the ngrok edge signing users in, trust the user it forwards
+	endpointOpts, edgeAuth := ngrokAuthOptions()
+	authConfig := chat.AuthConfig{}
+	if edgeAuth {
+		authConfig.IdentityHeader = chat.NgrokIdentityHeader
+	}
+	server.Auth, err = chat.OpenAuth(authConfig.FromEnv())
+	if err != nil {
+		log.Fatal("OpenAuth: ", err)
+	}
 
-func main() {
 	fs := http.FileServer(http.Dir("static"))
 	http.Handle("/", fs)
 
 	// WebSocket endpoint
-	http.HandleFunc("/ws", handleWebSocket)
+	http.Handle("/ws", server.Authenticate(http.HandlerFunc(server.HandleWebSocket)))
 
 	// Chat history endpoint
-	http.HandleFunc("/history", getChatHistory)
+	http.Handle("/history", server.Authenticate(http.HandlerFunc(server.HandlePastMessages)))
 
-	go broadcastMessages()
+	go server.Run()
 
 	log.Println("Server started...")
 
 	tun, err := ngrok.Listen(context.Background(),
-		config.HTTPEndpoint(),
+		config.HTTPEndpoint(endpointOpts...),
 		ngrok.WithAuthtokenFromEnv(),
 	)
 	if err != nil {
@@ -56,6 +53,12 @@ func main() {
 
 	log.Println("Server accessible at:", tun.URL())
 
+	// The page is served through the tunnel, so its origin is the tunnel's.
+	err = chat.ConfigureCORS(server, chat.CORSConfig{AllowedOrigins: []string{tun.URL()}}.FromEnv())
+	if err != nil {
+		log.Fatal("ConfigureCORS: ", err)
+	}
+
 	http.HandleFunc("/ws-url", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(tun.URL()))
 	})
@@ -66,92 +69,43 @@ func main() {
 	}
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("WebSocket upgrade failed:", err)
-		return
-	}
-	defer conn.Close()
-
-	// Add client connection to clients map
-	mutex.Lock()
-	clients[conn] = true
-	mutex.Unlock()
-
-	// Send existing chat messages to the new client
-	for _, message := range messages {
-		if message.ID > lastSentMessageID {
-			err := conn.WriteJSON(message)
-			if err != nil {
-				log.Println("WebSocket write error:", err)
-				conn.Close()
-				mutex.Lock()
-				delete(clients, conn)
-				mutex.Unlock()
-				return
-			}
-		}
+// ngrokAuthOptions returns the endpoint options that make the ngrok edge sign
+// users in before forwarding their requests, and whether there are any:
+//
+//	NGROK_OAUTH_PROVIDER      ngrok-managed OAuth provider, e.g. google or github
+//	NGROK_OIDC_ISSUER         or any OpenID Connect provider, with
+//	NGROK_OIDC_CLIENT_ID      the client registered with it
+//	NGROK_OIDC_CLIENT_SECRET  and the client's secret
+//	NGROK_AUTH_ALLOW_DOMAINS  comma-separated email domains let in
+//	NGROK_AUTH_ALLOW_EMAILS   comma-separated email addresses let in
+func ngrokAuthOptions() ([]config.HTTPEndpointOption, bool) {
+	domains := splitEnv("NGROK_AUTH_ALLOW_DOMAINS")
+	emails := splitEnv("NGROK_AUTH_ALLOW_EMAILS")
+
+	if provider := os.Getenv("NGROK_OAUTH_PROVIDER"); provider != "" {
+		return []config.HTTPEndpointOption{config.WithOAuth(provider,
+			config.WithAllowOAuthDomain(domains...),
+			config.WithAllowOAuthEmail(emails...),
+		)}, true
 	}
-
-	for {
-		var message Message
-
-		// Read message from WebSocket connection
-		err := conn.ReadJSON(&message)
-		if err != nil {
-			log.Println("WebSocket read error:", err)
-			break
-		}
-
-		// Generate a unique ID for the new message
-		message.ID = len(messages) + 1
-
-		// Add message to the in-memory storage
-		mutex.Lock()
-		messages = append(messages, message)
-		mutex.Unlock()
-
-		// Update the last sent message ID
-		lastSentMessageID = message.ID
-
-		// Broadcast the received message to all clients
-		broadcast <- message
+	if issuer := os.Getenv("NGROK_OIDC_ISSUER"); issuer != "" {
+		return []config.HTTPEndpointOption{config.WithOIDC(issuer,
+			os.Getenv("NGROK_OIDC_CLIENT_ID"),
+			os.Getenv("NGROK_OIDC_CLIENT_SECRET"),
+			config.WithAllowOIDCDomain(domains...),
+			config.WithAllowOIDCEmail(emails...),
+			config.WithOIDCScope("email"),
+		)}, true
 	}
-
-	// Remove client connection from clients map
-	mutex.Lock()
-	delete(clients, conn)
-	mutex.Unlock()
+	return nil, false
 }
 
-func broadcastMessages() {
-	for {
-		message := <-broadcast
-
-		// Send message to all connected clients
-		for client := range clients {
-			err := client.WriteJSON(message)
-			if err != nil {
-				log.Println("WebSocket write error:", err)
-				client.Close()
-				mutex.Lock()
-				delete(clients, client)
-				mutex.Unlock()
-			}
+func splitEnv(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
 		}
 	}
-}
-
-func getChatHistory(w http.ResponseWriter, r *http.Request) {
-	// Marshal the chat messages into JSON
-	data, err := json.Marshal(messages)
-	if err != nil {
-		log.Println("Error marshaling chat history:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+	return values
 }
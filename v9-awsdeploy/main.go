@@ -2,33 +2,15 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"log"
 	"net/http"
 	"os"
-	"sync"
-	"time"
 
+	"github.com/shubcodes/sdk-k8s_demo/chat"
 	"golang.ngrok.com/ngrok"
 	"golang.ngrok.com/ngrok/config"
 )
 
-type Message struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-	Content  string `json:"content"`
-}
-
-var (
-	clients        = make(map[int]chan Message) // Connected clients
-	broadcast      = make(chan Message)         // Broadcast channel
-	mutex          sync.Mutex                   // Mutex to synchronize access to clients map
-	messages       []Message                    // In-memory storage for chat messages
-	nextClientID   = 1                          // Next client ID
-	nextMessageID  = 1                          // Next message ID
-	pollWaitPeriod = 30 * time.Second           // Maximum wait period for long poll
-)
-
 func main() {
 	if err := run(context.Background()); err != nil {
 		log.Fatal(err)
@@ -48,79 +30,20 @@ func run(ctx context.Context) error {
 
 	//log.Println("tunnel created:", tun.URL())
 
-	fs := http.FileServer(http.Dir("./static"))
-	http.Handle("/", fs)
-
-	http.HandleFunc("/send", handleSendMessage)
-	http.HandleFunc("/receive", handleReceiveMessage)
-	http.HandleFunc("/past_messages", handlePastMessages)
-
-	go broadcastMessages()
-
-	return http.Serve(tun, nil)
-}
-
-func handleSendMessage(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	decoder := json.NewDecoder(r.Body)
-	var message Message
-	err := decoder.Decode(&message)
+	store, err := chat.OpenStore(chat.StoreConfig{Backend: chat.StoreMemory}.FromEnv())
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-
-	message.ID = nextMessageID
-	nextMessageID++
-
-	broadcast <- message
-}
-
-func handleReceiveMessage(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	mutex.Lock()
-	clientID := nextClientID
-	clients[clientID] = make(chan Message, 1)
-	nextClientID++
-	mutex.Unlock()
-
-	select {
-	case message := <-clients[clientID]:
-		json.NewEncoder(w).Encode(message)
-	case <-time.After(pollWaitPeriod):
-		w.WriteHeader(http.StatusNoContent)
+		return err
 	}
+	server := chat.NewServer(store)
 
-	mutex.Lock()
-	delete(clients, clientID)
-	mutex.Unlock()
-}
+	fs := http.FileServer(http.Dir("./static"))
+	http.Handle("/", fs)
 
-func handlePastMessages(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
-		return
-	}
+	http.HandleFunc("/send", server.HandleSend)
+	http.HandleFunc("/receive", server.HandleReceive)
+	http.HandleFunc("/past_messages", server.HandlePastMessages)
 
-	json.NewEncoder(w).Encode(messages)
-}
+	go server.Run()
 
-func broadcastMessages() {
-	for message := range broadcast {
-		messages = append(messages, message)
-
-		mutex.Lock()
-		for _, client := range clients {
-			client <- message
-		}
-		mutex.Unlock()
-	}
+	return http.Serve(tun, nil)
 }